@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// AffinityStreamFor returns the partition stream of given stream that
+// requests whose affinity key maps to the partition are added to.
+func AffinityStreamFor(streamName string, partition int) string {
+	return fmt.Sprintf("%s:affinity:%d", streamName, partition)
+}
+
+// affinityPartition maps the affinity key to one of given number of
+// partitions, the same key always mapping to the same partition.
+func affinityPartition(affinityKey string, partitions int) int {
+	return int(fnv1a(affinityKey) % uint32(partitions))
+}
+
+// ProduceWithAffinity is like Produce, but adds the request to the partition
+// stream that affinityKey maps to, out of AffinityPartitions, so that requests
+// with the same key reach the consumer of that partition. Each partition
+// stream, see AffinityStreamFor, is meant to be consumed by a single consumer,
+// as the consumers of one stream split its requests between them.
+//
+// The mapping only depends on the key and AffinityPartitions, so adding or
+// removing consumers doesn't move keys between partitions, but a partition is
+// stalled until a consumer of it is running again. Changing AffinityPartitions
+// remaps most keys, so requests of a key that are outstanding at that time may
+// be processed by two consumers. Like for WithStreamOverride, which it
+// composes with, partition streams and their groups must be created by the
+// caller, and are only trimmed and reclaimed if they match StreamPattern.
+//
+// With AffinityOrdered, the promises of requests with the same key resolve in
+// the order they were produced, even if their consumer completes them out of
+// order, see AffinityOrdered for its trade-offs.
+func (p *Producer[Request, Response]) ProduceWithAffinity(ctx context.Context, affinityKey string, value Request) (*containers.Promise[Response], error) {
+	partitions := p.config().AffinityPartitions
+	if partitions <= 0 {
+		return nil, ErrAffinityDisabled
+	}
+	stream := AffinityStreamFor(p.streamFor(ctx), affinityPartition(affinityKey, partitions))
+	p.logger.Debug("Redis stream producing with affinity", "affinityKey", affinityKey, "stream", stream, "value", value)
+	p.startIterativeChecks()
+	produce := func() (*containers.Promise[Response], error) {
+		_, promise, err := p.produce(WithStreamOverride(ctx, stream), value, PriorityNormal)
+		return promise, err
+	}
+	if p.config().AffinityOrdered {
+		return p.produceOrdered(produce, affinityKey)
+	}
+	return produce()
+}
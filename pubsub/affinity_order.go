@@ -0,0 +1,89 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// orderedResult is an outstanding request of an affinity key, whose result
+// is buffered once ready until the results of the key's earlier requests are
+// delivered.
+type orderedResult[Response any] struct {
+	// promise returned to the caller, resolved in produce order.
+	promise *containers.Promise[Response]
+	ready   bool
+	res     Response
+	err     error
+}
+
+// affinityOrder sequences the results of requests per affinity key, see
+// AffinityOrdered.
+type affinityOrder[Response any] struct {
+	lock sync.Mutex
+	// keys holds the outstanding requests of each key in produce order.
+	keys map[string][]*orderedResult[Response]
+}
+
+func newAffinityOrder[Response any]() *affinityOrder[Response] {
+	return &affinityOrder[Response]{keys: make(map[string][]*orderedResult[Response])}
+}
+
+// reserve appends a request to the sequence of the key, returns nil if the
+// key already has limit outstanding requests.
+func (o *affinityOrder[Response]) reserve(key string, limit int, promise *containers.Promise[Response]) *orderedResult[Response] {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if limit > 0 && len(o.keys[key]) >= limit {
+		return nil
+	}
+	result := &orderedResult[Response]{promise: promise}
+	o.keys[key] = append(o.keys[key], result)
+	return result
+}
+
+// complete buffers the result of the request and delivers the results of the
+// key that are ready and no longer preceded by an outstanding request.
+func (o *affinityOrder[Response]) complete(key string, result *orderedResult[Response], res Response, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	result.ready, result.res, result.err = true, res, err
+	pending := o.keys[key]
+	for len(pending) > 0 && pending[0].ready {
+		if pending[0].err != nil {
+			pending[0].promise.ProduceError(pending[0].err)
+		} else {
+			pending[0].promise.Produce(pending[0].res)
+		}
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(o.keys, key)
+	} else {
+		o.keys[key] = pending
+	}
+}
+
+// produceOrdered produces the request with affinity, returning a promise that
+// only resolves once the requests of the key produced before it resolved.
+func (p *Producer[Request, Response]) produceOrdered(produce func() (*containers.Promise[Response], error), affinityKey string) (*containers.Promise[Response], error) {
+	promise := containers.NewPromise[Response](nil)
+	result := p.affinityOrder.reserve(affinityKey, p.config().AffinityOrderedMaxOutstanding, &promise)
+	if result == nil {
+		return nil, ErrAffinityOrderFull
+	}
+	produced, err := produce()
+	if err != nil {
+		var zero Response
+		p.affinityOrder.complete(affinityKey, result, zero, err)
+		return nil, err
+	}
+	// Untracked, as StopAndWait only errors the produced promise after its
+	// threads are done
+	p.StopWaiter.LaunchUntrackedThread(func() {
+		<-produced.ReadyChan()
+		res, err := produced.Current()
+		p.affinityOrder.complete(affinityKey, result, res, err)
+	})
+	return &promise, nil
+}
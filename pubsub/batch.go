@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// BatchResult is the outcome of a request of a batch, at Index of the batch.
+type BatchResult[Response any] struct {
+	Index    int
+	Response Response
+	Err      error
+}
+
+// BatchProduceChan produces all the requests and returns a channel on which
+// the result of each request is sent as soon as it resolves, so that callers
+// can process early finishing requests without waiting for the slowest one.
+// The channel is closed once all the requests resolved, timed out, or ctx is
+// done. If producing any of the requests fails, the already produced ones are
+// canceled and the error is returned.
+func (p *Producer[Request, Response]) BatchProduceChan(ctx context.Context, values []Request) (<-chan BatchResult[Response], error) {
+	p.logger.Debug("Redis stream producing batch", "requests", len(values))
+	p.startIterativeChecks()
+	keys := make([]promiseKey, 0, len(values))
+	promises := make([]*containers.Promise[Response], 0, len(values))
+	for i, value := range values {
+		key, promise, err := p.produce(ctx, value, PriorityNormal)
+		if err != nil {
+			p.cancelProduced(ctx, keys)
+			return nil, fmt.Errorf("producing request %d of batch: %w", i, err)
+		}
+		keys = append(keys, key)
+		promises = append(promises, promise)
+	}
+	// Buffered so that senders never block on a slow reader
+	results := make(chan BatchResult[Response], len(promises))
+	remaining := make(chan struct{}, len(promises))
+	for i, promise := range promises {
+		// Untracked, as StopAndWait only errors the promises after its threads
+		// are done
+		p.StopWaiter.LaunchUntrackedThread(func() {
+			defer func() { remaining <- struct{}{} }()
+			select {
+			case <-promise.ReadyChan():
+				res, err := promise.Current()
+				results <- BatchResult[Response]{Index: i, Response: res, Err: err}
+			case <-ctx.Done():
+				results <- BatchResult[Response]{Index: i, Err: ctx.Err()}
+			}
+		})
+	}
+	p.StopWaiter.LaunchUntrackedThread(func() {
+		for range promises {
+			<-remaining
+		}
+		close(results)
+	})
+	return results, nil
+}
+
+// cancelProduced errors with ErrRequestCanceled and stops tracking the
+// promises of given messages, and best effort removes them from redis.
+func (p *Producer[Request, Response]) cancelProduced(ctx context.Context, keys []promiseKey) {
+	for _, key := range keys {
+		shard := p.shardFor(key)
+		shard.lock.Lock()
+		if tracked, found := shard.promises[key]; found {
+			tracked.promise.ProduceError(ErrRequestCanceled)
+			p.stopTracking(shard, key, PromiseCanceled)
+		}
+		p.unlockAndObserve(shard)
+	}
+	for _, key := range keys {
+		p.removeFromRedis(ctx, key.stream, key.id)
+	}
+}
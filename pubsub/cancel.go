@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// cancelKeyFor returns the key the producer sets once the request of given
+// response key is canceled.
+func cancelKeyFor(resultKey string) string { return resultKey + ".canceled" }
+
+// Cancel cancels the request with given message id, its promise errors with
+// ErrRequestCanceled and consumers already processing it are signaled to
+// abort with the cancel key. Returns whether the request was outstanding.
+func (p *Producer[Request, Response]) Cancel(ctx context.Context, msgId string) bool {
+	return p.CancelStream(ctx, p.stream(), msgId)
+}
+
+// CancelStream is like Cancel, for a request produced to given stream rather
+// than the producer's, e.g. one produced before MigrateTo, which is canceled
+// wherever it was moved to.
+func (p *Producer[Request, Response]) CancelStream(ctx context.Context, stream, msgId string) bool {
+	return p.cancel(ctx, promiseKey{stream: stream, id: msgId})
+}
+
+// ProduceCancelable is like Produce, but also returns a function that cancels
+// the request as Cancel does. It's safe to call multiple times and after the
+// promise resolved, in which case it does nothing.
+func (p *Producer[Request, Response]) ProduceCancelable(ctx context.Context, value Request) (*containers.Promise[Response], context.CancelFunc, error) {
+	p.logger.Debug("Redis stream producing cancelable", "value", value)
+	p.startIterativeChecks()
+	key, promise, err := p.produce(ctx, value, PriorityNormal)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Cleanup shouldn't be cut short by the context being canceled too
+	cleanupCtx := context.WithoutCancel(ctx)
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { p.cancel(cleanupCtx, key) })
+	}
+	return promise, cancel, nil
+}
+
+func (p *Producer[Request, Response]) cancel(ctx context.Context, key promiseKey) bool {
+	key, shard, tracked := p.lockTracked(key)
+	if tracked != nil {
+		tracked.promise.ProduceError(ErrRequestCanceled)
+		p.stopTracking(shard, key, PromiseCanceled)
+	}
+	p.unlockAndObserve(shard)
+	if tracked == nil {
+		return false
+	}
+	p.signalCancel(ctx, key.stream, key.id)
+	p.removeFromRedis(ctx, key.stream, key.id)
+	return true
+}
+
+// signalCancel sets the cancel key of the message, it's best effort as
+// consumers not aborting only wastes their work.
+func (p *Producer[Request, Response]) signalCancel(ctx context.Context, stream, msgId string) {
+	cfg := p.config()
+	if cfg.CancelKeyTimeout == 0 {
+		return
+	}
+	key := cancelKeyFor(resultKeyFor(stream, msgId, cfg.UseHashTag))
+	if err := p.client.Set(ctx, key, 1, cfg.CancelKeyTimeout).Err(); err != nil {
+		p.logger.Warn("error setting cancel key", "msgId", msgId, "err", err)
+	}
+}
+
+// Canceled returns whether the producer canceled the message.
+func (c *Consumer[Request, Response]) Canceled(ctx context.Context, messageID string) (bool, error) {
+	key := cancelKeyFor(resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag))
+	err := c.client.Get(ctx, key).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WithCancellation returns a context that is canceled with ErrRequestCanceled
+// as cause once the producer cancels the message, polled every
+// CancelPollInterval, so that long running processing can abort early. The
+// returned cancel func must be called once processing is done.
+func (c *Consumer[Request, Response]) WithCancellation(ctx context.Context, messageID string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if c.cfg.CancelPollInterval == 0 {
+		return ctx, func() { cancel(context.Canceled) }
+	}
+	c.StopWaiter.LaunchThread(func(stopCtx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stopCtx.Done():
+				return
+			case <-time.After(c.cfg.CancelPollInterval):
+			}
+			canceled, err := c.Canceled(ctx, messageID)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn("error checking cancel key", "messageID", messageID, "err", err)
+				}
+				continue
+			}
+			if canceled {
+				log.Info("Request canceled by producer", "messageID", messageID)
+				cancel(ErrRequestCanceled)
+				return
+			}
+		}
+	})
+	return ctx, func() { cancel(context.Canceled) }
+}
@@ -0,0 +1,30 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// redisNow returns the current time of the redis server's clock, estimated
+// from the local clock and the last measured offset between them.
+func (p *Producer[Request, Response]) redisNow() time.Time {
+	return time.Now().Add(time.Duration(p.redisClockOffset.Load()))
+}
+
+// syncRedisTime measures the offset of the redis server's clock from the
+// local clock, assuming the server read its clock halfway through the round
+// trip.
+func (p *Producer[Request, Response]) syncRedisTime(ctx context.Context) time.Duration {
+	cfg := p.config()
+	before := time.Now()
+	redisTime, err := p.client.Time(ctx).Result()
+	if err != nil {
+		p.logger.Warn("error reading redis server time, keeping last measured clock offset", "err", err)
+		return cfg.RedisTimeSyncInterval
+	}
+	after := time.Now()
+	offset := redisTime.Sub(before.Add(after.Sub(before) / 2))
+	p.redisClockOffset.Store(int64(offset))
+	p.logger.Debug("measured redis clock offset", "offset", offset, "rtt", after.Sub(before))
+	return cfg.RedisTimeSyncInterval
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// coalescedBatchCounter counts the pipelines of coalesced XADDs, which along
+// with the XADD counter gives the average batch size.
+var coalescedBatchCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/xadd/coalesced/batches", nil)
+
+// xaddCoalescer buffers XADDs for a short window and sends the buffered ones
+// in one pipeline, each caller still getting the id of its own entry.
+type xaddCoalescer struct {
+	client   redis.UniversalClient
+	window   time.Duration
+	maxBatch int
+
+	lock    sync.Mutex
+	pending []*coalescedXAdd
+	timer   *time.Timer
+	// flushLock serializes flushes, so that entries are added in the order
+	// they were buffered and their ids ascend in that order.
+	flushLock sync.Mutex
+}
+
+type coalescedXAdd struct {
+	args *redis.XAddArgs
+	id   string
+	err  error
+	done chan struct{}
+}
+
+func newXAddCoalescer(client redis.UniversalClient, window time.Duration, maxBatch int) *xaddCoalescer {
+	return &xaddCoalescer{client: client, window: window, maxBatch: max(maxBatch, 1)}
+}
+
+// add buffers the XADD and returns the id of the entry once its batch was
+// flushed, either after the window or once the buffer filled.
+func (c *xaddCoalescer) add(args *redis.XAddArgs) (string, error) {
+	x := &coalescedXAdd{args: args, done: make(chan struct{})}
+	c.lock.Lock()
+	c.pending = append(c.pending, x)
+	full := len(c.pending) >= c.maxBatch
+	if full && c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	} else if !full && c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+	c.lock.Unlock()
+	if full {
+		c.flush()
+	}
+	<-x.done
+	return x.id, x.err
+}
+
+// flush sends the buffered XADDs in pipelines of up to maxBatch, leaving a
+// partial batch buffered for its window if there's one after a full batch.
+func (c *xaddCoalescer) flush() {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+	for first := true; ; first = false {
+		c.lock.Lock()
+		if !first && len(c.pending) < c.maxBatch {
+			if len(c.pending) > 0 && c.timer == nil {
+				c.timer = time.AfterFunc(c.window, c.flush)
+			}
+			c.lock.Unlock()
+			return
+		}
+		n := min(len(c.pending), c.maxBatch)
+		batch := c.pending[:n:n]
+		c.pending = c.pending[n:]
+		if len(c.pending) == 0 && c.timer != nil {
+			c.timer.Stop()
+			c.timer = nil
+		}
+		c.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		c.send(batch)
+	}
+}
+
+// send adds the entries of the batch in one pipeline. It doesn't use the
+// contexts of the callers, so that one giving up doesn't fail the others.
+func (c *xaddCoalescer) send(batch []*coalescedXAdd) {
+	ctx := context.Background()
+	start := time.Now()
+	pipe := c.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(batch))
+	for i, x := range batch {
+		cmds[i] = pipe.XAdd(ctx, x.args)
+	}
+	// Errors are reported by each command
+	_, _ = pipe.Exec(ctx)
+	coalescedBatchCounter.Inc(1)
+	for i, x := range batch {
+		x.id, x.err = cmds[i].Result()
+		recordXAdd(x.args.Stream, start, x.err)
+		close(x.done)
+	}
+}
@@ -2,16 +2,164 @@ package pubsub
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 
 	"github.com/ethereum/go-ethereum/log"
 )
 
+// allowedOldestID returns the id below which messages are past given timeout.
+func allowedOldestID(now time.Time, timeout time.Duration) string {
+	return fmt.Sprintf("%d-0", now.Add(-timeout).UnixMilli())
+}
+
+// isNoGroupErr returns whether err is the redis error returned when the stream
+// or its consumer group doesn't exist.
+func isNoGroupErr(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
+
+// isBusyGroupErr returns whether err is the redis error returned when creating
+// a consumer group that already exists.
+func isBusyGroupErr(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP")
+}
+
 func ResultKeyFor(streamName, id string) string { return fmt.Sprintf("%s.%s", streamName, id) }
 
+// idempotencyKeyFor returns the key that maps an idempotency key of requests
+// produced to the stream to the id of the message produced for it.
+func idempotencyKeyFor(streamName, key string) string {
+	return fmt.Sprintf("%s.idempotency.%s", streamName, key)
+}
+
+// HashTaggedResultKeyFor is like ResultKeyFor but wraps the stream name in a
+// hash tag, so that in redis cluster the response key is stored in the same
+// slot as the stream itself.
+func HashTaggedResultKeyFor(streamName, id string) string {
+	return fmt.Sprintf("{%s}.%s", streamName, id)
+}
+
+// payloadField returns the configured field of stream entries holding the
+// marshaled request, defaulting to messageKey.
+func payloadField(field string) string {
+	if field == "" {
+		return messageKey
+	}
+	return field
+}
+
+// messageChunkKeyFor returns the field of the stream entry holding i'th chunk
+// of a request produced with ProduceStream.
+func messageChunkKeyFor(field string, i int) string {
+	return fmt.Sprintf("%s#%d", payloadField(field), i)
+}
+
+// messageChunksKeyFor returns the field of the stream entry holding the number
+// of chunks of a request produced with ProduceStream.
+func messageChunksKeyFor(field string) string { return payloadField(field) + "-chunks" }
+
+// messageData returns the marshaled request of a stream entry, reassembling it
+// when it was written in chunks, decrypting and decompressing it.
+func messageData(values map[string]any, field string, ciphers *cipherSet) ([]byte, error) {
+	if countVal, found := values[messageChunksKeyFor(field)]; found {
+		countStr, ok := countVal.(string)
+		if !ok {
+			return nil, errors.New("error casting chunks count to string")
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunks count: %v, error: %w", countStr, err)
+		}
+		var data []byte
+		for i := 0; i < count; i++ {
+			chunk, ok := fieldBytes(values[messageChunkKeyFor(field, i)])
+			if !ok {
+				return nil, fmt.Errorf("missing chunk %d of %d", i, count)
+			}
+			plain, err := ciphers.decrypt(chunk)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %d of %d: %w", i, count, err)
+			}
+			data = append(data, plain...)
+		}
+		return data, nil
+	}
+	data, ok := fieldBytes(values[payloadField(field)])
+	if !ok {
+		return nil, errors.New("error casting request to bytes")
+	}
+	data, err := ciphers.decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+// fieldBytes returns the bytes of a stream entry's field value. Values are
+// added as bytes, which redis stores binary-safe, and read back as strings
+// holding the same bytes.
+func fieldBytes(value any) ([]byte, bool) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// chunkedMarkerPrefix prefixes the value of a response key when the response
+// is written in chunks, followed by the number of chunks. JSON values can't
+// start with '#', so the marker can't be confused with a response.
+const chunkedMarkerPrefix = "#chunks:"
+
+// chunkKeyFor returns the key of i'th chunk of a chunked response.
+func chunkKeyFor(resultKey string, i int) string { return fmt.Sprintf("%s#%d", resultKey, i) }
+
+func chunkedMarker(count int) string { return chunkedMarkerPrefix + strconv.Itoa(count) }
+
+// parseChunkedMarker returns the number of chunks if value of the response key
+// is a chunked response marker.
+func parseChunkedMarker(value string) (int, bool) {
+	if !strings.HasPrefix(value, chunkedMarkerPrefix) {
+		return 0, false
+	}
+	count, err := strconv.Atoi(strings.TrimPrefix(value, chunkedMarkerPrefix))
+	if err != nil || count < 0 {
+		return 0, true
+	}
+	return count, true
+}
+
+// errorMarkerPrefix prefixes the value of a response key when the consumer
+// failed processing the request, followed by the error message.
+const errorMarkerPrefix = "#error:"
+
+func errorMarker(err error) string { return errorMarkerPrefix + err.Error() }
+
+// parseErrorMarker returns the error message if value of the response key is
+// an error marker.
+func parseErrorMarker(value string) (string, bool) {
+	if !strings.HasPrefix(value, errorMarkerPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(value, errorMarkerPrefix), true
+}
+
+func resultKeyFor(streamName, id string, useHashTag bool) string {
+	if useHashTag {
+		return HashTaggedResultKeyFor(streamName, id)
+	}
+	return ResultKeyFor(streamName, id)
+}
+
 // CreateStream tries to create stream with given name, if it already exists
 // does not return an error.
 func CreateStream(ctx context.Context, streamName string, client redis.UniversalClient) error {
@@ -22,6 +170,23 @@ func CreateStream(ctx context.Context, streamName string, client redis.Universal
 	return nil
 }
 
+// groupExists returns whether the stream exists and has the consumer group.
+func groupExists(ctx context.Context, client redis.UniversalClient, streamName, group string) (bool, error) {
+	groups, err := client.XInfoGroups(ctx, streamName).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, g := range groups {
+		if g.Name == group {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // StreamExists returns whether there are any consumer group for specified
 // redis stream.
 func StreamExists(ctx context.Context, streamName string, client redis.UniversalClient) bool {
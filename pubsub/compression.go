@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// compressionMarkerPrefix prefixes payloads that were gzip compressed,
+// followed by the compressed bytes. JSON values can't start with '#', so the
+// marker can't be confused with an uncompressed payload and each payload
+// records whether it was compressed.
+const compressionMarkerPrefix = "#gz:"
+
+// compress gzip compresses payloads larger than minBytes, smaller payloads
+// and all payloads when minBytes is 0 are returned as is.
+func compress(data []byte, minBytes int) ([]byte, error) {
+	if minBytes <= 0 || len(data) <= minBytes {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(compressionMarkerPrefix)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("compressing payload: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compressing payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the uncompressed bytes of a compressed payload, payloads
+// that aren't compressed are returned as is.
+func decompress(data []byte) ([]byte, error) {
+	rest, found := bytes.CutPrefix(data, []byte(compressionMarkerPrefix))
+	if !found {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %w", err)
+	}
+	defer r.Close()
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %w", err)
+	}
+	return plain, nil
+}
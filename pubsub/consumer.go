@@ -24,21 +24,74 @@ type ConsumerConfig struct {
 	ResponseEntryTimeout time.Duration `koanf:"response-entry-timeout"`
 	// Minimum idle time after which messages will be autoclaimed
 	IdletimeToAutoclaim time.Duration `koanf:"idletime-to-autoclaim"`
+	// UseHashTag wraps the stream name of response keys in a redis cluster
+	// hash tag, producers of the stream must have the same setting.
+	UseHashTag bool `koanf:"use-hash-tag"`
+	// PayloadField is the field of stream entries holding the marshaled
+	// request, producers of the stream must have the same setting. Empty
+	// means "msg".
+	PayloadField string `koanf:"payload-field"`
+	// CancelPollInterval is the interval in which contexts returned by
+	// WithCancellation check whether the producer canceled the message. Zero
+	// disables the checks.
+	CancelPollInterval time.Duration `koanf:"cancel-poll-interval"`
+	// ResponseHMACKey is the shared secret responses are HMAC-signed with,
+	// producers of the stream must have the same key. Empty disables signing.
+	ResponseHMACKey string `koanf:"response-hmac-key"`
+	// EncryptionKeys are the keys request and response payloads are
+	// encrypted with at rest, formatted as "id:hex-encoded key", producers of
+	// the stream must have the same keys. The first key encrypts.
+	EncryptionKeys []string `koanf:"encryption-keys"`
+	// ResponseStream makes consumers add responses to the response stream of
+	// the request stream, see ResponseStreamFor, instead of setting a key per
+	// response. Must match producers.
+	ResponseStream bool `koanf:"response-stream"`
+	// HeartbeatInterval is the interval in which consumers update the
+	// heartbeat key of the message they process, see HeartbeatStaleness of
+	// producers. Zero disables heartbeats.
+	HeartbeatInterval time.Duration `koanf:"heartbeat-interval"`
+	// CompressionMinBytes is the size in bytes above which marshaled responses
+	// are gzip compressed, zero disables compression.
+	CompressionMinBytes int `koanf:"compression-min-bytes"`
 }
 
 var DefaultConsumerConfig = ConsumerConfig{
 	ResponseEntryTimeout: time.Hour,
 	IdletimeToAutoclaim:  5 * time.Minute,
+	UseHashTag:           false,
+	PayloadField:         messageKey,
+	CancelPollInterval:   time.Second,
+	ResponseHMACKey:      "",
+	EncryptionKeys:       nil,
+	ResponseStream:       false,
+	HeartbeatInterval:    0,
+	CompressionMinBytes:  0,
 }
 
 var TestConsumerConfig = ConsumerConfig{
 	ResponseEntryTimeout: time.Minute,
 	IdletimeToAutoclaim:  30 * time.Millisecond,
+	UseHashTag:           false,
+	PayloadField:         messageKey,
+	CancelPollInterval:   10 * time.Millisecond,
+	ResponseHMACKey:      "",
+	EncryptionKeys:       nil,
+	ResponseStream:       false,
+	HeartbeatInterval:    10 * time.Millisecond,
+	CompressionMinBytes:  0,
 }
 
 func ConsumerConfigAddOptions(prefix string, f *pflag.FlagSet) {
 	f.Duration(prefix+".response-entry-timeout", DefaultConsumerConfig.ResponseEntryTimeout, "timeout for response entry")
 	f.Duration(prefix+".idletime-to-autoclaim", DefaultConsumerConfig.IdletimeToAutoclaim, "After a message spends this amount of time in PEL (Pending Entries List i.e claimed by another consumer but not Acknowledged) it will be allowed to be autoclaimed by other consumers")
+	f.Bool(prefix+".use-hash-tag", DefaultConsumerConfig.UseHashTag, "wrap stream name of response keys in a hash tag so that they are in the same redis cluster slot as the stream (must match producers)")
+	f.String(prefix+".payload-field", DefaultConsumerConfig.PayloadField, "field of stream entries holding the marshaled request (must match producers)")
+	f.Duration(prefix+".cancel-poll-interval", DefaultConsumerConfig.CancelPollInterval, "interval in which consumers check whether the message they process was canceled by the producer (0 = disabled)")
+	f.String(prefix+".response-hmac-key", DefaultConsumerConfig.ResponseHMACKey, "shared secret responses are signed with (must match producers, empty = disabled)")
+	f.StringSlice(prefix+".encryption-keys", DefaultConsumerConfig.EncryptionKeys, "keys requests and responses are encrypted with at rest in redis, formatted as id:hex-encoded AES key, the first one encrypts and all decrypt (must match producers)")
+	f.Bool(prefix+".response-stream", DefaultConsumerConfig.ResponseStream, "write responses to a response stream of the request stream rather than separate keys (must match producers)")
+	f.Duration(prefix+".heartbeat-interval", DefaultConsumerConfig.HeartbeatInterval, "interval in which consumers update the heartbeat of the message they process, read by producers with heartbeat-staleness set (0 = disabled)")
+	f.Int(prefix+".compression-min-bytes", DefaultConsumerConfig.CompressionMinBytes, "gzip compress responses whose marshaled size is larger than this many bytes (0 disables compression)")
 }
 
 // Consumer implements a consumer for redis stream provides heartbeat to
@@ -50,24 +103,37 @@ type Consumer[Request any, Response any] struct {
 	redisStream string
 	redisGroup  string
 	cfg         *ConsumerConfig
+	// ciphers is nil when payloads aren't encrypted.
+	ciphers *cipherSet
 }
 
 type Message[Request any] struct {
 	ID    string
 	Value Request
 	Ack   func()
+	// NoResponse is set for messages produced with ProduceNoWait, they should
+	// be finished with Complete instead of SetResult.
+	NoResponse bool
+	// QoS is the class the message was produced with by ProduceWithQoS, for
+	// consumers to schedule their work by.
+	QoS QoSClass
 }
 
 func NewConsumer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ConsumerConfig) (*Consumer[Request, Response], error) {
 	if streamName == "" {
 		return nil, fmt.Errorf("redis stream name cannot be empty")
 	}
+	ciphers, err := newCipherSet(cfg.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
+	}
 	return &Consumer[Request, Response]{
 		id:          uuid.NewString(),
 		client:      client,
 		redisStream: streamName,
 		redisGroup:  streamName, // There is 1-1 mapping of redis stream and consumer group.
 		cfg:         cfg,
+		ciphers:     ciphers,
 	}, nil
 }
 
@@ -160,16 +226,24 @@ func (c *Consumer[Request, Response]) Consume(ctx context.Context) (*Message[Req
 		messages = res[0].Messages
 	}
 
-	var (
-		value    = messages[0].Values[messageKey]
-		data, ok = (value).(string)
-	)
-	if !ok {
-		return nil, errors.New("error casting request to string")
+	if notBefore, scheduled := parseNotBefore(messages[0].Values); scheduled && time.Now().Before(notBefore) {
+		// Leave it idle in the PEL without heartbeating, so that it's autoclaimed again later
+		log.Debug("Skipping scheduled message that isn't due yet", "messageID", messages[0].ID, "notBefore", notBefore)
+		return nil, nil
+	}
+	if c.skipPastDeadline(ctx, messages[0]) {
+		return nil, nil
+	}
+	data, err := messageData(messages[0].Values, c.cfg.PayloadField, c.ciphers)
+	if err != nil {
+		return nil, err
 	}
 	var req Request
-	if err := json.Unmarshal([]byte(data), &req); err != nil {
-		return nil, fmt.Errorf("unmarshaling value: %v, error: %w", value, err)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("unmarshaling value: %v, error: %w", string(data), err)
+	}
+	if _, wantsReceipt := messages[0].Values[receiptKey]; wantsReceipt {
+		c.sendReceipt(ctx, messages[0].ID)
 	}
 	ackNotifier := make(chan struct{})
 	c.StopWaiter.LaunchThread(func(ctx context.Context) {
@@ -205,11 +279,18 @@ func (c *Consumer[Request, Response]) Consume(ctx context.Context) (*Message[Req
 			}
 		}
 	})
+	if c.cfg.HeartbeatInterval != 0 {
+		msgId := messages[0].ID
+		c.StopWaiter.LaunchThread(func(ctx context.Context) { c.heartbeat(ctx, msgId, ackNotifier) })
+	}
 	log.Debug("Redis stream consuming", "consumer_id", c.id, "message_id", messages[0].ID)
+	_, noResponse := messages[0].Values[noResponseKey]
 	return &Message[Request]{
-		ID:    messages[0].ID,
-		Value: req,
-		Ack:   func() { close(ackNotifier) },
+		ID:         messages[0].ID,
+		Value:      req,
+		Ack:        func() { close(ackNotifier) },
+		NoResponse: noResponse,
+		QoS:        parseQoS(messages[0].Values),
 	}, nil
 }
 
@@ -218,12 +299,93 @@ func (c *Consumer[Request, Response]) SetResult(ctx context.Context, messageID s
 	if err != nil {
 		return fmt.Errorf("marshaling result: %w", err)
 	}
-	resultKey := ResultKeyFor(c.StreamName(), messageID)
+	return c.setResponse(ctx, messageID, resp)
+}
+
+// SetResultWithMeta is like SetResult, but also reports metadata about the
+// processing of the message, which producers surface with AwaitWithMeta.
+func (c *Consumer[Request, Response]) SetResultWithMeta(ctx context.Context, messageID string, result Response, meta ResponseMeta) error {
+	resp, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("marshaling result: %w", err)
+	}
+	value, err := metaMarker(meta, resp)
+	if err != nil {
+		return err
+	}
+	return c.setResponse(ctx, messageID, value)
+}
+
+// setResponse writes the value of the message's response key and completes it.
+func (c *Consumer[Request, Response]) setResponse(ctx context.Context, messageID string, resp []byte) error {
+	resp, err := compress(resp, c.cfg.CompressionMinBytes)
+	if err != nil {
+		return err
+	}
+	if resp, err = c.ciphers.encrypt(resp); err != nil {
+		return err
+	}
+	resultKey := resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag)
 	log.Debug("consumer: setting result", "cid", c.id, "msgIdInStream", messageID, "resultKeyInRedis", resultKey)
-	acquired, err := c.client.SetNX(ctx, resultKey, resp, c.cfg.ResponseEntryTimeout).Result()
+	acquired, err := c.writeResponse(ctx, messageID, resultKey, c.sign(messageID, string(resp), resp))
 	if err != nil || !acquired {
 		return fmt.Errorf("setting result for message with message-id in stream: %v, error: %w", messageID, err)
 	}
+	return c.Complete(ctx, messageID)
+}
+
+// SetError reports that processing the message failed with given error, the
+// producer's promise for the message errors with ErrConsumerError and the
+// error's message.
+func (c *Consumer[Request, Response]) SetError(ctx context.Context, messageID string, processErr error) error {
+	if processErr == nil {
+		return errors.New("error to set cannot be nil")
+	}
+	resultKey := resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag)
+	log.Debug("consumer: setting error", "cid", c.id, "msgIdInStream", messageID, "resultKeyInRedis", resultKey, "error", processErr)
+	marker := errorMarker(processErr)
+	acquired, err := c.writeResponse(ctx, messageID, resultKey, c.sign(messageID, marker, []byte(marker)))
+	if err != nil || !acquired {
+		return fmt.Errorf("setting error for message with message-id in stream: %v, error: %w", messageID, err)
+	}
+	return c.Complete(ctx, messageID)
+}
+
+// SetChunkedResult is like SetResult, but writes the marshaled result split in
+// chunks of at most chunkSize bytes to separate keys, for results larger than
+// is comfortable for a single redis value.
+func (c *Consumer[Request, Response]) SetChunkedResult(ctx context.Context, messageID string, result Response, chunkSize int) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	resp, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("marshaling result: %w", err)
+	}
+	if resp, err = c.ciphers.encrypt(resp); err != nil {
+		return err
+	}
+	resultKey := resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag)
+	count := 0
+	for start := 0; start < len(resp); start += chunkSize {
+		end := min(start+chunkSize, len(resp))
+		if err := c.client.Set(ctx, chunkKeyFor(resultKey, count), resp[start:end], c.cfg.ResponseEntryTimeout).Err(); err != nil {
+			return fmt.Errorf("setting result chunk %d for message with message-id in stream: %v, error: %w", count, messageID, err)
+		}
+		count++
+	}
+	log.Debug("consumer: setting chunked result", "cid", c.id, "msgIdInStream", messageID, "resultKeyInRedis", resultKey, "chunks", count)
+	// The marker is written last, so that producer only sees the response once all of its chunks are written.
+	acquired, err := c.writeResponse(ctx, messageID, resultKey, c.sign(messageID, chunkedMarker(count), resp))
+	if err != nil || !acquired {
+		return fmt.Errorf("setting result for message with message-id in stream: %v, error: %w", messageID, err)
+	}
+	return c.Complete(ctx, messageID)
+}
+
+// Complete acknowledges and deletes the message from the stream without
+// writing a response for it.
+func (c *Consumer[Request, Response]) Complete(ctx context.Context, messageID string) error {
 	log.Debug("consumer: xack", "cid", c.id, "messageId", messageID)
 	if _, err := c.client.XAck(ctx, c.redisStream, c.redisGroup, messageID).Result(); err != nil {
 		return fmt.Errorf("acking message: %v, error: %w", messageID, err)
@@ -0,0 +1,118 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	deadConsumerMovedCounter   = metrics.NewRegisteredCounter("arb/pubsub/producer/dead_consumer/moved", nil)
+	deadConsumerRemovedCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/dead_consumer/removed", nil)
+)
+
+// reclaimDeadConsumers moves all the pending requests of consumers that have
+// been idle for longer than DeadConsumerIdle off them, keeping their idle
+// time so that live consumers autoclaim them right away, rather than waiting
+// for each to be picked or reclaimed separately. Dead consumers are then
+// removed from the group, so that they don't pile up in XINFO CONSUMERS.
+func (p *Producer[Request, Response]) reclaimDeadConsumers(ctx context.Context) time.Duration {
+	cfg := p.config()
+	consumers, err := p.client.XInfoConsumers(ctx, p.stream(), p.group()).Result()
+	if err != nil {
+		p.logger.Error("error getting consumers of the group", "err", err)
+		return 5 * cfg.CheckResultInterval
+	}
+	for _, consumer := range consumers {
+		// Requests moved by this producer are idle under its name
+		if consumer.Name == p.id || consumer.Idle < cfg.DeadConsumerIdle {
+			continue
+		}
+		if consumer.Pending > 0 {
+			moved, err := p.moveDeadConsumerPending(ctx, consumer.Name)
+			if err != nil {
+				p.logger.Error("error moving pending requests of dead consumer", "consumer", consumer.Name, "err", err)
+				continue
+			}
+			deadConsumerMovedCounter.Inc(moved)
+			p.logger.Warn("moved pending requests of dead consumer", "consumer", consumer.Name, "idle", consumer.Idle, "moved", moved)
+		}
+		if err := p.removeDeadConsumer(ctx, consumer.Name); err != nil {
+			p.logger.Error("error removing dead consumer from the group", "consumer", consumer.Name, "err", err)
+		}
+	}
+	return 5 * cfg.CheckResultInterval
+}
+
+// moveDeadConsumerPending claims all the pending requests of the consumer in
+// batches of DeadConsumerReclaimBatch, setting their idle time back to what
+// it was. Requests that were claimed since the consumer was deemed dead are
+// left alone, as they are no longer idle for DeadConsumerIdle.
+func (p *Producer[Request, Response]) moveDeadConsumerPending(ctx context.Context, consumer string) (int64, error) {
+	cfg := p.config()
+	batch := max(cfg.DeadConsumerReclaimBatch, 1)
+	var moved int64
+	for {
+		entries, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   p.stream(),
+			Group:    p.group(),
+			Start:    "-",
+			End:      "+",
+			Count:    batch,
+			Consumer: consumer,
+			Idle:     cfg.DeadConsumerIdle,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return moved, fmt.Errorf("getting pending requests: %w", err)
+		}
+		if len(entries) == 0 {
+			return moved, nil
+		}
+		idle := entries[0].Idle
+		args := []any{"XCLAIM", p.stream(), p.group(), p.id, cfg.DeadConsumerIdle.Milliseconds()}
+		for _, entry := range entries {
+			args = append(args, entry.ID)
+			idle = min(idle, entry.Idle)
+		}
+		args = append(args, "IDLE", idle.Milliseconds(), "JUSTID")
+		claimed, err := p.client.Do(ctx, args...).StringSlice()
+		if err != nil {
+			return moved, fmt.Errorf("claiming pending requests: %w", err)
+		}
+		moved += int64(len(claimed))
+		if int64(len(entries)) < batch || len(claimed) == 0 {
+			return moved, nil
+		}
+	}
+}
+
+// removeDeadConsumer deletes the consumer from the group once its pending
+// list is drained. Deleting a consumer drops its pending requests from the
+// PEL, so it's left in the group while it has any.
+func (p *Producer[Request, Response]) removeDeadConsumer(ctx context.Context, consumer string) error {
+	pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   p.stream(),
+		Group:    p.group(),
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: consumer,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("getting pending requests: %w", err)
+	}
+	if len(pending) > 0 {
+		p.logger.Debug("not removing dead consumer with pending requests", "consumer", consumer)
+		return nil
+	}
+	if err := p.client.XGroupDelConsumer(ctx, p.stream(), p.group(), consumer).Err(); err != nil {
+		return fmt.Errorf("deleting consumer: %w", err)
+	}
+	deadConsumerRemovedCounter.Inc(1)
+	p.logger.Info("removed dead consumer from the group", "consumer", consumer)
+	return nil
+}
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// deadlineKey is the field of the stream entry holding the unix time in
+// milliseconds after which the request shouldn't be processed anymore.
+const deadlineKey = "deadline"
+
+// ProduceWithDeadline is like Produce, but consumers skip the request if they
+// get to it after given deadline, which errors its promise with
+// ErrDeadlineExceeded instead of processing it late. Requests already being
+// processed when the deadline passes aren't affected.
+func (p *Producer[Request, Response]) ProduceWithDeadline(ctx context.Context, value Request, deadline time.Time) (*containers.Promise[Response], error) {
+	p.logger.Debug("Redis stream producing with deadline", "value", value, "deadline", deadline)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{payloadField(p.config().PayloadField): val, deadlineKey: deadline.UnixMilli()}
+	_, promise, err := p.produceValues(ctx, values, PriorityNormal, func(tracked *trackedPromise[Response]) {
+		tracked.processDeadline = deadline
+	})
+	return promise, err
+}
+
+// skipPastDeadline reports the message as failed with ErrDeadlineExceeded if
+// its deadline has passed, returns whether it did.
+func (c *Consumer[Request, Response]) skipPastDeadline(ctx context.Context, msg redis.XMessage) bool {
+	deadline, found := parseUnixMilli(msg.Values, deadlineKey)
+	if !found || !time.Now().After(deadline) {
+		return false
+	}
+	log.Info("Skipping message past its deadline", "messageID", msg.ID, "deadline", deadline)
+	if err := c.SetError(ctx, msg.ID, ErrDeadlineExceeded); err != nil {
+		log.Error("Error reporting message past its deadline", "messageID", msg.ID, "err", err)
+	}
+	return true
+}
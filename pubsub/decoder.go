@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// ResponseDecoder decodes the bytes of a response, as set by consumers.
+type ResponseDecoder[Response any] func(data []byte) (Response, error)
+
+// ProduceWithDecoder is like Produce, but the response is decoded with given
+// decoder instead of json.Unmarshal, e.g. for polymorphic payloads. Decoding
+// errors are handled like unmarshaling errors, including UnmarshalRetries.
+func (p *Producer[Request, Response]) ProduceWithDecoder(ctx context.Context, value Request, decode ResponseDecoder[Response]) (*containers.Promise[Response], error) {
+	if decode == nil {
+		return nil, errors.New("decoder cannot be nil")
+	}
+	p.logger.Debug("Redis stream producing with decoder", "value", value)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	_, promise, err := p.produceValues(ctx, map[string]any{payloadField(p.config().PayloadField): val}, PriorityNormal, func(tracked *trackedPromise[Response]) {
+		tracked.decode = decode
+	})
+	return promise, err
+}
+
+// unmarshal decodes the response with the decoder of the promise, or
+// json.Unmarshal if it has none.
+func (t *trackedPromise[Response]) unmarshal(data []byte, resp *Response) error {
+	if t.decode == nil {
+		return json.Unmarshal(data, resp)
+	}
+	decoded, err := t.decode(data)
+	if err != nil {
+		return err
+	}
+	*resp = decoded
+	return nil
+}
@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redactedSecret replaces secrets of the config in diagnostics.
+const redactedSecret = "<redacted>"
+
+// Diagnostics is a snapshot of the state of a producer and its stream, meant
+// to be logged or serialized to JSON when investigating issues. Secrets of
+// its Config are redacted.
+type Diagnostics struct {
+	ProducerID  string
+	Config      ProducerConfig
+	Outstanding int
+	Stream      *redis.XInfoStream
+	Groups      []redis.XInfoGroup
+	Pending     *redis.XPending
+}
+
+// Diagnostics returns a snapshot of the producer's outstanding requests along
+// with XINFO STREAM, XINFO GROUPS and XPENDING summary of its stream.
+func (p *Producer[Request, Response]) Diagnostics(ctx context.Context) (Diagnostics, error) {
+	d := Diagnostics{
+		ProducerID:  p.id,
+		Config:      p.config().redacted(),
+		Outstanding: p.promisesLen(),
+	}
+	var err error
+	if d.Stream, err = p.client.XInfoStream(ctx, p.stream()).Result(); err != nil {
+		return d, fmt.Errorf("getting stream info: %w", err)
+	}
+	if d.Groups, err = p.client.XInfoGroups(ctx, p.stream()).Result(); err != nil {
+		return d, fmt.Errorf("getting groups info: %w", err)
+	}
+	if d.Pending, err = p.client.XPending(ctx, p.stream(), p.group()).Result(); err != nil {
+		return d, fmt.Errorf("getting pending entries summary: %w", err)
+	}
+	return d, nil
+}
+
+// redacted returns a copy of the config whose secrets are replaced, so that
+// it's safe to log. The ids of encryption keys are kept, to tell which keys
+// are configured.
+func (c *ProducerConfig) redacted() ProducerConfig {
+	r := *c
+	if r.ResponseHMACKey != "" {
+		r.ResponseHMACKey = redactedSecret
+	}
+	r.EncryptionKeys = make([]string, len(c.EncryptionKeys))
+	for i, key := range c.EncryptionKeys {
+		id, _, _ := strings.Cut(key, ":")
+		r.EncryptionKeys[i] = id + ":" + redactedSecret
+	}
+	return r
+}
+
+// visitPendingBatch is the number of PEL entries fetched per XPENDING call
+// while visiting pending messages.
+const visitPendingBatch = 100
+
+// PendingEntry describes a message in the pending entries list of the
+// producer's consumer group.
+type PendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	RetryCount int64
+}
+
+// VisitPending calls visit for each entry of the PEL of the producer's stream
+// in id order, until visit returns false or all entries were visited. It only
+// reads the PEL and never claims or acknowledges messages.
+func (p *Producer[Request, Response]) VisitPending(ctx context.Context, visit func(PendingEntry) bool) error {
+	start := "-"
+	for {
+		entries, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: p.stream(),
+			Group:  p.group(),
+			Start:  start,
+			End:    "+",
+			Count:  visitPendingBatch,
+		}).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			return fmt.Errorf("reading pending entries: %w", err)
+		}
+		for _, e := range entries {
+			if !visit(PendingEntry{ID: e.ID, Consumer: e.Consumer, Idle: e.Idle, RetryCount: e.RetryCount}) {
+				return nil
+			}
+		}
+		if len(entries) < visitPendingBatch {
+			return nil
+		}
+		parts, err := getUintParts(entries[len(entries)-1].ID)
+		if err != nil {
+			return fmt.Errorf("parsing pending entry id: %w", err)
+		}
+		start = fmt.Sprintf("%d-%d", parts[0], parts[1]+1)
+	}
+}
@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// discoverScanCount is the COUNT hint of SCAN calls discovering streams.
+const discoverScanCount = 1000
+
+// discoverStreams scans the keys for streams matching StreamPattern and
+// replaces the discovered streams with them. On cluster clients only the
+// node the SCAN is sent to is scanned.
+func (p *Producer[Request, Response]) discoverStreams(ctx context.Context) time.Duration {
+	cfg := p.config()
+	var streams []string
+	var cursor uint64
+	for {
+		keys, next, err := p.client.ScanType(ctx, cursor, cfg.StreamPattern, discoverScanCount, "stream").Result()
+		if err != nil {
+			p.logger.Error("error discovering streams", "pattern", cfg.StreamPattern, "err", err)
+			return cfg.StreamDiscoveryInterval
+		}
+		streams = append(streams, keys...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	p.streams.Store(&streams)
+	p.logger.Debug("discovered streams", "pattern", cfg.StreamPattern, "streams", len(streams))
+	return cfg.StreamDiscoveryInterval
+}
+
+// discoveredStreams returns the streams last discovered, nil if none.
+func (p *Producer[Request, Response]) discoveredStreams() []string {
+	if streams := p.streams.Load(); streams != nil {
+		return *streams
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptionMarkerPrefix prefixes payloads encrypted at rest, followed by the
+// id of the key, ':' and the nonce and ciphertext. JSON values can't start
+// with '#', so the marker can't be confused with a plaintext payload.
+const encryptionMarkerPrefix = "#enc:"
+
+// cipherSet encrypts payloads with its primary key and decrypts payloads of
+// any of its keys, so that keys can be rotated. A nil cipherSet leaves
+// payloads as is.
+type cipherSet struct {
+	primaryID string
+	aeads     map[string]cipher.AEAD
+}
+
+// newCipherSet parses keys formatted as "id:hex-encoded AES key", the first of
+// which is the primary key. Returns nil if there are no keys.
+func newCipherSet(keys []string) (*cipherSet, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	c := &cipherSet{aeads: make(map[string]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		id, hexKey, found := strings.Cut(key, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("encryption key %d isn't formatted as id:key", i)
+		}
+		if _, exists := c.aeads[id]; exists {
+			return nil, fmt.Errorf("duplicate encryption key id %v", id)
+		}
+		raw, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("decoding encryption key %v: %w", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %v: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %v: %w", id, err)
+		}
+		if i == 0 {
+			c.primaryID = id
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+func (c *cipherSet) encrypt(data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	aead := c.aeads[c.primaryID]
+	out := make([]byte, 0, len(encryptionMarkerPrefix)+len(c.primaryID)+1+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(out, encryptionMarkerPrefix...)
+	out = append(out, c.primaryID...)
+	out = append(out, ':')
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+// decrypt returns the plaintext of an encrypted payload, payloads that aren't
+// encrypted are returned as is so that encryption can be enabled gradually.
+func (c *cipherSet) decrypt(data []byte) ([]byte, error) {
+	rest, found := bytes.CutPrefix(data, []byte(encryptionMarkerPrefix))
+	if !found {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("payload is encrypted but no encryption keys are configured")
+	}
+	id, sealed, found := bytes.Cut(rest, []byte(":"))
+	if !found {
+		return nil, errors.New("encrypted payload has no key id")
+	}
+	aead, ok := c.aeads[string(id)]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id %v", string(id))
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted payload is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting payload with key %v: %w", string(id), err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// msgIdTime returns the time the message was added to the stream, which is
+// the timestamp part of its id assigned by the redis server.
+func msgIdTime(msgId string) (time.Time, error) {
+	parts, err := getUintParts(msgId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(parts[0])), nil
+}
+
+// EnqueuedPromise is a promise of a response that also knows when its request
+// was added to the stream.
+type EnqueuedPromise[Response any] struct {
+	*containers.Promise[Response]
+	enqueuedAt time.Time
+}
+
+// EnqueuedAt returns the time the request was added to the stream, by the
+// redis server's clock, so that callers can reason about its age.
+func (e *EnqueuedPromise[Response]) EnqueuedAt() time.Time {
+	return e.enqueuedAt
+}
+
+// ProduceEnqueued is like Produce, but the returned promise exposes when the
+// request was added to the stream.
+func (p *Producer[Request, Response]) ProduceEnqueued(ctx context.Context, value Request) (*EnqueuedPromise[Response], error) {
+	p.logger.Debug("Redis stream producing", "value", value)
+	p.startIterativeChecks()
+	key, promise, err := p.produce(ctx, value, PriorityNormal)
+	if err != nil {
+		return nil, err
+	}
+	enqueuedAt, err := msgIdTime(key.id)
+	if err != nil {
+		// Redis assigned ids always have a timestamp
+		p.logger.Error("Error parsing time of produced message", "msgId", key.id, "err", err)
+	}
+	return &EnqueuedPromise[Response]{Promise: promise, enqueuedAt: enqueuedAt}, nil
+}
@@ -0,0 +1,42 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+type explicitIDKey struct{}
+
+// explicitID returns the id the request produced with the context is added to
+// the stream with, empty if redis generates it.
+func explicitID(ctx context.Context) string {
+	id, _ := ctx.Value(explicitIDKey{}).(string)
+	return id
+}
+
+// isNonMonotonicIDErr returns whether redis rejected an explicit id for not
+// being greater than the stream's top id.
+func isNonMonotonicIDErr(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "equal or smaller than the target stream top item") || strings.Contains(err.Error(), "must be greater than 0-0"))
+}
+
+// ProduceWithExplicitID is like Produce, but adds the request to the stream
+// with given id instead of one generated by redis, e.g. to replay a known
+// message or for deterministic tests. The id must be greater than the id of
+// the stream's top entry, otherwise it errors with ErrIDNotMonotonic, and
+// it errors with ErrDuplicateRequest if a request with the id is outstanding.
+func (p *Producer[Request, Response]) ProduceWithExplicitID(ctx context.Context, id string, value Request) (*containers.Promise[Response], error) {
+	if _, err := getUintParts(id); err != nil {
+		return nil, err
+	}
+	p.logger.Debug("Redis stream producing with explicit id", "id", id, "value", value)
+	p.startIterativeChecks()
+	_, promise, err := p.produce(context.WithValue(ctx, explicitIDKey{}, id), value, PriorityNormal)
+	if isNonMonotonicIDErr(err) {
+		return nil, fmt.Errorf("%w: %v", ErrIDNotMonotonic, id)
+	}
+	return promise, err
+}
@@ -0,0 +1,29 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// runChecks runs a check cycle once no other cycle is running, so that the
+// timer, keyspace notifications and Flush never run overlapping cycles.
+func (p *Producer[Request, Response]) runChecks(ctx context.Context) (time.Duration, error) {
+	select {
+	case p.checking <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-p.checking }()
+	return p.checkResponses(ctx), nil
+}
+
+// Flush runs a check cycle right away, out of band from CheckResultInterval,
+// and returns once it completed. If a cycle is running it waits for it to
+// complete first, so that responses set before Flush was called are read.
+func (p *Producer[Request, Response]) Flush(ctx context.Context) error {
+	if p.closed.Load() {
+		return ErrProducerClosed
+	}
+	_, err := p.runChecks(ctx)
+	return err
+}
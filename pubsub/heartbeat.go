@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// heartbeatKeyFor returns the key holding the unix time in milliseconds a
+// consumer last reported working on the request of given response key.
+func heartbeatKeyFor(resultKey string) string { return resultKey + ".heartbeat" }
+
+// heartbeat updates the heartbeat key of the message every HeartbeatInterval
+// until it's acked or ctx is done.
+func (c *Consumer[Request, Response]) heartbeat(ctx context.Context, messageID string, acked <-chan struct{}) {
+	key := heartbeatKeyFor(resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag))
+	for {
+		if err := c.client.Set(ctx, key, time.Now().UnixMilli(), c.cfg.ResponseEntryTimeout).Err(); err != nil {
+			log.Warn("error updating heartbeat", "messageID", messageID, "err", err)
+		}
+		select {
+		case <-acked:
+			if err := c.client.Del(ctx, key).Err(); err != nil {
+				log.Warn("error deleting heartbeat", "messageID", messageID, "err", err)
+			}
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.HeartbeatInterval):
+		}
+	}
+}
+
+// heartbeatFresh returns whether a consumer reported working on the request
+// within HeartbeatStaleness.
+func (p *Producer[Request, Response]) heartbeatFresh(ctx context.Context, resultKey string) bool {
+	cfg := p.config()
+	if cfg.HeartbeatStaleness == 0 {
+		return false
+	}
+	val, err := p.readClient.Get(ctx, heartbeatKeyFor(resultKey)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			p.logger.Warn("error reading heartbeat", "key", resultKey, "err", err)
+		}
+		return false
+	}
+	beat, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		p.logger.Warn("invalid heartbeat", "key", resultKey, "value", val)
+		return false
+	}
+	return time.Since(time.UnixMilli(beat)) < cfg.HeartbeatStaleness
+}
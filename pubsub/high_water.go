@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var highWaterCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/high_water/crossed", nil)
+
+// HighWaterObserver is notified when the length of the stream grows past
+// HighWaterMark, e.g. because consumers are falling behind, and when it drops
+// back below LowWaterMark. Its callbacks are called synchronously from the
+// producer's check loop, so they must not block. Either callback may be nil.
+type HighWaterObserver struct {
+	OnHighWater func(length int64)
+	OnRecovered func(length int64)
+}
+
+// WithHighWaterObserver registers an observer of the stream crossing its
+// high-water mark.
+func WithHighWaterObserver(observer HighWaterObserver) ProducerOption {
+	return func(o *producerOptions) {
+		o.highWaterObserver = observer
+	}
+}
+
+// AboveHighWater returns whether the stream was longer than HighWaterMark
+// when last checked, and hasn't dropped back below LowWaterMark since.
+func (p *Producer[Request, Response]) AboveHighWater() bool {
+	return p.aboveHighWater.Load()
+}
+
+// checkHighWater reads the length of the stream and notifies the observer
+// when it crossed the high-water mark, or recovered below the low-water mark.
+// Recovering at a lower mark than the high-water mark keeps a stream whose
+// length hovers around the mark from flapping.
+func (p *Producer[Request, Response]) checkHighWater(ctx context.Context) {
+	cfg := p.config()
+	length, err := p.client.XLen(ctx, p.stream()).Result()
+	if err != nil {
+		p.logger.Warn("redis producer: Error reading stream length", "stream", p.stream(), "error", err)
+		return
+	}
+	lowWaterMark := cfg.LowWaterMark
+	if lowWaterMark == 0 {
+		lowWaterMark = cfg.HighWaterMark
+	}
+	if !p.aboveHighWater.Load() && length > cfg.HighWaterMark {
+		p.aboveHighWater.Store(true)
+		highWaterCounter.Inc(1)
+		p.logger.Warn("redis producer: Stream is above its high-water mark", "stream", p.stream(), "length", length, "mark", cfg.HighWaterMark)
+		if p.highWaterObserver.OnHighWater != nil {
+			p.highWaterObserver.OnHighWater(length)
+		}
+	} else if p.aboveHighWater.Load() && length < lowWaterMark {
+		p.aboveHighWater.Store(false)
+		p.logger.Info("redis producer: Stream recovered below its low-water mark", "stream", p.stream(), "length", length, "mark", lowWaterMark)
+		if p.highWaterObserver.OnRecovered != nil {
+			p.highWaterObserver.OnRecovered(length)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// RequestProducer is the request/response API of Producer, for code that
+// produces requests to accept instead of the concrete type, so that it can be
+// given a fake in tests. It's kept minimal so that fakes don't need to change
+// as Producer grows, the other ways of producing are separate interfaces.
+type RequestProducer[Request any, Response any] interface {
+	Start(ctx context.Context)
+	StopAndWait()
+	Produce(ctx context.Context, value Request) (*containers.Promise[Response], error)
+	ProduceAndWait(ctx context.Context, value Request) (Response, error)
+}
+
+// QoSProducer is a RequestProducer that produces requests with a QoS class.
+type QoSProducer[Request any, Response any] interface {
+	RequestProducer[Request, Response]
+	ProduceWithQoS(ctx context.Context, value Request, qos QoSClass) (*containers.Promise[Response], error)
+}
+
+// ChannelProducer is a RequestProducer that delivers responses on channels.
+type ChannelProducer[Request any, Response any] interface {
+	RequestProducer[Request, Response]
+	ProduceC(ctx context.Context, value Request) (<-chan ResponseOrError[Response], error)
+}
+
+var (
+	_ QoSProducer[struct{}, struct{}]     = (*Producer[struct{}, struct{}])(nil)
+	_ ChannelProducer[struct{}, struct{}] = (*Producer[struct{}, struct{}])(nil)
+)
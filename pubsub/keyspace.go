@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyspacePattern returns the channel pattern of keyspace notifications of the
+// stream's response keys.
+func (p *Producer[Request, Response]) keyspacePattern(stream string) string {
+	db := 0
+	if client, ok := p.client.(*redis.Client); ok {
+		db = client.Options().DB
+	}
+	return fmt.Sprintf("__keyspace@%d__:%s", db, resultKeyFor(stream, "*", p.config().UseHashTag))
+}
+
+// watchKeyspace subscribes to keyspace notifications of the stream's response
+// keys and runs a check cycle once any of them is set. Notifications arriving
+// while a cycle runs are coalesced into one more cycle.
+func (p *Producer[Request, Response]) watchKeyspace(ctx context.Context) {
+	p.keyspaceLock.Lock()
+	sub := p.client.PSubscribe(ctx, p.keyspacePattern(p.stream()))
+	p.keyspaceSub = sub
+	p.keyspaceLock.Unlock()
+	defer func() {
+		p.keyspaceLock.Lock()
+		p.keyspaceSub = nil
+		p.keyspaceLock.Unlock()
+		if err := sub.Close(); err != nil {
+			p.logger.Warn("error closing keyspace notifications subscription", "err", err)
+		}
+	}()
+	notified := make(chan struct{}, 1)
+	p.StopWaiter.LaunchThread(func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-notified:
+				if _, err := p.runChecks(ctx); err != nil {
+					return
+				}
+			}
+		}
+	})
+	msgs := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			// Only writes of responses matter, not e.g. their expiry or deletion
+			if msg.Payload != "set" && msg.Payload != "xadd" {
+				continue
+			}
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// watchKeyspaceOf adds the response keys of the stream MigrateTo switched to
+// to the keyspace notifications watched, keeping the ones of the old stream
+// for its outstanding requests.
+func (p *Producer[Request, Response]) watchKeyspaceOf(ctx context.Context, stream string) {
+	p.keyspaceLock.Lock()
+	defer p.keyspaceLock.Unlock()
+	// Not subscribed yet, watchKeyspace subscribes to the producer's stream then
+	if p.keyspaceSub == nil {
+		return
+	}
+	if err := p.keyspaceSub.PSubscribe(ctx, p.keyspacePattern(stream)); err != nil {
+		p.logger.Warn("error subscribing to keyspace notifications of new stream, falling back to polling", "stream", stream, "err", err)
+	}
+}
@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// metaMarkerPrefix prefixes the value of a response key when the consumer
+// reported metadata along with the response, followed by a JSON envelope of
+// both.
+const metaMarkerPrefix = "#meta:"
+
+// ResponseMeta is metadata about processing of a request reported by the
+// consumer.
+type ResponseMeta struct {
+	// Worker identifies who processed the request.
+	Worker string
+	// Duration of processing the request.
+	Duration time.Duration
+	// Version of the worker.
+	Version string
+}
+
+type metaEnvelope struct {
+	Meta     ResponseMeta
+	Response json.RawMessage
+}
+
+func metaMarker(meta ResponseMeta, resp []byte) ([]byte, error) {
+	envelope, err := json.Marshal(metaEnvelope{Meta: meta, Response: resp})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling response metadata: %w", err)
+	}
+	return append([]byte(metaMarkerPrefix), envelope...), nil
+}
+
+// splitResponseMeta returns the metadata and the marshaled response of a
+// response value, which is returned as is if it has no metadata.
+func splitResponseMeta(value []byte) (ResponseMeta, []byte, error) {
+	if !bytes.HasPrefix(value, []byte(metaMarkerPrefix)) {
+		return ResponseMeta{}, value, nil
+	}
+	var envelope metaEnvelope
+	if err := json.Unmarshal(value[len(metaMarkerPrefix):], &envelope); err != nil {
+		return ResponseMeta{}, nil, fmt.Errorf("unmarshaling response metadata: %w", err)
+	}
+	return envelope.Meta, envelope.Response, nil
+}
+
+// MetaPromise is a promise of a response along with its metadata.
+type MetaPromise[Response any] struct {
+	promise *containers.Promise[Response]
+	meta    *ResponseMeta
+}
+
+// AwaitWithMeta waits for the response and returns it with the metadata the
+// consumer reported, which is zero if it reported none.
+func (m *MetaPromise[Response]) AwaitWithMeta(ctx context.Context) (Response, ResponseMeta, error) {
+	res, err := m.promise.Await(ctx)
+	if err != nil {
+		return res, ResponseMeta{}, err
+	}
+	return res, *m.meta, nil
+}
+
+// ProduceWithMeta is like Produce, but the returned promise also surfaces the
+// metadata consumers report with SetResultWithMeta.
+func (p *Producer[Request, Response]) ProduceWithMeta(ctx context.Context, value Request) (*MetaPromise[Response], error) {
+	p.logger.Debug("Redis stream producing with metadata", "value", value)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	meta := &ResponseMeta{}
+	_, promise, err := p.produceValues(ctx, map[string]any{payloadField(p.config().PayloadField): val}, PriorityNormal, func(tracked *trackedPromise[Response]) {
+		tracked.meta = meta
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MetaPromise[Response]{promise: promise, meta: meta}, nil
+}
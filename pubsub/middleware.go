@@ -0,0 +1,33 @@
+package pubsub
+
+import "context"
+
+// RequestMiddleware transforms a request before it's marshaled and added to
+// the stream, e.g. to set fields common to all requests. An error aborts the
+// produce and is returned to its caller.
+type RequestMiddleware[Request any] func(ctx context.Context, value Request) (Request, error)
+
+// Use appends the middleware to the chain applied to requests, in the order
+// they were added, by all Produce variants that marshal a request value.
+// ProduceStream and ProduceRaw add already marshaled requests, which are not
+// transformed.
+func (p *Producer[Request, Response]) Use(middleware RequestMiddleware[Request]) {
+	p.middlewaresLock.Lock()
+	defer p.middlewaresLock.Unlock()
+	middlewares := append([]RequestMiddleware[Request]{}, p.middlewares...)
+	p.middlewares = append(middlewares, middleware)
+}
+
+// applyMiddlewares passes the request through the chain of middlewares.
+func (p *Producer[Request, Response]) applyMiddlewares(ctx context.Context, value Request) (Request, error) {
+	p.middlewaresLock.RLock()
+	middlewares := p.middlewares
+	p.middlewaresLock.RUnlock()
+	for _, middleware := range middlewares {
+		var err error
+		if value, err = middleware(ctx, value); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
+}
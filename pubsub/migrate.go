@@ -0,0 +1,158 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// stream returns the stream requests are produced to by default.
+func (p *Producer[Request, Response]) stream() string {
+	p.targetLock.RLock()
+	defer p.targetLock.RUnlock()
+	return p.redisStream
+}
+
+// group returns the consumer group of the stream requests are produced to by
+// default.
+func (p *Producer[Request, Response]) group() string {
+	p.targetLock.RLock()
+	defer p.targetLock.RUnlock()
+	return p.redisGroup
+}
+
+// MigrateTo switches the stream the producer produces to, e.g. when renaming
+// or resharding a stream. Requests produced from then on go to the new
+// stream, while the outstanding requests of the old stream are awaited until
+// ctx is done. The ones still unresolved then are read back from the old
+// stream and produced again to the new one, their promises resolving with the
+// response from there.
+func (p *Producer[Request, Response]) MigrateTo(ctx context.Context, newStream string) error {
+	if newStream == "" {
+		return errors.New("stream name cannot be empty")
+	}
+	p.produceLock.Lock()
+	p.targetLock.Lock()
+	oldStream := p.redisStream
+	p.redisStream = newStream
+	p.redisGroup = newStream // There is 1-1 mapping of redis stream and consumer group.
+	p.targetLock.Unlock()
+	p.produceLock.Unlock()
+	if oldStream == newStream {
+		return nil
+	}
+	p.watchKeyspaceOf(ctx, newStream)
+	p.logger.Info("Migrating producer to new stream", "from", oldStream, "to", newStream)
+	for len(p.outstandingOf(oldStream)) > 0 {
+		select {
+		case <-ctx.Done():
+			// Moving shouldn't be interrupted halfway by the same context
+			return p.moveOutstanding(context.WithoutCancel(ctx), oldStream, newStream)
+		case <-time.After(p.config().CheckResultInterval):
+		}
+	}
+	return nil
+}
+
+// outstandingOf returns the keys of promises of requests produced to stream.
+func (p *Producer[Request, Response]) outstandingOf(stream string) []promiseKey {
+	return p.trackedKeys(func(key promiseKey) bool { return key.stream == stream })
+}
+
+// moveOutstanding produces the unresolved requests of the old stream again to
+// the new one, tracking their promises under the new messages.
+func (p *Producer[Request, Response]) moveOutstanding(ctx context.Context, oldStream, newStream string) error {
+	var errs []error
+	moved := 0
+	for _, key := range p.outstandingOf(oldStream) {
+		msgs, err := p.client.XRangeN(ctx, oldStream, key.id, key.id, 1).Result()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading message %v: %w", key.id, err))
+			continue
+		}
+		if len(msgs) == 0 {
+			// Already completed by a consumer, its response will be picked up
+			continue
+		}
+		if !p.isTracked(key) {
+			continue
+		}
+		// No shard lock is held while producing, the promise is re-keyed after
+		msgId, err := p.addToStream(ctx, newStream, msgs[0].Values)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("producing message %v to %v: %w", key.id, newStream, err))
+			continue
+		}
+		newKey := promiseKey{stream: newStream, id: msgId}
+		if !p.rekey(key, newKey, nil) {
+			// Resolved or canceled meanwhile, nobody waits for the new request
+			p.removeFromRedis(ctx, newStream, msgId)
+			continue
+		}
+		p.movePersistedPromise(ctx, key, newKey)
+		p.removeFromRedis(ctx, oldStream, key.id)
+		moved++
+	}
+	p.logger.Info("Moved outstanding requests to new stream", "from", oldStream, "to", newStream, "moved", moved, "errors", len(errs))
+	return errors.Join(errs...)
+}
+
+// rekey moves the promise tracked under the old key to the new one, holding
+// the locks of both shards so that lockTracked finds it under either. update,
+// if set, is applied to the promise while they're held. Returns false if it
+// isn't tracked anymore.
+func (p *Producer[Request, Response]) rekey(oldKey, newKey promiseKey, update func(*trackedPromise[Response])) bool {
+	oldShard, newShard := p.shardFor(oldKey), p.shardFor(newKey)
+	// Locked in the order of their index, so that concurrent rekeys don't deadlock
+	first, second := oldShard, newShard
+	if p.shardIndex(newKey) < p.shardIndex(oldKey) {
+		first, second = newShard, oldShard
+	}
+	first.lock.Lock()
+	if second != first {
+		second.lock.Lock()
+	}
+	defer func() {
+		if second != first {
+			p.unlockAndObserve(second)
+		}
+		p.unlockAndObserve(first)
+	}()
+	tracked, found := oldShard.promises[oldKey]
+	if !found {
+		return false
+	}
+	delete(oldShard.promises, oldKey)
+	tracked.movedFrom = append(tracked.movedFrom, oldKey)
+	if update != nil {
+		update(tracked)
+	}
+	p.migrated.Store(oldKey, newKey)
+	newShard.promises[newKey] = tracked
+	if p.closed.Load() {
+		tracked.promise.ProduceError(ErrProducerClosed)
+		p.stopTracking(newShard, newKey, PromiseCanceled)
+	}
+	return true
+}
+
+// lockTracked locks the shard of the promise of given message and returns it
+// along with the promise, following it to the stream MigrateTo moved it to.
+// The promise is nil if it isn't tracked, the shard is locked regardless.
+func (p *Producer[Request, Response]) lockTracked(key promiseKey) (promiseKey, *promiseShard[Response], *trackedPromise[Response]) {
+	for {
+		shard := p.shardFor(key)
+		shard.lock.Lock()
+		if tracked, found := shard.promises[key]; found {
+			return key, shard, tracked
+		}
+		// A rekey stores it while holding this lock, so it's seen if it was moved
+		moved, found := p.migrated.Load(key)
+		if !found {
+			return key, shard, nil
+		}
+		shard.lock.Unlock()
+		key = moved
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import "time"
+
+// PromiseTransition is a state transition of a promise tracked by a producer.
+type PromiseTransition int
+
+const (
+	// PromiseCreated is when the request is produced and its promise is tracked.
+	PromiseCreated PromiseTransition = iota
+	// PromiseResolved is when the promise is resolved with the response.
+	PromiseResolved
+	// PromiseErrored is when the response can't be read, e.g. when it fails to
+	// unmarshal or the consumer reported an error.
+	PromiseErrored
+	// PromiseTimedOut is when the request is past its TTL or the deadline of
+	// the context it was produced with.
+	PromiseTimedOut
+	// PromiseCanceled is when the request is canceled or the producer is stopped.
+	PromiseCanceled
+)
+
+func (t PromiseTransition) String() string {
+	switch t {
+	case PromiseCreated:
+		return "created"
+	case PromiseResolved:
+		return "resolved"
+	case PromiseErrored:
+		return "errored"
+	case PromiseTimedOut:
+		return "timed-out"
+	case PromiseCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// PromiseObserver is called on every state transition of a promise, with the
+// time elapsed since it was created. It's called outside of the promises lock
+// but synchronously from the producer's check loop, so it must not block.
+type PromiseObserver func(msgId string, transition PromiseTransition, elapsed time.Duration)
+
+// PromiseEvent is a state transition of a promise along with the user data
+// its request was produced with, see WithUserData.
+type PromiseEvent struct {
+	MsgID      string
+	Transition PromiseTransition
+	Elapsed    time.Duration
+	UserData   any
+}
+
+// PromiseEventObserver is like PromiseObserver, but is given the user data
+// of the promise as well.
+type PromiseEventObserver func(event PromiseEvent)
+
+type promiseTransition struct {
+	msgId      string
+	transition PromiseTransition
+	elapsed    time.Duration
+	userData   any
+}
+
+// WithPromiseObserver registers an observer of state transitions of promises.
+func WithPromiseObserver(observer PromiseObserver) ProducerOption {
+	return func(o *producerOptions) {
+		o.observer = observer
+	}
+}
+
+// WithPromiseEventObserver registers an observer of state transitions of
+// promises that is given their user data, it can be combined with
+// WithPromiseObserver.
+func WithPromiseEventObserver(observer PromiseEventObserver) ProducerOption {
+	return func(o *producerOptions) {
+		o.eventObserver = observer
+	}
+}
+
+// recordTransition buffers a transition of the tracked promise to be observed
+// once the lock of its shard is released, which must be held.
+func (p *Producer[Request, Response]) recordTransition(shard *promiseShard[Response], msgId string, tracked *trackedPromise[Response], transition PromiseTransition) {
+	if p.observer == nil && p.eventObserver == nil {
+		return
+	}
+	shard.transitions = append(shard.transitions, promiseTransition{
+		msgId:      msgId,
+		transition: transition,
+		elapsed:    time.Since(tracked.created),
+		userData:   tracked.userData,
+	})
+}
+
+// unlockAndObserve releases the lock of the shard and passes the transitions
+// recorded while holding it to the observers, and removes the promises that
+// stopped being tracked from the persisted set.
+func (p *Producer[Request, Response]) unlockAndObserve(shard *promiseShard[Response]) {
+	transitions := shard.transitions
+	shard.transitions = nil
+	unpersisted := shard.unpersisted
+	shard.unpersisted = nil
+	releasedIdempotency := shard.releasedIdempotency
+	shard.releasedIdempotency = nil
+	shard.lock.Unlock()
+	p.unpersistPromises(unpersisted)
+	p.releaseIdempotencyKeys(releasedIdempotency)
+	for _, t := range transitions {
+		if p.observer != nil {
+			p.observer(t.msgId, t.transition, t.elapsed)
+		}
+		if p.eventObserver != nil {
+			p.eventObserver(PromiseEvent{MsgID: t.msgId, Transition: t.transition, Elapsed: t.elapsed, UserData: t.userData})
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package pubsub
+
+// Pause makes producing fail with ErrProducerPaused until Resume is called,
+// e.g. during maintenance. Outstanding promises keep being checked and
+// resolved, so that they drain while paused. Produces already adding their
+// request to the stream complete before Pause returns.
+func (p *Producer[Request, Response]) Pause() {
+	p.produceLock.Lock()
+	defer p.produceLock.Unlock()
+	if !p.paused.Swap(true) {
+		p.logger.Info("redis producer: paused producing", "stream", p.stream())
+	}
+}
+
+// Resume makes producing succeed again after Pause.
+func (p *Producer[Request, Response]) Resume() {
+	if p.paused.Swap(false) {
+		p.logger.Info("redis producer: resumed producing", "stream", p.stream())
+	}
+}
+
+// Paused returns whether producing is paused, see Pause.
+func (p *Producer[Request, Response]) Paused() bool {
+	return p.paused.Load()
+}
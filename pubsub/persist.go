@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// persistedPromisesKeyFor returns the key of the set the producer with given
+// id persists the message ids of its outstanding requests to.
+func persistedPromisesKeyFor(producerID string) string {
+	return fmt.Sprintf("pubsub.producer.%s.promises", producerID)
+}
+
+// persistedMember returns the member of the persisted set for the request,
+// message ids never contain '/', so the stream follows the first one.
+func persistedMember(key promiseKey) string {
+	return key.id + "/" + key.stream
+}
+
+func parsePersistedMember(member string) (promiseKey, bool) {
+	id, stream, found := strings.Cut(member, "/")
+	if !found || id == "" || stream == "" {
+		return promiseKey{}, false
+	}
+	return promiseKey{stream: stream, id: id}, true
+}
+
+// persistPromise adds the request to the persisted set, before it's tracked,
+// so that a crash after the request was added to the stream doesn't lose it.
+// Returns whether it was added, in which case callers failing to track it
+// must unpersist it.
+func (p *Producer[Request, Response]) persistPromise(ctx context.Context, key promiseKey) bool {
+	if !p.config().PersistPromises {
+		return false
+	}
+	added, err := p.client.SAdd(ctx, persistedPromisesKeyFor(p.id), persistedMember(key)).Result()
+	if err != nil {
+		p.logger.Warn("redis producer: Error persisting outstanding request, it won't be restored after a crash", "msgId", key.id, "error", err)
+		return false
+	}
+	return added > 0
+}
+
+// persistedPromiseFor is like promiseFor, but persists the request first,
+// unpersisting it again if it can't be tracked.
+func (p *Producer[Request, Response]) persistedPromiseFor(ctx context.Context, key promiseKey) (*containers.Promise[Response], error) {
+	persisted := p.persistPromise(ctx, key)
+	promise, err := p.promiseFor(ctx, key)
+	if err != nil && persisted {
+		p.unpersistPromises([]string{persistedMember(key)})
+	}
+	return promise, err
+}
+
+// movePersistedPromise replaces a request that's produced again under a new
+// message id in the persisted set.
+func (p *Producer[Request, Response]) movePersistedPromise(ctx context.Context, from, to promiseKey) {
+	if !p.config().PersistPromises {
+		return
+	}
+	set := persistedPromisesKeyFor(p.id)
+	pipe := p.client.TxPipeline()
+	pipe.SAdd(ctx, set, persistedMember(to))
+	pipe.SRem(ctx, set, persistedMember(from))
+	if _, err := pipe.Exec(ctx); err != nil {
+		p.logger.Warn("redis producer: Error moving persisted outstanding request", "from", from.id, "to", to.id, "error", err)
+	}
+}
+
+// unpersistPromises removes requests that stopped being tracked from the
+// persisted set. It's called once no shard lock is held, from paths that have
+// no context, so it isn't canceled along with the producer.
+func (p *Producer[Request, Response]) unpersistPromises(members []string) {
+	if len(members) == 0 {
+		return
+	}
+	if err := p.client.SRem(context.Background(), persistedPromisesKeyFor(p.id), members).Err(); err != nil {
+		p.logger.Warn("redis producer: Error removing resolved requests from the persisted set", "count", len(members), "error", err)
+	}
+}
+
+// restorePromises tracks the requests a previous run of the producer with the
+// same id persisted, so that their responses are awaited again and callers
+// can get their promises with Subscribe. Requests past their timeout by then
+// time out in the next check cycle.
+func (p *Producer[Request, Response]) restorePromises(ctx context.Context) {
+	members, err := p.client.SMembers(ctx, persistedPromisesKeyFor(p.id)).Result()
+	if err != nil {
+		p.logger.Error("redis producer: Error reading persisted outstanding requests", "error", err)
+		return
+	}
+	var invalid []string
+	restored := 0
+	for _, member := range members {
+		key, ok := parsePersistedMember(member)
+		if !ok {
+			invalid = append(invalid, member)
+			continue
+		}
+		if _, err := p.promiseFor(ctx, key); err != nil {
+			p.logger.Error("redis producer: Error restoring persisted outstanding request", "msgId", key.id, "error", err)
+			continue
+		}
+		restored++
+	}
+	p.unpersistPromises(invalid)
+	if restored > 0 {
+		p.logger.Info("redis producer: Restored persisted outstanding requests", "restored", restored)
+		p.startIterativeChecks()
+	}
+}
@@ -0,0 +1,92 @@
+package pubsub
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// priorityKey is the field of the stream entry holding the request's priority.
+const priorityKey = "priority"
+
+// Priority of a request, higher values are more urgent.
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// parsePriority returns the priority stored in the stream entry values,
+// defaulting to PriorityNormal when it's missing or invalid.
+func parsePriority(values map[string]any) Priority {
+	str, ok := values[priorityKey].(string)
+	if !ok {
+		return PriorityNormal
+	}
+	priority, err := strconv.ParseInt(str, 10, 8)
+	if err != nil {
+		return PriorityNormal
+	}
+	return Priority(priority)
+}
+
+// requestTimeout returns the TTL of requests with given priority, high
+// priority requests can be configured to fail fast while low priority ones
+// tolerate longer waits.
+func (c *ProducerConfig) requestTimeout(priority Priority) time.Duration {
+	if priority > PriorityNormal && c.HighPriorityRequestTimeout != 0 {
+		return c.HighPriorityRequestTimeout
+	}
+	if priority < PriorityNormal && c.LowPriorityRequestTimeout != 0 {
+		return c.LowPriorityRequestTimeout
+	}
+	return c.RequestTimeout
+}
+
+// hasPriorityTimeouts returns whether request timeout depends on priority.
+func (c *ProducerConfig) hasPriorityTimeouts() bool {
+	return c.HighPriorityRequestTimeout != 0 || c.LowPriorityRequestTimeout != 0
+}
+
+// minRequestTimeout returns the shortest request timeout of any priority.
+func (c *ProducerConfig) minRequestTimeout() time.Duration {
+	timeout := c.RequestTimeout
+	for _, t := range []time.Duration{c.HighPriorityRequestTimeout, c.LowPriorityRequestTimeout} {
+		if t != 0 && t < timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// maxRequestTimeout returns the longest request timeout of any priority.
+func (c *ProducerConfig) maxRequestTimeout() time.Duration {
+	return max(c.RequestTimeout, c.HighPriorityRequestTimeout, c.LowPriorityRequestTimeout)
+}
+
+// sortByPriority stably sorts the keys by the priority of their promises,
+// highest first, keeping the order of keys of the same priority. Keys that
+// stopped being tracked are sorted as PriorityNormal.
+func (p *Producer[Request, Response]) sortByPriority(keys []promiseKey) {
+	byShard := make([][]promiseKey, len(p.shards))
+	for _, key := range keys {
+		i := p.shardIndex(key)
+		byShard[i] = append(byShard[i], key)
+	}
+	priorities := make(map[promiseKey]Priority, len(keys))
+	for i, shard := range p.shards {
+		if len(byShard[i]) == 0 {
+			continue
+		}
+		shard.lock.RLock()
+		for _, key := range byShard[i] {
+			if tracked, found := shard.promises[key]; found {
+				priorities[key] = tracked.priority
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return priorities[keys[i]] > priorities[keys[j]] })
+}
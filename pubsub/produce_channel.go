@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// ProduceResult is the outcome of producing the request at Index of the
+// channel given to ProduceFromChannel, Promise is nil when Err is set.
+type ProduceResult[Response any] struct {
+	Index   int
+	Promise *containers.Promise[Response]
+	Err     error
+}
+
+// ProduceFromChannel produces requests received on the channel until it's
+// closed or ctx is done, sending the outcome of producing each of them on the
+// returned channel, which is closed once it's done or the producer is
+// stopped. Once ChannelMaxOutstanding of its requests are outstanding, it
+// stops receiving requests until some of them resolve, so that the sender is
+// slowed down to what consumers keep up with. The returned channel is unbuffered, a slow reader slows it down too.
+func (p *Producer[Request, Response]) ProduceFromChannel(ctx context.Context, requests <-chan Request) (<-chan ProduceResult[Response], error) {
+	if p.closed.Load() {
+		return nil, ErrProducerClosed
+	}
+	p.startIterativeChecks()
+	// slots holds an entry per outstanding request, nil when unlimited
+	var slots chan struct{}
+	if limit := p.config().ChannelMaxOutstanding; limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+	results := make(chan ProduceResult[Response])
+	p.StopWaiter.LaunchThread(func(stopCtx context.Context) {
+		defer close(results)
+		for index := 0; ; index++ {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				default:
+					p.logger.Debug("redis producer: pausing producing from channel until outstanding requests resolve", "outstanding", cap(slots))
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return
+					case <-stopCtx.Done():
+						return
+					}
+				}
+			}
+			var value Request
+			select {
+			case v, ok := <-requests:
+				if !ok {
+					return
+				}
+				value = v
+			case <-ctx.Done():
+				return
+			case <-stopCtx.Done():
+				return
+			}
+			_, promise, err := p.produce(ctx, value, PriorityNormal)
+			if slots != nil {
+				if err != nil {
+					<-slots
+				} else {
+					// Untracked, as StopAndWait only errors the promise after
+					// its threads are done
+					p.StopWaiter.LaunchUntrackedThread(func() {
+						select {
+						case <-promise.ReadyChan():
+						case <-ctx.Done():
+						}
+						<-slots
+					})
+				}
+			}
+			select {
+			case results <- ProduceResult[Response]{Index: index, Promise: promise, Err: err}:
+			case <-ctx.Done():
+				return
+			case <-stopCtx.Done():
+				return
+			}
+		}
+	})
+	return results, nil
+}
+
+// ResponseOrError is the outcome of a request produced with ProduceC.
+type ResponseOrError[Response any] struct {
+	Response Response
+	Err      error
+}
+
+// ProduceC is like Produce, but returns a channel instead of a promise, for
+// channel oriented callers. The outcome of the request, or ctx's error if ctx
+// is done first, is sent on the channel which is then closed. The channel is
+// buffered so that the result is delivered even if it's never read.
+func (p *Producer[Request, Response]) ProduceC(ctx context.Context, value Request) (<-chan ResponseOrError[Response], error) {
+	promise, err := p.Produce(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	result := make(chan ResponseOrError[Response], 1)
+	// Untracked, as StopAndWait only errors the promise after its threads are
+	// done
+	p.StopWaiter.LaunchUntrackedThread(func() {
+		defer close(result)
+		select {
+		case <-promise.ReadyChan():
+			res, err := promise.Current()
+			result <- ResponseOrError[Response]{Response: res, Err: err}
+		case <-ctx.Done():
+			result <- ResponseOrError[Response]{Err: ctx.Err()}
+		}
+	})
+	return result, nil
+}
@@ -9,44 +9,221 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"github.com/spf13/pflag"
+	"golang.org/x/time/rate"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 
 	"github.com/offchainlabs/nitro/util/containers"
 	"github.com/offchainlabs/nitro/util/stopwaiter"
 )
 
 const (
-	messageKey   = "msg"
-	defaultGroup = "default_consumer_group"
+	messageKey    = "msg"
+	noResponseKey = "no-response"
+	defaultGroup  = "default_consumer_group"
+	// streamChunkSize is the size of the message chunks that ProduceStream
+	// reads the request into.
+	streamChunkSize = 1 << 16
 )
 
+var (
+	ErrPayloadTooLarge = errors.New("payload too large")
+	ErrGroupNotFound   = errors.New("consumer group not found")
+	ErrRequestCanceled = errors.New("request canceled")
+	ErrProducerClosed  = errors.New("producer closed")
+	ErrConsumerError   = errors.New("consumer reported error")
+
+	ErrGroupRepositionDisabled = errors.New("group reposition is disabled")
+	ErrStreamGone              = errors.New("stream or consumer group deleted")
+	ErrSchedulingDisabled      = errors.New("scheduling is disabled")
+	ErrRequestTimeout          = errors.New("request timed out")
+	ErrIDNotMonotonic          = errors.New("explicit id isn't greater than the stream's top id")
+	ErrResponseUnverified      = errors.New("response signature is missing or invalid")
+	ErrDeadlineExceeded        = errors.New("request deadline passed before it was processed")
+	ErrDuplicateRequest        = errors.New("request with the same message id is already outstanding")
+	ErrRetryAfter              = errors.New("consumer asked to retry the request later")
+	ErrAffinityDisabled        = errors.New("affinity partitions are disabled")
+	ErrForceEvicted            = errors.New("promise outstanding past its max lifetime")
+	ErrAffinityOrderFull       = errors.New("too many ordered requests outstanding for the affinity key")
+	ErrProducerPaused          = errors.New("producer paused")
+)
+
+var (
+	xpendingErrorCounter  = metrics.NewRegisteredCounter("arb/pubsub/producer/xpending/error", nil)
+	groupRecreatedCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/group/recreated", nil)
+	trimmedCounter        = metrics.NewRegisteredCounter("arb/pubsub/producer/trimmed", nil)
+	responseDelCounter    = metrics.NewRegisteredCounter("arb/pubsub/producer/response/deleted", nil)
+	xackCounter           = metrics.NewRegisteredCounter("arb/pubsub/producer/xack", nil)
+	xaddCounter           = metrics.NewRegisteredCounter("arb/pubsub/producer/xadd", nil)
+	xdelCounter           = metrics.NewRegisteredCounter("arb/pubsub/producer/xdel", nil)
+	promisesGauge         = metrics.NewRegisteredGauge("arb/pubsub/producer/promises", nil)
+	redisDegradedCounter  = metrics.NewRegisteredCounter("arb/pubsub/producer/redis/degraded", nil)
+	ageWarningCounter     = metrics.NewRegisteredCounter("arb/pubsub/producer/promise/age_warning", nil)
+	forceEvictedCounter   = metrics.NewRegisteredCounter("arb/pubsub/producer/promise/force_evicted", nil)
+)
+
+// xaddMetricPrefix prefixes the names of the per stream metrics of XADDs,
+// followed by the stream name.
+const xaddMetricPrefix = "arb/pubsub/producer/xadd/stream/"
+
 type Producer[Request any, Response any] struct {
 	stopwaiter.StopWaiter
-	id          string
-	client      redis.UniversalClient
+	id     string
+	client redis.UniversalClient
+	// readClient serves the read only lookups of responses, it's the same as
+	// client unless a read replica is configured.
+	readClient redis.UniversalClient
+	// targetLock guards redisStream and redisGroup, which change on MigrateTo.
+	targetLock  sync.RWMutex
 	redisStream string
 	redisGroup  string
-	cfg         *ProducerConfig
+	// cfg is swapped by UpdateConfig, methods load it once so that they see
+	// consistent values.
+	cfg atomic.Pointer[ProducerConfig]
+	// limiter is nil when rate of producing is unlimited.
+	limiter *rate.Limiter
+	// redisClockOffset is the offset in nanoseconds of the redis server's
+	// clock from the local clock.
+	redisClockOffset atomic.Int64
 
-	promisesLock sync.RWMutex
-	promises     map[string]*containers.Promise[Response]
+	// shards of the outstanding promises, see PromiseShards.
+	shards []*promiseShard[Response]
+	// migrated maps the keys of promises moved to another stream by
+	// MigrateTo to the keys they're tracked under from then on, stored while
+	// the shard locks of both are held, until the promise stops being tracked.
+	migrated containers.SyncMap[promiseKey, promiseKey]
+	// releasedIdempotency maps the idempotency keys of requests that stopped
+	// being tracked to the message ids they mapped to, stored while the shard
+	// lock is held, until the keys are deleted from redis.
+	releasedIdempotency containers.SyncMap[string, string]
+	// keyspaceLock guards keyspaceSub, the subscription to keyspace
+	// notifications while EnableKeyspaceNotifications is set, nil otherwise.
+	keyspaceLock sync.Mutex
+	keyspaceSub  *redis.PubSub
+	// responsesLock guards responseCursors and streamResponses, which are
+	// only used when ResponseStream is set.
+	responsesLock sync.Mutex
+	// responseCursors are the ids response streams were read up to, by
+	// request stream.
+	responseCursors map[string]string
+	streamResponses map[promiseKey]*streamResponse
+	// produceLock is held for reading while producing, so that MigrateTo
+	// switches streams between produces.
+	produceLock sync.RWMutex
+	// closed is set once the producer is stopped, before the promises of all
+	// shards are errored.
+	closed atomic.Bool
+	// paused is set while producing is paused, see Pause.
+	paused atomic.Bool
+	// observer is nil when transitions of promises aren't observed.
+	observer PromiseObserver
+	// eventObserver is nil when transitions aren't observed with user data.
+	eventObserver PromiseEventObserver
+	// retryPolicy is nil when ProduceAndWait doesn't retry.
+	retryPolicy *RetryPolicy
+	// middlewares applied to requests, replaced rather than modified by Use.
+	middlewares     []RequestMiddleware[Request]
+	middlewaresLock sync.RWMutex
+	// logger all logging of the producer goes through, see WithLogger.
+	logger log.Logger
+	// trimObserver is nil when trims aren't observed.
+	trimObserver TrimObserver
+	// noopTrims counts the consecutive trims that freed no entries.
+	noopTrims atomic.Int64
+	// highWaterObserver has nil callbacks when the length of the stream isn't
+	// observed.
+	highWaterObserver HighWaterObserver
+	// aboveHighWater is set while the stream is above its high-water mark.
+	aboveHighWater atomic.Bool
+	// ciphers is nil when payloads aren't encrypted.
+	ciphers *cipherSet
+	// reclaimed are the messages reclaimed with ClassifyTimeouts, so that
+	// their timeouts aren't classified as processed.
+	reclaimed reclaimedSet
+	// affinityOrder sequences results per affinity key, see AffinityOrdered.
+	affinityOrder *affinityOrder[Response]
 
 	// Used for checking responses from consumers iteratively
 	// For the first time when Produce is called.
 	once sync.Once
+	// checksStartedAt is when the checks started, see StartupGracePeriod.
+	checksStartedAt time.Time
+	// streams matching StreamPattern, nil until discovered.
+	streams atomic.Pointer[[]string]
+	// coalescer is nil when requests are added to the stream one by one.
+	coalescer *xaddCoalescer
+	// checking is full while a check cycle runs, see runChecks.
+	checking chan struct{}
+	// started is closed once the first check cycle completed.
+	started     chan struct{}
+	startedOnce sync.Once
+}
+
+// promiseKey identifies a tracked promise by the stream its message was added
+// to and the message id, as ids of different streams may collide.
+type promiseKey struct {
+	stream string
+	id     string
+}
+
+// trackedPromise is a promise of a produced request that the producer is
+// waiting a response for.
+type trackedPromise[Response any] struct {
+	promise *containers.Promise[Response]
+	// deadline of the context the request was produced with, zero if none.
+	deadline time.Time
+	created  time.Time
+	priority Priority
+	// notBefore of a scheduled request, zero if it's not scheduled.
+	notBefore time.Time
+	// processDeadline after which consumers skip the request, zero if none.
+	processDeadline time.Time
+	// meta is filled with the response's metadata before the promise is
+	// resolved, nil if the caller isn't interested in it.
+	meta *ResponseMeta
+	// produced is resolved once a consumer received the request, nil if the
+	// caller didn't ask for a receipt.
+	produced *containers.Promise[struct{}]
+	// ageWarned is set once the request was reported as outstanding for
+	// longer than OutstandingAgeWarning.
+	ageWarned bool
+	// unmarshalFailures counts the check cycles its response failed to
+	// unmarshal, up to UnmarshalRetries.
+	unmarshalFailures int
+	// retryAfters counts the times it was produced again after its consumer
+	// asked to retry later, up to MaxRetryAfter.
+	retryAfters int
+	// userData the request was produced with, see WithUserData.
+	userData any
+	// decode is nil when responses are decoded with json.Unmarshal.
+	decode ResponseDecoder[Response]
+	// subscribers are resolved along with promise, see Subscribe.
+	subscribers []*containers.Promise[Response]
+	// movedFrom are the keys it was tracked under before MigrateTo moved it
+	// to another stream, nil if it wasn't moved.
+	movedFrom []promiseKey
+	// idempotencyKey the request was produced with by ProduceIdempotent,
+	// released once it stops being tracked, empty if none.
+	idempotencyKey string
 }
 
 type ProducerConfig struct {
@@ -54,50 +231,706 @@ type ProducerConfig struct {
 	CheckResultInterval time.Duration `koanf:"check-result-interval"`
 	// RequestTimeout is a TTL for any message sent to the redis stream
 	RequestTimeout time.Duration `koanf:"request-timeout"`
+	// Interval in which response keys of the stream are scanned for orphans
+	// (responses not tracked by this producer that have no expiry set).
+	// Zero disables the sweep.
+	OrphanSweepInterval time.Duration `koanf:"orphan-sweep-interval"`
+	// ResponseEntryTimeout is the TTL set on orphaned response keys found by the sweep.
+	ResponseEntryTimeout time.Duration `koanf:"response-entry-timeout"`
+	// MaxPayloadBytes is the maximum size of a marshaled request, larger
+	// requests are rejected before being added to the stream. Zero means no limit.
+	MaxPayloadBytes uint64 `koanf:"max-payload-bytes"`
+	// OrderedResolution makes promises that are ready in the same check cycle
+	// resolve in the order their requests were produced.
+	OrderedResolution bool `koanf:"ordered-resolution"`
+	// UseHashTag wraps the stream name of response keys in a redis cluster
+	// hash tag, consumers of the stream must have the same setting.
+	UseHashTag bool `koanf:"use-hash-tag"`
+	// RequireExistingGroup makes producing fail immediately when the stream
+	// or its consumer group doesn't exist, instead of the request silently
+	// timing out as there are no consumers reading it.
+	RequireExistingGroup bool `koanf:"require-existing-group"`
+	// MaxProducePerSecond limits the rate of producing requests, producing
+	// blocks until allowed by the limit. Zero means unlimited.
+	MaxProducePerSecond float64 `koanf:"max-produce-per-second"`
+	// ProduceBurst is the number of requests that can be produced at once
+	// above the MaxProducePerSecond rate.
+	ProduceBurst int `koanf:"produce-burst"`
+	// DisableTrim stops the producer from XTRIMming the stream up to the PEL's
+	// lower message, e.g. when a single coordinator owns trimming.
+	DisableTrim bool `koanf:"disable-trim"`
+	// DisableReclaim stops the producer from removing the PEL's lower message
+	// when it has been past the RequestTimeout.
+	DisableReclaim bool `koanf:"disable-reclaim"`
+	// HighPriorityRequestTimeout is the RequestTimeout of high priority
+	// requests. Zero means RequestTimeout is used.
+	HighPriorityRequestTimeout time.Duration `koanf:"high-priority-request-timeout"`
+	// LowPriorityRequestTimeout is the RequestTimeout of low priority
+	// requests. Zero means RequestTimeout is used.
+	LowPriorityRequestTimeout time.Duration `koanf:"low-priority-request-timeout"`
+	// MaxConsecutiveRedisErrors is the number of consecutive redis errors
+	// after which the rest of a check cycle is aborted, and the next one is
+	// delayed by RedisErrorBackoff. Zero disables aborting.
+	MaxConsecutiveRedisErrors int `koanf:"max-consecutive-redis-errors"`
+	// RedisErrorBackoff is the delay before the next check cycle after one
+	// was aborted due to redis errors.
+	RedisErrorBackoff time.Duration `koanf:"redis-error-backoff"`
+	// PendingScanCount is the max number of PEL entries scanned per cycle to
+	// reclaim the ones past their TTL. Zero means only the PEL's lower message
+	// is reclaimed per cycle.
+	PendingScanCount int64 `koanf:"pending-scan-count"`
+	// PendingMinIdle is the minimum idle time of PEL entries scanned for
+	// reclaiming.
+	PendingMinIdle time.Duration `koanf:"pending-min-idle"`
+	// EnableGroupReposition allows SetGroupPosition to move the consumer
+	// group's last delivered id. It is meant for incident recovery only.
+	EnableGroupReposition bool `koanf:"enable-group-reposition"`
+	// UseGetDel makes the producer read and delete response keys with a single
+	// GETDEL instead of GET followed by DEL, requires redis 6.2 or newer.
+	UseGetDel bool `koanf:"use-get-del"`
+	// CheckChunkSize is the number of promises checked while holding the
+	// promises lock, which is released between chunks of a check cycle so that
+	// produce calls aren't blocked for its whole duration. Zero means all promises
+	// are checked while holding the lock.
+	CheckChunkSize int `koanf:"check-chunk-size"`
+	// DisableHTMLEscape makes the producer marshal requests without escaping
+	// <, > and & characters.
+	DisableHTMLEscape bool `koanf:"disable-html-escape"`
+	// FailOnStreamGone makes the producer error outstanding promises of a stream
+	// with ErrStreamGone as soon as the stream or its consumer group is found to be
+	// deleted, instead of waiting for their request timeout.
+	FailOnStreamGone bool `koanf:"fail-on-stream-gone"`
+	// EnableScheduling allows ProduceAt, and extends the request timeout of
+	// scheduled requests by their delay when reclaiming them from the PEL.
+	EnableScheduling bool `koanf:"enable-scheduling"`
+	// RedisTimeSyncInterval is the interval in which the offset between the
+	// local clock and the redis server clock, which assigns message ids, is
+	// measured with TIME. Request timeouts are evaluated against the redis clock
+	// so that clock skew of the producer's host doesn't time requests out early.
+	// Zero disables it and the local clock is used.
+	RedisTimeSyncInterval time.Duration `koanf:"redis-time-sync-interval"`
+	// PayloadField is the field of stream entries holding the marshaled request,
+	// consumers of the stream must have the same setting. Empty means "msg".
+	PayloadField string `koanf:"payload-field"`
+	// MaxResolvePerCycle caps the number of promises resolved or errored per
+	// check cycle, so that a mass timeout doesn't hold the promises lock for long.
+	// The next cycle starts right away when promises are left. Zero means no cap.
+	MaxResolvePerCycle int `koanf:"max-resolve-per-cycle"`
+	// PruneOrphansInterval is the interval in which PruneOrphans deletes response
+	// keys left behind by crashed producers. Zero disables it.
+	PruneOrphansInterval time.Duration `koanf:"prune-orphans-interval"`
+	// CancelKeyTimeout is the expiry of the cancel key set when a request is
+	// canceled, which consumers poll to abort its processing. Zero disables it.
+	CancelKeyTimeout time.Duration `koanf:"cancel-key-timeout"`
+	// AckResolved makes the producer XACK the messages of requests resolved in a
+	// check cycle with a single call at its end, so that the PEL doesn't keep
+	// entries consumers failed to acknowledge and trimming can advance.
+	AckResolved bool `koanf:"ack-resolved"`
+	// OutstandingAgeWarning is the age of an outstanding request, by its message
+	// id, after which a warning is logged once, ahead of it timing out. Zero
+	// disables it.
+	OutstandingAgeWarning time.Duration `koanf:"outstanding-age-warning"`
+	// UnmarshalRetries is the number of check cycles a response failing to
+	// unmarshal is left in place and retried, before erroring the request. It
+	// smooths over response format changes during rolling upgrades.
+	UnmarshalRetries int `koanf:"unmarshal-retries"`
+	// KeepAliveTimeout is the minimum idle time of a message, reset by the
+	// heartbeat of the consumer processing it, for it to be reclaimed once past
+	// its request timeout. It should be at least the consumers'
+	// IdletimeToAutoclaim, which they heartbeat well within. Zero reclaims it
+	// regardless of its idle time, which can steal work of slow consumers.
+	KeepAliveTimeout time.Duration `koanf:"keep-alive-timeout"`
+	// TrimStallThreshold is the number of consecutive trims freeing no entries
+	// after which trimming is reported as stalled, commonly by one stuck message
+	// pinning the PEL's lower entry. Zero disables it.
+	TrimStallThreshold int `koanf:"trim-stall-threshold"`
+	// ResponseHMACKey is the shared secret consumers HMAC-sign responses with,
+	// responses without a valid signature error with ErrResponseUnverified.
+	// Consumers of the stream must have the same key. Empty disables it.
+	ResponseHMACKey string `koanf:"response-hmac-key"`
+	// EncryptionKeys are AES keys formatted as "id:hex-encoded key", which
+	// request and response payloads are encrypted with at rest in redis. The
+	// first key encrypts and all of them decrypt, so that keys can be rotated.
+	// Error responses aren't encrypted. Consumers must have the same keys.
+	EncryptionKeys []string `koanf:"encryption-keys"`
+	// EnableKeyspaceNotifications makes the producer subscribe to keyspace
+	// notifications of the stream's response keys and check responses as soon as
+	// one is set, cutting latency below CheckResultInterval, which remains as
+	// fallback. Requires notify-keyspace-events of the server to include K and
+	// string events.
+	EnableKeyspaceNotifications bool `koanf:"enable-keyspace-notifications"`
+	// PromiseShards is the number of shards, each with its own lock, that
+	// outstanding promises are split in by message id, so that concurrent
+	// produces and response checks of different shards don't contend. Values
+	// below 1 mean 1.
+	PromiseShards int `koanf:"promise-shards"`
+	// ResponseStream makes the producer read responses from the response stream
+	// of the request stream, see ResponseStreamFor, instead of a key per
+	// response. Must match consumers.
+	ResponseStream bool `koanf:"response-stream"`
+	// HeartbeatStaleness is the age after which a consumer's heartbeat for a
+	// request is stale. While it's fresh, the request doesn't time out and isn't
+	// reclaimed, so long running requests can exceed their timeout. Zero ignores
+	// heartbeats.
+	HeartbeatStaleness time.Duration `koanf:"heartbeat-staleness"`
+	// MaxRetryAfter is the number of times a request is re-produced after the
+	// delay its consumer asked to retry after with SetRetryAfter. Requires
+	// EnableScheduling, beyond it, or without scheduling, the promise errors with
+	// ErrRetryAfter.
+	MaxRetryAfter int `koanf:"max-retry-after"`
+	// StartupGracePeriod is the time after the producer started checking
+	// responses during which it doesn't reclaim PEL entries that are past
+	// their TTL, as requests that were in progress across its restart may
+	// still be answered.
+	StartupGracePeriod time.Duration `koanf:"startup-grace-period"`
+	// CheckExists pipelines EXISTS across the response keys of all outstanding
+	// promises at the start of each cycle and only reads the ones that exist,
+	// saving a round trip per promise whose response isn't ready.
+	CheckExists bool `koanf:"check-exists"`
+	// AffinityPartitions is the number of partition streams requests produced
+	// with ProduceWithAffinity are spread across by their affinity key.
+	AffinityPartitions int `koanf:"affinity-partitions"`
+	// CreateGroup makes NewProducer create the stream and its consumer group,
+	// starting at CreateGroupStartID, if the group doesn't exist.
+	CreateGroup bool `koanf:"create-group"`
+	// CreateGroupStartID is the id the group created by CreateGroup starts at,
+	// "$" to only deliver requests added after it or "0" for all of them.
+	CreateGroupStartID string `koanf:"create-group-start-id"`
+	// PriorityResolution makes promises that are ready in the same check cycle
+	// resolve in order of the priority their requests were produced with,
+	// highest first. Within a priority, OrderedResolution still applies.
+	PriorityResolution bool `koanf:"priority-resolution"`
+	// DeadConsumerIdle is the idle time, as reported by XINFO CONSUMERS, after
+	// which a consumer is deemed dead. All its pending requests are then moved
+	// off it at once, staying claimable by live consumers, and it's removed
+	// from the group. It should be well above the consumers' heartbeat period.
+	DeadConsumerIdle time.Duration `koanf:"dead-consumer-idle"`
+	// DeadConsumerReclaimBatch is the max number of pending requests of a dead
+	// consumer moved per XCLAIM.
+	DeadConsumerReclaimBatch int64 `koanf:"dead-consumer-reclaim-batch"`
+	// StreamPattern is a glob pattern of streams that are periodically discovered
+	// with SCAN and trimmed and reclaimed like the configured stream, for
+	// topologies where streams requests are routed to appear at runtime.
+	// Responses are polled for all outstanding requests whatever their stream.
+	StreamPattern string `koanf:"stream-pattern"`
+	// StreamDiscoveryInterval is the interval streams matching StreamPattern
+	// are discovered at.
+	StreamDiscoveryInterval time.Duration `koanf:"stream-discovery-interval"`
+	// MaxPromiseLifetime is a safety net against leaked promises: ones that are
+	// outstanding for longer than it are errored with ErrForceEvicted and stop
+	// being tracked, regardless of their timeouts or schedule. It should be well
+	// above the longest request timeout, e.g. twice RequestTimeout.
+	MaxPromiseLifetime time.Duration `koanf:"max-promise-lifetime"`
+	// CoalesceWindow is the time requests are buffered for before the buffered
+	// ones are added to the stream with one pipeline of XADDs, reducing round
+	// trips for bursts of produces. Zero adds each request on its own.
+	CoalesceWindow time.Duration `koanf:"coalesce-window"`
+	// CoalesceMaxBatch is the max number of requests buffered by CoalesceWindow,
+	// the buffer is flushed early when it fills.
+	CoalesceMaxBatch int `koanf:"coalesce-max-batch"`
+	// ClassifyTimeouts makes the producer check, for requests that time out,
+	// whether a consumer acked them without writing a response or no consumer
+	// finished them, logging and metering the two distinctly to tell consumer
+	// bugs from outages.
+	ClassifyTimeouts bool `koanf:"classify-timeouts"`
+	// CompressionMinBytes is the size in bytes above which marshaled requests
+	// are gzip compressed, zero disables compression.
+	CompressionMinBytes int `koanf:"compression-min-bytes"`
+	// HighWaterMark is the length of the stream above which the high-water
+	// observer is notified, zero disables checking the length of the stream.
+	HighWaterMark int64 `koanf:"high-water-mark"`
+	// LowWaterMark is the length of the stream below which a stream that was
+	// above HighWaterMark is considered recovered. Zero means HighWaterMark.
+	LowWaterMark int64 `koanf:"low-water-mark"`
+	// ChannelMaxOutstanding is the maximum number of outstanding requests of a
+	// ProduceFromChannel call, it stops receiving requests from its channel once
+	// reached until some resolve. Zero means unlimited.
+	ChannelMaxOutstanding int `koanf:"channel-max-outstanding"`
+	// AffinityOrdered makes the promises of requests produced with the same
+	// affinity key resolve in produce order, responses completed out of order
+	// are buffered until the earlier requests of the key resolve. This is
+	// head-of-line blocking: a slow request of a key, up to timing out, holds
+	// back all the later responses of the key however fast they complete.
+	AffinityOrdered bool `koanf:"affinity-ordered"`
+	// AffinityOrderedMaxOutstanding bounds the outstanding requests per
+	// affinity key with AffinityOrdered, and so the responses buffered for it,
+	// producing more fails with ErrAffinityOrderFull. Zero means unlimited.
+	AffinityOrderedMaxOutstanding int `koanf:"affinity-ordered-max-outstanding"`
+	// PersistPromises persists the message ids of outstanding requests to a redis
+	// set keyed by the producer's id, see WithID, so that after a crash or restart
+	// a producer with the same id tracks them again on Start. Callers get their
+	// promises back with Subscribe.
+	PersistPromises bool `koanf:"persist-promises"`
 }
 
 var DefaultProducerConfig = ProducerConfig{
-	CheckResultInterval: 5 * time.Second,
-	RequestTimeout:      3 * time.Hour,
+	CheckResultInterval:           5 * time.Second,
+	RequestTimeout:                3 * time.Hour,
+	OrphanSweepInterval:           0,
+	ResponseEntryTimeout:          time.Hour,
+	MaxPayloadBytes:               0,
+	OrderedResolution:             false,
+	UseHashTag:                    false,
+	RequireExistingGroup:          false,
+	MaxProducePerSecond:           0,
+	ProduceBurst:                  1,
+	DisableTrim:                   false,
+	DisableReclaim:                false,
+	HighPriorityRequestTimeout:    0,
+	LowPriorityRequestTimeout:     0,
+	MaxConsecutiveRedisErrors:     10,
+	RedisErrorBackoff:             time.Second,
+	PendingScanCount:              0,
+	PendingMinIdle:                0,
+	EnableGroupReposition:         false,
+	UseGetDel:                     false,
+	CheckChunkSize:                0,
+	DisableHTMLEscape:             false,
+	FailOnStreamGone:              false,
+	EnableScheduling:              false,
+	RedisTimeSyncInterval:         time.Minute,
+	PayloadField:                  messageKey,
+	MaxResolvePerCycle:            0,
+	PruneOrphansInterval:          0,
+	CancelKeyTimeout:              10 * time.Minute,
+	AckResolved:                   false,
+	OutstandingAgeWarning:         0,
+	UnmarshalRetries:              0,
+	KeepAliveTimeout:              DefaultConsumerConfig.IdletimeToAutoclaim,
+	TrimStallThreshold:            10,
+	ResponseHMACKey:               "",
+	EncryptionKeys:                nil,
+	EnableKeyspaceNotifications:   false,
+	PromiseShards:                 1,
+	ResponseStream:                false,
+	HeartbeatStaleness:            0,
+	MaxRetryAfter:                 3,
+	StartupGracePeriod:            0,
+	CheckExists:                   false,
+	AffinityPartitions:            0,
+	CreateGroup:                   false,
+	CreateGroupStartID:            "$",
+	PriorityResolution:            false,
+	DeadConsumerIdle:              0,
+	DeadConsumerReclaimBatch:      100,
+	StreamPattern:                 "",
+	StreamDiscoveryInterval:       time.Minute,
+	MaxPromiseLifetime:            0,
+	CoalesceWindow:                0,
+	CoalesceMaxBatch:              100,
+	ClassifyTimeouts:              false,
+	CompressionMinBytes:           0,
+	HighWaterMark:                 0,
+	LowWaterMark:                  0,
+	ChannelMaxOutstanding:         100,
+	AffinityOrdered:               false,
+	AffinityOrderedMaxOutstanding: 1000,
+	PersistPromises:               false,
 }
 
 var TestProducerConfig = ProducerConfig{
-	CheckResultInterval: 5 * time.Millisecond,
-	RequestTimeout:      time.Minute,
+	CheckResultInterval:           5 * time.Millisecond,
+	RequestTimeout:                time.Minute,
+	OrphanSweepInterval:           0,
+	ResponseEntryTimeout:          time.Minute,
+	MaxPayloadBytes:               0,
+	OrderedResolution:             false,
+	UseHashTag:                    false,
+	RequireExistingGroup:          false,
+	MaxProducePerSecond:           0,
+	ProduceBurst:                  1,
+	DisableTrim:                   false,
+	DisableReclaim:                false,
+	HighPriorityRequestTimeout:    0,
+	LowPriorityRequestTimeout:     0,
+	MaxConsecutiveRedisErrors:     10,
+	RedisErrorBackoff:             time.Second,
+	PendingScanCount:              0,
+	PendingMinIdle:                0,
+	EnableGroupReposition:         true,
+	UseGetDel:                     false,
+	CheckChunkSize:                0,
+	DisableHTMLEscape:             false,
+	FailOnStreamGone:              false,
+	EnableScheduling:              false,
+	RedisTimeSyncInterval:         time.Second,
+	PayloadField:                  messageKey,
+	MaxResolvePerCycle:            0,
+	PruneOrphansInterval:          0,
+	CancelKeyTimeout:              time.Minute,
+	AckResolved:                   false,
+	OutstandingAgeWarning:         0,
+	UnmarshalRetries:              0,
+	KeepAliveTimeout:              TestConsumerConfig.IdletimeToAutoclaim,
+	TrimStallThreshold:            10,
+	ResponseHMACKey:               "",
+	EncryptionKeys:                nil,
+	EnableKeyspaceNotifications:   false,
+	PromiseShards:                 1,
+	ResponseStream:                false,
+	HeartbeatStaleness:            0,
+	MaxRetryAfter:                 3,
+	StartupGracePeriod:            0,
+	CheckExists:                   false,
+	AffinityPartitions:            0,
+	CreateGroup:                   false,
+	CreateGroupStartID:            "$",
+	PriorityResolution:            false,
+	DeadConsumerIdle:              0,
+	DeadConsumerReclaimBatch:      100,
+	StreamPattern:                 "",
+	StreamDiscoveryInterval:       100 * time.Millisecond,
+	MaxPromiseLifetime:            0,
+	CoalesceWindow:                0,
+	CoalesceMaxBatch:              100,
+	ClassifyTimeouts:              false,
+	CompressionMinBytes:           0,
+	HighWaterMark:                 0,
+	LowWaterMark:                  0,
+	ChannelMaxOutstanding:         100,
+	AffinityOrdered:               false,
+	AffinityOrderedMaxOutstanding: 1000,
+	PersistPromises:               false,
 }
 
 func ProducerAddConfigAddOptions(prefix string, f *pflag.FlagSet) {
 	f.Duration(prefix+".check-result-interval", DefaultProducerConfig.CheckResultInterval, "interval in which producer checks pending messages whether consumer processing them is inactive")
 	f.Duration(prefix+".request-timeout", DefaultProducerConfig.RequestTimeout, "timeout after which the message in redis stream is considered as errored, this prevents workers from working on wrong requests indefinitely")
+	f.Duration(prefix+".orphan-sweep-interval", DefaultProducerConfig.OrphanSweepInterval, "interval in which producer scans response keys of the stream and sets an expiry on untracked ones that have none (0 = disabled)")
+	f.Duration(prefix+".response-entry-timeout", DefaultProducerConfig.ResponseEntryTimeout, "expiry set on orphaned response keys found by the orphan sweep")
+	f.Uint64(prefix+".max-payload-bytes", DefaultProducerConfig.MaxPayloadBytes, "maximum size in bytes of a marshaled request added to the stream (0 = unlimited)")
+	f.Bool(prefix+".ordered-resolution", DefaultProducerConfig.OrderedResolution, "resolve promises that are ready in the same check cycle in the order their requests were produced")
+	f.Bool(prefix+".use-hash-tag", DefaultProducerConfig.UseHashTag, "wrap stream name of response keys in a hash tag so that they are in the same redis cluster slot as the stream (must match consumers)")
+	f.Bool(prefix+".require-existing-group", DefaultProducerConfig.RequireExistingGroup, "fail producing immediately if the stream or its consumer group doesn't exist (costs one more redis round trip per request)")
+	f.Float64(prefix+".max-produce-per-second", DefaultProducerConfig.MaxProducePerSecond, "maximum rate of producing requests, producing blocks until allowed (0 = unlimited)")
+	f.Int(prefix+".produce-burst", DefaultProducerConfig.ProduceBurst, "number of requests that can be produced at once above the max-produce-per-second rate")
+	f.Bool(prefix+".disable-trim", DefaultProducerConfig.DisableTrim, "don't trim the stream up to the lower message of the pending entries list, e.g. when a single coordinator owns trimming")
+	f.Bool(prefix+".disable-reclaim", DefaultProducerConfig.DisableReclaim, "don't remove the lower message of the pending entries list when it has been past the request timeout")
+	f.Duration(prefix+".high-priority-request-timeout", DefaultProducerConfig.HighPriorityRequestTimeout, "request timeout of high priority requests (0 = use request-timeout)")
+	f.Duration(prefix+".low-priority-request-timeout", DefaultProducerConfig.LowPriorityRequestTimeout, "request timeout of low priority requests (0 = use request-timeout)")
+	f.Int(prefix+".max-consecutive-redis-errors", DefaultProducerConfig.MaxConsecutiveRedisErrors, "number of consecutive redis errors after which a check cycle is aborted (0 = never abort)")
+	f.Duration(prefix+".redis-error-backoff", DefaultProducerConfig.RedisErrorBackoff, "delay before the next check cycle after one was aborted due to redis errors")
+	f.Int64(prefix+".pending-scan-count", DefaultProducerConfig.PendingScanCount, "max number of pending entries scanned per cycle to reclaim the ones past their request timeout (0 = only reclaim the lower pending entry)")
+	f.Duration(prefix+".pending-min-idle", DefaultProducerConfig.PendingMinIdle, "minimum idle time of pending entries scanned for reclaiming")
+	f.Bool(prefix+".enable-group-reposition", DefaultProducerConfig.EnableGroupReposition, "allow SetGroupPosition to move the last delivered id of the consumer group (dangerous, for incident recovery only)")
+	f.Bool(prefix+".use-get-del", DefaultProducerConfig.UseGetDel, "read and delete response keys in one round trip with GETDEL (requires redis 6.2+)")
+	f.Int(prefix+".check-chunk-size", DefaultProducerConfig.CheckChunkSize, "number of promises checked per chunk of a check cycle, the promises lock is released between chunks so that produce calls can interleave (0 = check all promises while holding the lock)")
+	f.Bool(prefix+".disable-html-escape", DefaultProducerConfig.DisableHTMLEscape, "don't escape <, > and & in marshaled requests")
+	f.Bool(prefix+".fail-on-stream-gone", DefaultProducerConfig.FailOnStreamGone, "immediately fail outstanding requests of a stream when it or its consumer group is deleted, instead of waiting for their request timeout (costs one more redis round trip per stream per check cycle)")
+	f.Bool(prefix+".enable-scheduling", DefaultProducerConfig.EnableScheduling, "allow producing requests that are processed no earlier than a given time, their request timeout is extended by the delay (must be set on all producers of the stream)")
+	f.Duration(prefix+".redis-time-sync-interval", DefaultProducerConfig.RedisTimeSyncInterval, "interval in which the offset of the local clock from the redis server clock is measured, so that request timeouts which compare against redis assigned message ids are not affected by clock skew (0 = use local clock)")
+	f.String(prefix+".payload-field", DefaultProducerConfig.PayloadField, "field of stream entries holding the marshaled request (must match consumers)")
+	f.Int(prefix+".max-resolve-per-cycle", DefaultProducerConfig.MaxResolvePerCycle, "maximum number of promises resolved or errored per check cycle, the rest are left for the next cycle which starts right away (0 = unlimited)")
+	f.Duration(prefix+".prune-orphans-interval", DefaultProducerConfig.PruneOrphansInterval, "interval in which producer deletes response keys of the stream whose message isn't pending or tracked and is past the request timeout (0 = disabled)")
+	f.Duration(prefix+".cancel-key-timeout", DefaultProducerConfig.CancelKeyTimeout, "timeout of the key signaling consumers that a request was canceled (0 = don't signal consumers)")
+	f.Bool(prefix+".ack-resolved", DefaultProducerConfig.AckResolved, "explicitly acknowledge messages of resolved requests that are still pending, batched per check cycle")
+	f.Duration(prefix+".outstanding-age-warning", DefaultProducerConfig.OutstandingAgeWarning, "age of an outstanding request after which producer logs a warning, e.g. a fraction of the request timeout (0 = disabled)")
+	f.Int(prefix+".unmarshal-retries", DefaultProducerConfig.UnmarshalRetries, "number of check cycles a response that fails to unmarshal is left in place and retried before erroring its request, e.g. during rolling upgrades of consumers")
+	f.Duration(prefix+".keep-alive-timeout", DefaultProducerConfig.KeepAliveTimeout, "minimum idle time of a message past its request timeout for producer to reclaim it, so that messages of slow but alive consumers heartbeating them aren't reclaimed (0 = reclaim regardless of idle time)")
+	f.Int(prefix+".trim-stall-threshold", DefaultProducerConfig.TrimStallThreshold, "number of consecutive trims freeing nothing after which trimming is reported as stalled, e.g. by a stuck message pinning the lower pending entry (0 = disabled)")
+	f.String(prefix+".response-hmac-key", DefaultProducerConfig.ResponseHMACKey, "shared secret consumers sign responses with, responses without a valid signature are rejected (must match consumers, empty = disabled)")
+	f.StringSlice(prefix+".encryption-keys", DefaultProducerConfig.EncryptionKeys, "keys requests and responses are encrypted with at rest in redis, formatted as id:hex-encoded AES key, the first one encrypts and all decrypt (must match consumers)")
+	f.Bool(prefix+".enable-keyspace-notifications", DefaultProducerConfig.EnableKeyspaceNotifications, "check responses as soon as redis keyspace notifications report response keys of the stream being set, polling remains as fallback (requires notify-keyspace-events to include K and $)")
+	f.Int(prefix+".promise-shards", DefaultProducerConfig.PromiseShards, "number of independently locked shards the outstanding promises are split in, more shards reduce lock contention of concurrent produces and response checks (OrderedResolution still orders across shards)")
+	f.Bool(prefix+".response-stream", DefaultProducerConfig.ResponseStream, "read responses from a response stream of the request stream rather than separate keys (must match consumers)")
+	f.Duration(prefix+".heartbeat-staleness", DefaultProducerConfig.HeartbeatStaleness, "heartbeats of consumers older than this mean they abandoned the request, fresher ones keep it from timing out or being reclaimed (0 = heartbeats ignored)")
+	f.Int(prefix+".max-retry-after", DefaultProducerConfig.MaxRetryAfter, "times a request is re-produced after the delay its consumer asked to retry after, requires enable-scheduling (0 = retry hints error the request)")
+	f.Duration(prefix+".startup-grace-period", DefaultProducerConfig.StartupGracePeriod, "time after checks start during which PEL entries past their TTL aren't reclaimed, so requests in progress across a restart aren't killed (0 = no grace period)")
+	f.Bool(prefix+".check-exists", DefaultProducerConfig.CheckExists, "pipeline EXISTS across the response keys each cycle and only GET the ones that exist (ignored with response-stream)")
+	f.Int(prefix+".affinity-partitions", DefaultProducerConfig.AffinityPartitions, "number of partition streams requests produced with an affinity key are spread across, each meant to be consumed by a single consumer (0 = affinity disabled)")
+	f.Bool(prefix+".create-group", DefaultProducerConfig.CreateGroup, "create the stream and its consumer group when the producer is created, starting at create-group-start-id")
+	f.String(prefix+".create-group-start-id", DefaultProducerConfig.CreateGroupStartID, "id the consumer group created with create-group starts at, $ for new requests only or 0 for all existing ones")
+	f.Bool(prefix+".priority-resolution", DefaultProducerConfig.PriorityResolution, "resolve promises that are ready in the same check cycle in order of their request priority, highest first (combined with ordered-resolution, in produce order within a priority)")
+	f.Duration(prefix+".dead-consumer-idle", DefaultProducerConfig.DeadConsumerIdle, "consumers idle for longer than this are deemed dead, their pending requests are moved off them at once and they're removed from the group (0 = disabled)")
+	f.Int64(prefix+".dead-consumer-reclaim-batch", DefaultProducerConfig.DeadConsumerReclaimBatch, "max number of pending requests of a dead consumer moved per call")
+	f.String(prefix+".stream-pattern", DefaultProducerConfig.StreamPattern, "glob pattern of streams discovered with SCAN that are trimmed and reclaimed along with the configured stream, e.g. the streams requests are routed to by context (empty = disabled)")
+	f.Duration(prefix+".stream-discovery-interval", DefaultProducerConfig.StreamDiscoveryInterval, "interval at which streams matching stream-pattern are discovered")
+	f.Duration(prefix+".max-promise-lifetime", DefaultProducerConfig.MaxPromiseLifetime, "promises outstanding for longer than this are force errored with ErrForceEvicted whatever their timeouts, as a guard against leaks, e.g. twice request-timeout (0 = disabled)")
+	f.Duration(prefix+".coalesce-window", DefaultProducerConfig.CoalesceWindow, "time requests are buffered for to be added to the stream with one pipelined batch of XADDs (0 = every request is added on its own)")
+	f.Int(prefix+".coalesce-max-batch", DefaultProducerConfig.CoalesceMaxBatch, "max number of buffered requests, the buffer is flushed early once it fills")
+	f.Bool(prefix+".classify-timeouts", DefaultProducerConfig.ClassifyTimeouts, "tell requests that timed out after a consumer acked them without a response apart from ones no consumer finished, in logs and metrics (costs redis round trips per timeout)")
+	f.Int(prefix+".compression-min-bytes", DefaultProducerConfig.CompressionMinBytes, "gzip compress requests whose marshaled size is larger than this many bytes (0 disables compression)")
+	f.Int64(prefix+".high-water-mark", DefaultProducerConfig.HighWaterMark, "length of the stream above which the high-water observer is notified (0 disables)")
+	f.Int64(prefix+".low-water-mark", DefaultProducerConfig.LowWaterMark, "length of the stream below which the high-water observer is notified of recovery (0 means the high-water mark)")
+	f.Int(prefix+".channel-max-outstanding", DefaultProducerConfig.ChannelMaxOutstanding, "maximum number of outstanding requests produced by a ProduceFromChannel call, it stops receiving requests once reached (0 = unlimited)")
+	f.Bool(prefix+".affinity-ordered", DefaultProducerConfig.AffinityOrdered, "resolve the promises of requests produced with the same affinity key in produce order, a slow request holds back the responses of later requests of its key")
+	f.Int(prefix+".affinity-ordered-max-outstanding", DefaultProducerConfig.AffinityOrderedMaxOutstanding, "maximum number of outstanding ordered requests per affinity key, bounding the responses buffered for it, producing more fails with ErrAffinityOrderFull (0 = unlimited)")
+	f.Bool(prefix+".persist-promises", DefaultProducerConfig.PersistPromises, "persist the message ids of outstanding requests to a redis set keyed by the producer id, so that a producer restarted with the same id resumes awaiting them")
 }
 
-func NewProducer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ProducerConfig) (*Producer[Request, Response], error) {
+// Validate checks that the config is usable, so that misconfigurations are
+// reported when creating the producer instead of as a check loop spinning or
+// requests failing at runtime.
+func (c *ProducerConfig) Validate() error {
+	if c.CheckResultInterval <= 0 {
+		return fmt.Errorf("check-result-interval must be positive, got %v", c.CheckResultInterval)
+	}
+	if c.RequestTimeout <= 0 {
+		return fmt.Errorf("request-timeout must be positive, got %v", c.RequestTimeout)
+	}
+	if c.HighPriorityRequestTimeout < 0 || c.LowPriorityRequestTimeout < 0 {
+		return fmt.Errorf("priority request timeouts can't be negative, got high %v and low %v", c.HighPriorityRequestTimeout, c.LowPriorityRequestTimeout)
+	}
+	if timeout := c.minRequestTimeout(); c.CheckResultInterval >= timeout {
+		return fmt.Errorf("check-result-interval (%v) must be less than the request timeout (%v), or requests time out before their responses are checked", c.CheckResultInterval, timeout)
+	}
+	if c.MaxProducePerSecond < 0 {
+		return fmt.Errorf("max-produce-per-second can't be negative, got %v", c.MaxProducePerSecond)
+	}
+	for name, interval := range map[string]time.Duration{
+		"orphan-sweep-interval":    c.OrphanSweepInterval,
+		"redis-time-sync-interval": c.RedisTimeSyncInterval,
+		"prune-orphans-interval":   c.PruneOrphansInterval,
+		"dead-consumer-idle":       c.DeadConsumerIdle,
+		"max-promise-lifetime":     c.MaxPromiseLifetime,
+		"coalesce-window":          c.CoalesceWindow,
+	} {
+		if interval < 0 {
+			return fmt.Errorf("%s can't be negative, got %v", name, interval)
+		}
+	}
+	if c.OrphanSweepInterval != 0 && c.ResponseEntryTimeout <= 0 {
+		return fmt.Errorf("response-entry-timeout must be positive when orphan-sweep-interval is set, got %v", c.ResponseEntryTimeout)
+	}
+	if c.StreamPattern != "" && c.StreamDiscoveryInterval <= 0 {
+		return fmt.Errorf("stream-discovery-interval must be positive when stream-pattern is set, got %v", c.StreamDiscoveryInterval)
+	}
+	if c.DeadConsumerIdle != 0 && c.DeadConsumerReclaimBatch <= 0 {
+		return fmt.Errorf("dead-consumer-reclaim-batch must be positive when dead-consumer-idle is set, got %v", c.DeadConsumerReclaimBatch)
+	}
+	if c.CoalesceWindow != 0 && c.CoalesceMaxBatch <= 0 {
+		return fmt.Errorf("coalesce-max-batch must be positive when coalesce-window is set, got %v", c.CoalesceMaxBatch)
+	}
+	if c.HighWaterMark < 0 || c.LowWaterMark < 0 {
+		return fmt.Errorf("water marks can't be negative, got high %v and low %v", c.HighWaterMark, c.LowWaterMark)
+	}
+	if c.HighWaterMark != 0 && c.LowWaterMark > c.HighWaterMark {
+		return fmt.Errorf("low-water-mark (%v) can't be greater than high-water-mark (%v)", c.LowWaterMark, c.HighWaterMark)
+	}
+	if c.AffinityOrdered && c.AffinityPartitions <= 0 {
+		return errors.New("affinity-ordered requires affinity-partitions to be set")
+	}
+	return nil
+}
+
+// ProducerOption configures optional behavior of a Producer.
+type ProducerOption func(*producerOptions)
+
+type producerOptions struct {
+	idGenerator       func() string
+	checkResponseType bool
+	observer          PromiseObserver
+	eventObserver     PromiseEventObserver
+	retryPolicy       *RetryPolicy
+	readClient        redis.UniversalClient
+	trimObserver      TrimObserver
+	highWaterObserver HighWaterObserver
+	logger            log.Logger
+}
+
+// WithIDGenerator sets the function used to generate the producer's id, which
+// is the consumer name used when the producer claims messages from the PEL.
+// Defaults to defaultProducerID.
+func WithIDGenerator(idGenerator func() string) ProducerOption {
+	return func(o *producerOptions) {
+		o.idGenerator = idGenerator
+	}
+}
+
+// WithID sets a stable id for the producer, e.g. to correlate its identity
+// across restarts.
+func WithID(id string) ProducerOption {
+	return WithIDGenerator(func() string { return id })
+}
+
+// WithLogger makes the producer log through given logger instead of the
+// global one, e.g. to route its logs or apply a different level policy.
+func WithLogger(logger log.Logger) ProducerOption {
+	return func(o *producerOptions) {
+		o.logger = logger
+	}
+}
+
+// WithReadClient makes the producer look up responses through given client,
+// e.g. of a read replica, to offload the primary which still serves all the
+// writes. A response written to the primary may not have replicated yet, in
+// which case it's just picked up by a later check.
+func WithReadClient(client redis.UniversalClient) ProducerOption {
+	return func(o *producerOptions) {
+		o.readClient = client
+	}
+}
+
+// WithResponseTypeCheck makes NewProducer verify that the Response type can
+// round trip through JSON, so that a misconfigured type is caught at startup
+// instead of failing every response at runtime.
+func WithResponseTypeCheck() ProducerOption {
+	return func(o *producerOptions) {
+		o.checkResponseType = true
+	}
+}
+
+// defaultProducerID returns an id of the form hostname-pid-uuid, so that the
+// process claiming messages is identifiable in redis introspection tools.
+func defaultProducerID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.NewString())
+}
+
+// checkJSONRoundTrip marshals and unmarshals a zero value of T.
+func checkJSONRoundTrip[T any]() error {
+	var zero T
+	val, err := json.Marshal(zero)
+	if err != nil {
+		return fmt.Errorf("marshaling zero value of %T: %w", zero, err)
+	}
+	var got T
+	if err := json.Unmarshal(val, &got); err != nil {
+		return fmt.Errorf("unmarshaling zero value of %T: %w", zero, err)
+	}
+	return nil
+}
+
+// checkNonPointer errors if T is a pointer type, as unmarshaling into the zero
+// value of a pointer leaves nil pointers around for responses like "null".
+func checkNonPointer[T any]() error {
+	if t := reflect.TypeFor[T](); t.Kind() == reflect.Pointer {
+		return fmt.Errorf("%v is a pointer type, use %v instead", t, t.Elem())
+	}
+	return nil
+}
+
+// NewProducer creates a producer for the stream. Response must not be a
+// pointer type, Request may be.
+func NewProducer[Request any, Response any](client redis.UniversalClient, streamName string, cfg *ProducerConfig, opts ...ProducerOption) (*Producer[Request, Response], error) {
+	if err := checkNonPointer[Response](); err != nil {
+		return nil, fmt.Errorf("invalid response type: %w", err)
+	}
 	if client == nil {
 		return nil, fmt.Errorf("redis client cannot be nil")
 	}
 	if streamName == "" {
 		return nil, fmt.Errorf("stream name cannot be empty")
 	}
-	return &Producer[Request, Response]{
-		id:          uuid.NewString(),
-		client:      client,
-		redisStream: streamName,
-		redisGroup:  streamName, // There is 1-1 mapping of redis stream and consumer group.
-		cfg:         cfg,
-		promises:    make(map[string]*containers.Promise[Response]),
-	}, nil
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid producer config: %w", err)
+	}
+	options := producerOptions{
+		idGenerator: defaultProducerID,
+		logger:      log.Root(),
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.checkResponseType {
+		if err := checkJSONRoundTrip[Response](); err != nil {
+			return nil, fmt.Errorf("invalid response type: %w", err)
+		}
+	}
+	id := options.idGenerator()
+	if id == "" {
+		return nil, fmt.Errorf("producer id cannot be empty")
+	}
+	readClient := client
+	if options.readClient != nil {
+		readClient = options.readClient
+	}
+	ciphers, err := newCipherSet(cfg.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
+	}
+	var limiter *rate.Limiter
+	if cfg.MaxProducePerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cfg.MaxProducePerSecond), max(cfg.ProduceBurst, 1))
+	}
+	p := &Producer[Request, Response]{
+		id:                id,
+		client:            client,
+		readClient:        readClient,
+		redisStream:       streamName,
+		redisGroup:        streamName, // There is 1-1 mapping of redis stream and consumer group.
+		limiter:           limiter,
+		shards:            newPromiseShards[Response](cfg.PromiseShards),
+		responseCursors:   make(map[string]string),
+		streamResponses:   make(map[promiseKey]*streamResponse),
+		checking:          make(chan struct{}, 1),
+		started:           make(chan struct{}),
+		observer:          options.observer,
+		eventObserver:     options.eventObserver,
+		retryPolicy:       options.retryPolicy,
+		trimObserver:      options.trimObserver,
+		highWaterObserver: options.highWaterObserver,
+		ciphers:           ciphers,
+		affinityOrder:     newAffinityOrder[Response](),
+		logger:            options.logger,
+	}
+	p.cfg.Store(cfg)
+	if cfg.CoalesceWindow > 0 {
+		p.coalescer = newXAddCoalescer(client, cfg.CoalesceWindow, cfg.CoalesceMaxBatch)
+	}
+	if cfg.CreateGroup {
+		if err := p.createGroup(context.Background(), cfg.CreateGroupStartID); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// createGroup creates the stream and its consumer group starting at given id,
+// leaving the group as is if it exists.
+func (p *Producer[Request, Response]) createGroup(ctx context.Context, startID string) error {
+	if startID == "" {
+		startID = "$"
+	}
+	if err := p.client.XGroupCreateMkStream(ctx, p.stream(), p.group(), startID).Err(); err != nil {
+		if isBusyGroupErr(err) {
+			return nil
+		}
+		return fmt.Errorf("creating consumer group at %v: %w", startID, err)
+	}
+	p.logger.Info("created consumer group", "stream", p.stream(), "group", p.group(), "startID", startID)
+	return nil
+}
+
+// config returns the active config of the producer.
+func (p *Producer[Request, Response]) config() *ProducerConfig {
+	return p.cfg.Load()
+}
+
+// UpdateConfig swaps the active config of the producer, e.g. to tune
+// intervals and timeouts during incidents without restarting. Check cycles
+// and produces starting afterwards use the new values. Settings applied when
+// the producer is created or started keep their initial values: the rate
+// limit, PromiseShards, EncryptionKeys, the coalescing of XADDs and what
+// background work is enabled. UseHashTag and PayloadField keep their initial
+// values too, as they must match the consumers. Invalid configs are rejected
+// and the active config is left as is, see ProducerConfig.Validate.
+func (p *Producer[Request, Response]) UpdateConfig(cfg ProducerConfig) error {
+	current := p.config()
+	cfg.UseHashTag = current.UseHashTag
+	cfg.PayloadField = current.PayloadField
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid producer config: %w", err)
+	}
+	p.cfg.Store(&cfg)
+	return nil
 }
 
+// getUintParts parses the timestamp and serial of a message id, it's called
+// for every comparison of ids so it slices the id instead of splitting it.
 func getUintParts(msgId string) ([2]uint64, error) {
-	idParts := strings.Split(msgId, "-")
-	if len(idParts) != 2 {
+	dash := strings.IndexByte(msgId, '-')
+	if dash < 0 || strings.IndexByte(msgId[dash+1:], '-') >= 0 {
 		return [2]uint64{}, fmt.Errorf("invalid i.d: %v", msgId)
 	}
-	idTimeStamp, err := strconv.ParseUint(idParts[0], 10, 64)
+	idTimeStamp, err := strconv.ParseUint(msgId[:dash], 10, 64)
 	if err != nil {
 		return [2]uint64{}, fmt.Errorf("invalid i.d: %v err: %w", msgId, err)
 	}
-	idSerial, err := strconv.ParseUint(idParts[1], 10, 64)
+	idSerial, err := strconv.ParseUint(msgId[dash+1:], 10, 64)
 	if err != nil {
 		return [2]uint64{}, fmt.Errorf("invalid i.d serial: %v err: %w", msgId, err)
 	}
@@ -128,124 +961,1320 @@ func cmpMsgId(msgId1, msgId2 string) int {
 	return 0
 }
 
+// stopTracking removes the promise of given message after its transition,
+// the lock of its shard must be held. All the promises stop being tracked
+// through it, so that the promises gauge stays in sync.
+func (p *Producer[Request, Response]) stopTracking(shard *promiseShard[Response], key promiseKey, transition PromiseTransition) {
+	tracked, found := shard.promises[key]
+	if !found {
+		return
+	}
+	p.recordTransition(shard, key.id, tracked, transition)
+	if tracked.produced != nil && !tracked.produced.Ready() {
+		tracked.produced.ProduceError(errNoReceipt)
+	}
+	tracked.notifySubscribers()
+	if p.config().PersistPromises && !p.closed.Load() {
+		// A stopped producer leaves them persisted, for its restart to restore
+		shard.unpersisted = append(shard.unpersisted, persistedMember(key))
+	}
+	if tracked.idempotencyKey != "" && !p.closed.Load() {
+		// Nothing resolves a promise for the message anymore, later requests
+		// with the key are produced again
+		released := idempotencyRelease{key: tracked.idempotencyKey, msgId: key.id}
+		if len(tracked.movedFrom) > 0 {
+			released.msgId = tracked.movedFrom[0].id
+		}
+		p.releasedIdempotency.Store(released.key, released.msgId)
+		shard.releasedIdempotency = append(shard.releasedIdempotency, released)
+	}
+	for _, from := range tracked.movedFrom {
+		p.migrated.Delete(from)
+	}
+	delete(shard.promises, key)
+	promisesGauge.Dec(1)
+}
+
+// assembleResponse returns the response given the value of its response key.
+// If the consumer wrote a chunked response, the chunks are read and
+// concatenated, and their keys are returned so that they can be deleted along
+// with the response key.
+func (p *Producer[Request, Response]) assembleResponse(ctx context.Context, resultKey, value string) ([]byte, []string, error) {
+	count, chunked := parseChunkedMarker(value)
+	if !chunked {
+		return []byte(value), nil, nil
+	}
+	chunkKeys := make([]string, count)
+	for i := range chunkKeys {
+		chunkKeys[i] = chunkKeyFor(resultKey, i)
+	}
+	if count == 0 {
+		return nil, chunkKeys, errors.New("chunked response has no chunks")
+	}
+	// Chunks are written before the marker, so they're replicated before it too
+	chunks, err := p.readClient.MGet(ctx, chunkKeys...).Result()
+	if err != nil {
+		return nil, chunkKeys, err
+	}
+	var data []byte
+	for i, chunk := range chunks {
+		str, ok := chunk.(string)
+		if !ok {
+			return nil, chunkKeys, fmt.Errorf("missing chunk %d of %d", i, count)
+		}
+		data = append(data, str...)
+	}
+	return data, chunkKeys, nil
+}
+
+// failGoneStreams errors the promises of the streams, of given promises, whose
+// consumer group doesn't exist anymore.
+func (p *Producer[Request, Response]) failGoneStreams(ctx context.Context, keys []promiseKey) {
+	checked := make(map[string]struct{})
+	for _, key := range keys {
+		if _, found := checked[key.stream]; found {
+			continue
+		}
+		checked[key.stream] = struct{}{}
+		exists, err := groupExists(ctx, p.client, key.stream, p.groupFor(key.stream))
+		if err != nil {
+			p.logger.Warn("error checking consumer group of stream", "stream", key.stream, "err", err)
+			continue
+		}
+		if !exists {
+			p.failStream(key.stream)
+		}
+	}
+}
+
+// failStream errors all the promises of the stream with ErrStreamGone.
+func (p *Producer[Request, Response]) failStream(stream string) {
+	failed := 0
+	for _, shard := range p.shards {
+		shard.lock.Lock()
+		for key, tracked := range shard.promises {
+			if key.stream != stream {
+				continue
+			}
+			tracked.promise.ProduceError(fmt.Errorf("%w: stream %v", ErrStreamGone, stream))
+			p.stopTracking(shard, key, PromiseErrored)
+			failed++
+		}
+		p.unlockAndObserve(shard)
+	}
+	if failed > 0 {
+		p.logger.Error("Stream or its consumer group is gone, failed outstanding requests", "stream", stream, "failed", failed)
+	}
+}
+
+// readResponse reads the value of a response key, deleting it at the same time
+// when UseGetDel is set, in which case it's read from the primary.
+func (p *Producer[Request, Response]) readResponse(ctx context.Context, resultKey string) (string, error) {
+	if p.config().UseGetDel {
+		return p.client.GetDel(ctx, resultKey).Result()
+	}
+	return p.readClient.Get(ctx, resultKey).Result()
+}
+
+// existingResponses pipelines EXISTS across the response keys of the given
+// promises, returning nil if the pipeline failed so that all are read.
+func (p *Producer[Request, Response]) existingResponses(ctx context.Context, keys []promiseKey) map[promiseKey]bool {
+	useHashTag := p.config().UseHashTag
+	pipe := p.readClient.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Exists(ctx, resultKeyFor(key.stream, key.id, useHashTag))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		p.logger.Warn("Error checking existence of response keys, reading all of them", "error", err)
+		return nil
+	}
+	exists := make(map[promiseKey]bool)
+	for i, cmd := range cmds {
+		if cmd.Val() > 0 {
+			exists[keys[i]] = true
+		}
+	}
+	return exists
+}
+
 // checkResponses checks iteratively whether response for the promise is ready.
 func (p *Producer[Request, Response]) checkResponses(ctx context.Context) time.Duration {
-	log.Debug("redis producer: check responses starting")
-	p.promisesLock.Lock()
-	defer p.promisesLock.Unlock()
+	cfg := p.config()
+	p.logger.Debug("redis producer: check responses starting")
+	// Requests consumers asked to retry later, produced again once no shard lock is held
+	var retries []retryAfter
+	defer func() { p.retryLater(ctx, retries) }()
+	// Requests past their TTL, classified once no shard lock is held
+	var timedOut []promiseKey
+	if cfg.ClassifyTimeouts {
+		defer func() { p.classifyTimeouts(ctx, timedOut) }()
+	}
+	// Message ids of resolved requests per stream, acked at the end of the
+	// cycle once no shard lock is held
+	resolved := make(map[string][]string)
+	if cfg.AckResolved {
+		defer func() { p.ackResolved(ctx, resolved) }()
+	}
+	// held is the shard whose lock is held while checking its promises
+	var held *promiseShard[Response]
+	release := func() {
+		if held != nil {
+			p.unlockAndObserve(held)
+			held = nil
+		}
+	}
+	defer release()
 	responded := 0
 	errored := 0
 	checked := 0
-	allowedOldestID := fmt.Sprintf("%d-0", time.Now().Add(-p.cfg.RequestTimeout).UnixMilli())
-	for id, promise := range p.promises {
+	redisErrors := 0
+	now := time.Now()
+	// Message ids are assigned by the redis server's clock
+	redisNow := p.redisNow()
+	keys := p.trackedKeys(nil)
+	if cfg.OrderedResolution {
+		sort.Slice(keys, func(i, j int) bool { return cmpMsgId(keys[i].id, keys[j].id) == -1 })
+	} else if len(p.shards) > 1 {
+		// Group the keys by shard, so that each shard is locked once per chunk
+		sort.SliceStable(keys, func(i, j int) bool { return p.shardIndex(keys[i]) < p.shardIndex(keys[j]) })
+	}
+	if cfg.PriorityResolution {
+		p.sortByPriority(keys)
+	}
+	if cfg.FailOnStreamGone {
+		p.failGoneStreams(ctx, keys)
+	}
+	if cfg.HighWaterMark != 0 {
+		p.checkHighWater(ctx)
+	}
+	// Response keys known to exist, nil when all are read
+	var exists map[promiseKey]bool
+	if cfg.ResponseStream {
+		p.readResponseStreams(ctx, keys)
+	} else if cfg.CheckExists && len(keys) > 0 {
+		exists = p.existingResponses(ctx, keys)
+	}
+	chunkSize := cfg.CheckChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(keys)
+	}
+	for i, key := range keys {
+		if i > 0 && i%chunkSize == 0 {
+			// Let produce calls waiting for the lock interleave between chunks
+			release()
+		}
+		if shard := p.shardFor(key); shard != held {
+			release()
+			shard.lock.Lock()
+			held = shard
+		}
 		if ctx.Err() != nil {
 			return 0
 		}
+		if cfg.MaxResolvePerCycle != 0 && responded+errored >= cfg.MaxResolvePerCycle {
+			// Leave the rest for the next cycle, which releases the lock in between
+			p.logger.Debug("checkResponses reached max resolved per cycle", "responded", responded, "errored", errored, "checked", checked)
+			return 0
+		}
+		id := key.id
+		tracked, found := held.promises[key]
+		if !found {
+			// Stopped being tracked while the lock was released
+			continue
+		}
+		promise := tracked.promise
 		checked++
-		resultKey := ResultKeyFor(p.redisStream, id)
-		res, err := p.client.Get(ctx, resultKey).Result()
+		resultKey := resultKeyFor(key.stream, id, cfg.UseHashTag)
+		if age := now.Sub(tracked.created); cfg.MaxPromiseLifetime != 0 && age > cfg.MaxPromiseLifetime {
+			// Whatever kept it from resolving or timing out, don't let it leak
+			promise.ProduceError(fmt.Errorf("%w: outstanding for %v", ErrForceEvicted, age))
+			p.logger.Error("redis producer: force evicting promise outstanding past its max lifetime", "stream", key.stream, "msgId", id, "age", age)
+			forceEvictedCounter.Inc(1)
+			errored++
+			if deleted, err := p.client.Del(ctx, resultKey).Result(); err == nil {
+				responseDelCounter.Inc(deleted)
+			}
+			p.stopTracking(held, key, PromiseTimedOut)
+			continue
+		}
+		if !tracked.deadline.IsZero() && now.After(tracked.deadline) {
+			// The caller that produced this request has given up on it, so stop tracking it
+			// without waiting for the request timeout
+			promise.ProduceError(fmt.Errorf("request context deadline passed: %w", context.DeadlineExceeded))
+			p.logger.Debug("redis producer: request context deadline passed", "msgId", id)
+			errored++
+			if deleted, err := p.client.Del(ctx, resultKey).Result(); err == nil {
+				responseDelCounter.Inc(deleted)
+			}
+			p.stopTracking(held, key, PromiseTimedOut)
+			continue
+		}
+		var res, entryID string
+		var err error
+		if cfg.ResponseStream {
+			res, entryID, err = p.takeStreamResponse(key)
+		} else if exists != nil && !exists[key] {
+			// Not ready when the cycle started, don't read it
+			err = redis.Nil
+		} else {
+			res, err = p.readResponse(ctx, resultKey)
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			redisErrors++
+			if cfg.MaxConsecutiveRedisErrors != 0 && redisErrors >= cfg.MaxConsecutiveRedisErrors {
+				// Redis is likely unavailable, don't hammer it with requests for the rest of the promises
+				redisDegradedCounter.Inc(1)
+				p.logger.Error("Aborting check responses after consecutive redis errors", "errors", redisErrors, "lastError", err, "checked", checked)
+				return cfg.RedisErrorBackoff
+			}
+		} else {
+			redisErrors = 0
+		}
 		if err != nil {
 			if !errors.Is(err, redis.Nil) {
-				log.Error("Error reading value in redis", "key", resultKey, "error", err)
-			} else if cmpMsgId(id, allowedOldestID) == -1 {
+				p.logger.Error("Error reading value in redis", "key", resultKey, "error", err)
+				continue
+			}
+			if tracked.produced != nil && !tracked.produced.Ready() {
+				p.checkReceipt(ctx, resultKey, tracked)
+			}
+			if cfg.OutstandingAgeWarning != 0 && !tracked.ageWarned {
+				p.warnIfOld(redisNow, key, tracked)
+			}
+			if cmpMsgId(id, allowedOldestID(redisNow, scheduledTimeout(id, tracked.notBefore, cfg.requestTimeout(tracked.priority)))) == -1 && !p.heartbeatFresh(ctx, resultKey) {
 				// The request this producer is waiting for has been past its TTL or is older than current PEL's lower,
 				// so safe to error and stop tracking this promise
-				promise.ProduceError(errors.New("error getting response, request has been waiting for too long"))
-				log.Error("error getting response, request has been waiting past its TTL")
+				promise.ProduceError(fmt.Errorf("error getting response, request has been waiting for too long: %w", ErrRequestTimeout))
+				p.logger.Error("error getting response, request has been waiting past its TTL")
 				errored++
-				delete(p.promises, id)
+				recordResolutionAge(resolvedTimeout, id, redisNow)
+				timedOut = append(timedOut, key)
+				p.stopTracking(held, key, PromiseTimedOut)
 			}
 			continue
 		}
 		var resp Response
-		if err := json.Unmarshal([]byte(res), &resp); err != nil {
+		var meta ResponseMeta
+		transition := PromiseErrored
+		retrying := false
+		raw := res
+		res, signature := splitSignature(res)
+		data, chunkKeys, err := p.assembleResponse(ctx, resultKey, res)
+		if err == nil {
+			err = p.verifyResponse(id, data, signature)
+		}
+		if err == nil {
+			data, err = p.ciphers.decrypt(data)
+		}
+		if err == nil {
+			data, err = decompress(data)
+		}
+		if err == nil {
+			meta, data, err = splitResponseMeta(data)
+		}
+		if errors.Is(err, ErrResponseUnverified) {
+			promise.ProduceError(err)
+			p.logger.Warn("redis producer: Rejecting unverified response", "key", resultKey, "error", err)
+			errored++
+		} else if delay, isRetry := parseRetryAfterMarker(res); isRetry && cfg.EnableScheduling && tracked.retryAfters < cfg.MaxRetryAfter {
+			p.logger.Debug("redis producer: consumer asked to retry later", "key", resultKey, "delay", delay)
+			retries = append(retries, retryAfter{key: key, delay: delay})
+			retrying = true
+		} else if isRetry {
+			promise.ProduceError(fmt.Errorf("%w: after %v", ErrRetryAfter, delay))
+			p.logger.Debug("redis producer: consumer asked to retry later past max retries", "key", resultKey, "delay", delay)
+			errored++
+		} else if consumerErr, isErr := parseErrorMarker(res); isErr && !tracked.processDeadline.IsZero() && consumerErr == ErrDeadlineExceeded.Error() {
+			promise.ProduceError(ErrDeadlineExceeded)
+			p.logger.Debug("redis producer: consumer skipped request past its deadline", "key", resultKey)
+			errored++
+		} else if isErr {
+			promise.ProduceError(fmt.Errorf("%w: %s", ErrConsumerError, consumerErr))
+			p.logger.Debug("redis producer: consumer reported error", "key", resultKey, "error", consumerErr)
+			errored++
+		} else if err != nil {
+			promise.ProduceError(fmt.Errorf("error reading response: %w", err))
+			p.logger.Error("redis producer: Error reading response", "key", resultKey, "error", err)
+			errored++
+		} else if err := tracked.unmarshal(data, &resp); err != nil {
+			if tracked.unmarshalFailures < cfg.UnmarshalRetries {
+				tracked.unmarshalFailures++
+				p.logger.Warn("redis producer: Error unmarshaling, retrying next cycle", "key", resultKey, "failures", tracked.unmarshalFailures, "error", err)
+				p.keepResponse(ctx, key, resultKey, raw, entryID)
+				continue
+			}
 			promise.ProduceError(fmt.Errorf("error unmarshalling: %w", err))
-			log.Error("redis producer: Error unmarshaling", "value", res, "error", err)
+			p.logger.Error("redis producer: Error unmarshaling", "value", string(data), "error", err)
 			errored++
+			recordResolutionAge(resolvedUnmarshalError, id, redisNow)
 		} else {
+			if tracked.meta != nil {
+				*tracked.meta = meta
+			}
 			promise.Produce(resp)
+			transition = PromiseResolved
 			responded++
+			recordResolutionAge(resolvedSuccess, id, redisNow)
+		}
+		if tracked.produced != nil {
+			// Any response implies the request was received
+			if !tracked.produced.Ready() {
+				tracked.produced.Produce(struct{}{})
+			}
+			chunkKeys = append(chunkKeys, receiptKeyFor(resultKey))
+		}
+		toDelete := chunkKeys
+		if cfg.ResponseStream {
+			p.deleteStreamResponse(ctx, key.stream, entryID)
+		} else if cfg.UseGetDel {
+			// GETDEL has already deleted the response key
+			responseDelCounter.Inc(1)
+		} else {
+			toDelete = append([]string{resultKey}, chunkKeys...)
+		}
+		if len(toDelete) > 0 {
+			if deleted, err := p.client.Del(ctx, toDelete...).Result(); err != nil {
+				p.logger.Error("Error deleting response key, it will be expired by the orphan sweep if enabled", "key", resultKey, "error", err)
+			} else {
+				responseDelCounter.Inc(deleted)
+			}
+		}
+		if retrying {
+			// Tracked until it's produced again, the consumer has acked it already
+			continue
+		}
+		resolved[key.stream] = append(resolved[key.stream], id)
+		p.stopTracking(held, key, transition)
+	}
+	p.logger.Debug("checkResponses", "responded", responded, "errored", errored, "checked", checked)
+	return cfg.CheckResultInterval
+}
+
+// keepResponse leaves the response in place to be read again, restoring it if
+// GETDEL deleted it or it was taken from the response stream.
+func (p *Producer[Request, Response]) keepResponse(ctx context.Context, key promiseKey, resultKey, value, entryID string) {
+	cfg := p.config()
+	if cfg.ResponseStream {
+		p.keepStreamResponse(key, value, entryID)
+		return
+	}
+	if !cfg.UseGetDel {
+		return
+	}
+	if err := p.client.Set(ctx, resultKey, value, cfg.ResponseEntryTimeout).Err(); err != nil {
+		p.logger.Error("Error restoring response key for retry", "key", resultKey, "error", err)
+	}
+}
+
+// warnIfOld logs a warning if the request has been outstanding for longer than
+// OutstandingAgeWarning, the lock of its shard must be held.
+func (p *Producer[Request, Response]) warnIfOld(now time.Time, key promiseKey, tracked *trackedPromise[Response]) {
+	cfg := p.config()
+	enqueuedAt, err := msgIdTime(key.id)
+	if err != nil {
+		return
+	}
+	if age := now.Sub(enqueuedAt); age > cfg.OutstandingAgeWarning {
+		p.logger.Warn("Request outstanding for long, it might time out", "stream", key.stream, "msgId", key.id, "age", age, "timeout", cfg.requestTimeout(tracked.priority))
+		ageWarningCounter.Inc(1)
+		tracked.ageWarned = true
+	}
+}
+
+// ackResolved acknowledges the messages of resolved requests with one XACK
+// per stream. Consumers ack messages once they wrote the response, so it only
+// matters for messages whose ack failed.
+func (p *Producer[Request, Response]) ackResolved(ctx context.Context, resolved map[string][]string) {
+	for stream, msgIds := range resolved {
+		acked, err := p.client.XAck(ctx, stream, p.groupFor(stream), msgIds...).Result()
+		if err != nil {
+			p.logger.Warn("error acking resolved messages", "stream", stream, "count", len(msgIds), "err", err)
+			continue
+		}
+		xackCounter.Inc(acked)
+	}
+}
+
+// messageRequestTimeout returns the request timeout of a message in the
+// stream, when timeouts depend on priority or scheduling it's read from the
+// message's fields.
+func (p *Producer[Request, Response]) messageRequestTimeout(ctx context.Context, stream, msgId string) time.Duration {
+	cfg := p.config()
+	if !cfg.hasPriorityTimeouts() && !cfg.EnableScheduling {
+		return cfg.RequestTimeout
+	}
+	msgs, err := p.client.XRangeN(ctx, stream, msgId, msgId, 1).Result()
+	if err != nil || len(msgs) == 0 {
+		if err != nil {
+			p.logger.Warn("error reading priority of message", "msgID", msgId, "err", err)
+		}
+		return cfg.RequestTimeout
+	}
+	notBefore, _ := parseNotBefore(msgs[0].Values)
+	return scheduledTimeout(msgId, notBefore, cfg.requestTimeout(parsePriority(msgs[0].Values)))
+}
+
+// reclaimExpired claims, acks and deletes the message that is past its TTL,
+// once its taken out from PEL the producer that sent this request will handle
+// the corresponding promise accordingly. Returns false if the message hasn't
+// been idle for KeepAliveTimeout or its heartbeat is fresh, as its consumer
+// is still alive, or the producer is in its StartupGracePeriod.
+func (p *Producer[Request, Response]) reclaimExpired(ctx context.Context, stream, msgId string) (bool, error) {
+	cfg := p.config()
+	if grace := cfg.StartupGracePeriod; grace > 0 && time.Since(p.checksStartedAt) < grace {
+		p.logger.Debug("Not reclaiming message during startup grace period", "msgID", msgId)
+		return false, nil
+	}
+	if p.heartbeatFresh(ctx, resultKeyFor(stream, msgId, cfg.UseHashTag)) {
+		p.logger.Debug("Not reclaiming message with fresh heartbeat", "msgID", msgId)
+		return false, nil
+	}
+	claimed, err := p.client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    p.groupFor(stream),
+		Consumer: p.id,
+		MinIdle:  cfg.KeepAliveTimeout,
+		Messages: []string{msgId},
+	}).Result()
+	if err != nil {
+		return false, fmt.Errorf("claiming: %w", err)
+	}
+	if len(claimed) == 0 {
+		p.logger.Debug("Not reclaiming message of alive consumer", "msgID", msgId)
+		return false, nil
+	}
+	// Recorded before acking, so that a timeout noticed meanwhile isn't
+	// classified as processed
+	p.recordReclaimed(promiseKey{stream: stream, id: msgId})
+	acked, err := p.client.XAck(ctx, stream, p.groupFor(stream), msgId).Result()
+	if err != nil {
+		return false, fmt.Errorf("acking: %w", err)
+	}
+	xackCounter.Inc(acked)
+	deleted, err := p.client.XDel(ctx, stream, msgId).Result()
+	if err != nil {
+		return false, fmt.Errorf("deleting: %w", err)
+	}
+	xdelCounter.Inc(deleted)
+	return true, nil
+}
+
+// reclaimPending scans up to PendingScanCount messages of the PEL that have
+// been idle for at least PendingMinIdle and reclaims the ones that are past
+// their TTL, so that more than the PEL's lower message is reclaimed per cycle.
+func (p *Producer[Request, Response]) reclaimPending(ctx context.Context) time.Duration {
+	cfg := p.config()
+	now := p.redisNow()
+	pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: p.stream(),
+		Group:  p.group(),
+		Start:  "-",
+		End:    allowedOldestID(now, cfg.minRequestTimeout()),
+		Count:  cfg.PendingScanCount,
+		Idle:   cfg.PendingMinIdle,
+	}).Result()
+	if err != nil {
+		p.logger.Error("error getting PEL entries from xpending", "err", err)
+		return 5 * cfg.CheckResultInterval
+	}
+	reclaimed := 0
+	for _, entry := range pending {
+		if cmpMsgId(entry.ID, allowedOldestID(now, p.messageRequestTimeout(ctx, p.stream(), entry.ID))) != -1 {
+			continue
 		}
-		p.client.Del(ctx, resultKey)
-		delete(p.promises, id)
+		if ok, err := p.reclaimExpired(ctx, p.stream(), entry.ID); err != nil {
+			p.logger.Error("error reclaiming PEL message thats past its TTL", "msgID", entry.ID, "err", err)
+			continue
+		} else if !ok {
+			continue
+		}
+		reclaimed++
+	}
+	p.logger.Debug("reclaimPending", "scanned", len(pending), "reclaimed", reclaimed)
+	if reclaimed == len(pending) && int64(reclaimed) == cfg.PendingScanCount {
+		// There might be more messages to reclaim
+		return 0
 	}
-	log.Debug("checkResponses", "responded", responded, "errored", errored, "checked", checked)
-	return p.cfg.CheckResultInterval
+	return 5 * cfg.CheckResultInterval
 }
 
 func (p *Producer[Request, Response]) clearMessages(ctx context.Context) time.Duration {
-	pelData, err := p.client.XPending(ctx, p.redisStream, p.redisGroup).Result()
+	interval := p.clearStream(ctx, p.stream())
+	for _, stream := range p.discoveredStreams() {
+		if stream != p.stream() {
+			interval = min(interval, p.clearStream(ctx, stream))
+		}
+	}
+	return interval
+}
+
+// clearStream trims the stream up to its PEL's lower entry and reclaims the
+// entries past their TTL. Only for the configured stream the group is
+// recreated if it's missing and trims are observed.
+func (p *Producer[Request, Response]) clearStream(ctx context.Context, stream string) time.Duration {
+	cfg := p.config()
+	configured := stream == p.stream()
+	pelData, err := p.client.XPending(ctx, stream, p.groupFor(stream)).Result()
 	if err != nil {
-		log.Error("error getting PEL data from xpending, xtrimming is disabled", "err", err)
+		xpendingErrorCounter.Inc(1)
+		p.logger.Error("error getting PEL data from xpending, xtrimming is disabled", "stream", stream, "err", err)
+		if configured && isNoGroupErr(err) {
+			if cfg.FailOnStreamGone {
+				// Fail before the group is recreated, after which it can't be told that it was gone
+				p.failStream(p.stream())
+			}
+			p.recreateGroup(ctx)
+		}
 	}
 	// XDEL on consumer side already deletes acked messages (mark as deleted) but doesnt claim the memory back, XTRIM helps in claiming this memory in normal conditions
 	// pelData might be outdated when we do the xtrim, but thats ok as the messages are also being trimmed by other producers
 	if pelData != nil && pelData.Lower != "" {
-		trimmed, trimErr := p.client.XTrimMinID(ctx, p.redisStream, pelData.Lower).Result()
-		log.Debug("trimming", "xTrimMinID", pelData.Lower, "trimmed", trimmed, "trim-err", trimErr)
+		if !cfg.DisableTrim {
+			trimmed, trimErr := p.client.XTrimMinID(ctx, stream, pelData.Lower).Result()
+			p.logger.Debug("trimming", "stream", stream, "xTrimMinID", pelData.Lower, "trimmed", trimmed, "trim-err", trimErr)
+			if trimErr == nil {
+				trimmedCounter.Inc(trimmed)
+				if configured {
+					p.recordTrim(pelData.Lower, trimmed)
+				}
+			}
+		}
 		// Check if pelData.Lower has been past its TTL and if it is then ack it to remove from PEL and delete it, once
 		// its taken out from PEL the producer that sent this request will handle the corresponding promise accordingly (as its past TTL)
-		allowedOldestID := fmt.Sprintf("%d-0", time.Now().Add(-p.cfg.RequestTimeout).UnixMilli())
-		if cmpMsgId(pelData.Lower, allowedOldestID) == -1 {
-			if err := p.client.XClaim(ctx, &redis.XClaimArgs{
-				Stream:   p.redisStream,
-				Group:    p.redisGroup,
-				Consumer: p.id,
-				MinIdle:  0,
-				Messages: []string{pelData.Lower},
-			}).Err(); err != nil {
-				log.Error("error claiming PEL's lower message thats past its TTL", "msgID", pelData.Lower, "err", err)
-				return 5 * p.cfg.CheckResultInterval
-			}
-			if _, err := p.client.XAck(ctx, p.redisStream, p.redisGroup, pelData.Lower).Result(); err != nil {
-				log.Error("error acking PEL's lower message thats past its TTL", "msgID", pelData.Lower, "err", err)
-				return 5 * p.cfg.CheckResultInterval
-			}
-			if _, err := p.client.XDel(ctx, p.redisStream, pelData.Lower).Result(); err != nil {
-				log.Error("error deleting PEL's lower message thats past its TTL", "msgID", pelData.Lower, "err", err)
-				return 5 * p.cfg.CheckResultInterval
+		if !cfg.DisableReclaim && (cfg.PendingScanCount == 0 || !configured) && cmpMsgId(pelData.Lower, allowedOldestID(p.redisNow(), p.messageRequestTimeout(ctx, stream, pelData.Lower))) == -1 {
+			ok, err := p.reclaimExpired(ctx, stream, pelData.Lower)
+			if err != nil {
+				p.logger.Error("error reclaiming PEL's lower message thats past its TTL", "stream", stream, "msgID", pelData.Lower, "err", err)
+				return 5 * cfg.CheckResultInterval
+			}
+			if ok {
+				return 0
 			}
-			return 0
 		}
 	}
-	return 5 * p.cfg.CheckResultInterval
+	if configured && !cfg.DisableReclaim && cfg.PendingScanCount > 0 {
+		return p.reclaimPending(ctx)
+	}
+	return 5 * cfg.CheckResultInterval
+}
+
+// sweepOrphanedResponses scans the response keys of the stream and sets an
+// expiry on the ones that have none and aren't tracked by this producer, so
+// that responses left behind for dead producers don't leak.
+func (p *Producer[Request, Response]) sweepOrphanedResponses(ctx context.Context) time.Duration {
+	cfg := p.config()
+	keys := p.trackedKeys(nil)
+	tracked := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		tracked[resultKeyFor(key.stream, key.id, cfg.UseHashTag)] = struct{}{}
+	}
+	expired := 0
+	iter := p.client.Scan(ctx, 0, resultKeyFor(p.stream(), "*", cfg.UseHashTag), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if _, found := tracked[key]; found {
+			continue
+		}
+		ttl, err := p.client.TTL(ctx, key).Result()
+		if err != nil {
+			p.logger.Error("Error getting ttl of response key", "key", key, "error", err)
+			continue
+		}
+		// TTL of -1 means the key exists but has no expiry associated
+		if ttl != -1 {
+			continue
+		}
+		if err := p.client.Expire(ctx, key, cfg.ResponseEntryTimeout).Err(); err != nil {
+			p.logger.Error("Error setting expiry on orphaned response key", "key", key, "error", err)
+			continue
+		}
+		expired++
+	}
+	if err := iter.Err(); err != nil {
+		p.logger.Error("Error scanning response keys", "stream", p.stream(), "error", err)
+	}
+	p.logger.Debug("sweepOrphanedResponses", "expired", expired)
+	return cfg.OrphanSweepInterval
+}
+
+// recreateGroup creates the consumer group of the stream when it went missing,
+// otherwise no XPENDING data is available and reclaiming is permanently broken.
+// The group is created at the start of the stream so that messages produced
+// while it was missing are still delivered to consumers.
+func (p *Producer[Request, Response]) recreateGroup(ctx context.Context) {
+	if err := p.client.XGroupCreateMkStream(ctx, p.stream(), p.group(), "0").Err(); err != nil {
+		if !isBusyGroupErr(err) {
+			p.logger.Error("error recreating missing consumer group", "stream", p.stream(), "group", p.group(), "err", err)
+		}
+		return
+	}
+	groupRecreatedCounter.Inc(1)
+	p.logger.Warn("recreated missing consumer group", "stream", p.stream(), "group", p.group())
+}
+
+func (p *Producer[Request, Response]) Id() string {
+	return p.id
 }
 
 func (p *Producer[Request, Response]) Start(ctx context.Context) {
+	cfg := p.config()
 	p.StopWaiter.Start(ctx, p)
+	if cfg.PersistPromises {
+		p.restorePromises(ctx)
+	}
+	if cfg.OrphanSweepInterval != 0 {
+		p.StopWaiter.CallIteratively(p.sweepOrphanedResponses)
+	}
+	if cfg.RedisTimeSyncInterval != 0 {
+		p.StopWaiter.CallIteratively(p.syncRedisTime)
+	}
+	if cfg.PruneOrphansInterval != 0 {
+		p.StopWaiter.CallIteratively(p.pruneOrphans)
+	}
+	if cfg.EnableKeyspaceNotifications {
+		p.StopWaiter.LaunchThread(p.watchKeyspace)
+	}
+	if cfg.DeadConsumerIdle != 0 {
+		p.StopWaiter.CallIteratively(p.reclaimDeadConsumers)
+	}
+	if cfg.StreamPattern != "" {
+		p.StopWaiter.CallIteratively(p.discoverStreams)
+	}
+}
+
+// CancelWhere errors with ErrRequestCanceled and stops tracking all the
+// outstanding promises whose message id matches the predicate, and best effort
+// removes their messages and responses from redis. Returns the number of
+// canceled promises.
+func (p *Producer[Request, Response]) CancelWhere(ctx context.Context, match func(msgId string) bool) int {
+	var canceled []promiseKey
+	for _, shard := range p.shards {
+		shard.lock.Lock()
+		for key, tracked := range shard.promises {
+			if !match(key.id) {
+				continue
+			}
+			tracked.promise.ProduceError(ErrRequestCanceled)
+			p.stopTracking(shard, key, PromiseCanceled)
+			canceled = append(canceled, key)
+		}
+		p.unlockAndObserve(shard)
+	}
+	for _, key := range canceled {
+		p.signalCancel(ctx, key.stream, key.id)
+		p.removeFromRedis(ctx, key.stream, key.id)
+	}
+	return len(canceled)
+}
+
+// removeFromRedis deletes message with given id from the stream, along with
+// its response if there is one. Errors are logged as it's best effort only.
+func (p *Producer[Request, Response]) removeFromRedis(ctx context.Context, stream, msgId string) {
+	if acked, err := p.client.XAck(ctx, stream, p.groupFor(stream), msgId).Result(); err != nil {
+		p.logger.Warn("error acking message", "msgId", msgId, "err", err)
+	} else {
+		xackCounter.Inc(acked)
+	}
+	if deleted, err := p.client.XDel(ctx, stream, msgId).Result(); err != nil {
+		p.logger.Warn("error deleting message", "msgId", msgId, "err", err)
+	} else {
+		xdelCounter.Inc(deleted)
+	}
+	if deleted, err := p.client.Del(ctx, resultKeyFor(stream, msgId, p.config().UseHashTag)).Result(); err != nil {
+		p.logger.Warn("error deleting response", "msgId", msgId, "err", err)
+	} else {
+		responseDelCounter.Inc(deleted)
+	}
+}
+
+// StopAndWait stops the producer and errors all the outstanding promises with
+// ErrProducerClosed, so that callers awaiting them don't wait forever. It is
+// safe to call multiple times.
+func (p *Producer[Request, Response]) StopAndWait() {
+	p.StopWaiter.StopAndWait()
+	// Produces tracking a promise from now on see it's closed under the shard's lock
+	p.closed.Store(true)
+	for _, shard := range p.shards {
+		shard.lock.Lock()
+		for key, tracked := range shard.promises {
+			tracked.promise.ProduceError(ErrProducerClosed)
+			p.stopTracking(shard, key, PromiseCanceled)
+		}
+		p.unlockAndObserve(shard)
+	}
+}
+
+// OutstandingIDs returns a snapshot of the message ids of the requests the
+// producer is still waiting a response for, in the order they were produced.
+func (p *Producer[Request, Response]) OutstandingIDs() []string {
+	keys := p.trackedKeys(nil)
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return cmpMsgId(ids[i], ids[j]) == -1 })
+	return ids
 }
 
 func (p *Producer[Request, Response]) promisesLen() int {
-	p.promisesLock.Lock()
-	defer p.promisesLock.Unlock()
-	return len(p.promises)
+	count := 0
+	for _, shard := range p.shards {
+		shard.lock.RLock()
+		count += len(shard.promises)
+		shard.lock.RUnlock()
+	}
+	return count
 }
 
-func (p *Producer[Request, Response]) produce(ctx context.Context, value Request) (*containers.Promise[Response], error) {
-	val, err := json.Marshal(value)
+// marshalRequest applies the middlewares to the request and marshals it,
+// compressing it if it's larger than the compression threshold and encrypting
+// it if encryption is enabled.
+func (p *Producer[Request, Response]) marshalRequest(ctx context.Context, value Request) ([]byte, error) {
+	cfg := p.config()
+	value, err := p.applyMiddlewares(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	val, err := p.marshal(value)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling value: %w", err)
 	}
-	// catching the promiseLock before we sendXadd makes sure promise ids will be always ascending
-	p.promisesLock.Lock()
-	defer p.promisesLock.Unlock()
-	msgId, err := p.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: p.redisStream,
-		Values: map[string]any{messageKey: val},
-	}).Result()
+	if cfg.MaxPayloadBytes != 0 && uint64(len(val)) > cfg.MaxPayloadBytes {
+		return nil, fmt.Errorf("%w: marshaled request is %d bytes, max allowed is %d bytes", ErrPayloadTooLarge, len(val), cfg.MaxPayloadBytes)
+	}
+	if val, err = compress(val, cfg.CompressionMinBytes); err != nil {
+		return nil, err
+	}
+	return p.ciphers.encrypt(val)
+}
+
+// marshal encodes the request as JSON, escaping HTML characters unless
+// DisableHTMLEscape is set.
+func (p *Producer[Request, Response]) marshal(value Request) ([]byte, error) {
+	if !p.config().DisableHTMLEscape {
+		return json.Marshal(value)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	// Encode terminates the value with a newline, unlike Marshal
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// addToStream adds an entry with given values to the stream and returns its id.
+func (p *Producer[Request, Response]) addToStream(ctx context.Context, stream string, values map[string]any) (string, error) {
+	// Don't enqueue work for callers that have already given up on it
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if p.config().RequireExistingGroup {
+		exists, err := groupExists(ctx, p.client, stream, p.groupFor(stream))
+		if err != nil {
+			return "", fmt.Errorf("checking consumer group: %w", err)
+		}
+		if !exists {
+			return "", fmt.Errorf("%w: stream %v, group %v", ErrGroupNotFound, stream, p.groupFor(stream))
+		}
+	}
+	args := &redis.XAddArgs{
+		Stream: stream,
+		ID:     explicitID(ctx),
+		Values: values,
+	}
+	var msgId string
+	var err error
+	if p.coalescer != nil {
+		msgId, err = p.coalescer.add(args)
+	} else {
+		start := time.Now()
+		msgId, err = p.client.XAdd(ctx, args).Result()
+		recordXAdd(stream, start, err)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("adding values to redis: %w", err)
+		return "", fmt.Errorf("adding values to redis: %w", err)
 	}
-	promise := containers.NewPromise[Response](nil)
-	p.promises[msgId] = &promise
-	return &promise, nil
+	return msgId, nil
 }
 
-func (p *Producer[Request, Response]) Produce(ctx context.Context, value Request) (*containers.Promise[Response], error) {
-	log.Debug("Redis stream producing", "value", value)
+// xaddMetrics are the per stream metrics of XADDs.
+type xaddMetrics struct {
+	duration metrics.Timer
+	errors   metrics.Counter
+	added    metrics.Counter
+}
+
+// xaddMetricsByStream caches the registered metrics of each stream, so that
+// they aren't looked up in the registry on every XADD.
+var xaddMetricsByStream containers.SyncMap[string, *xaddMetrics]
+
+func xaddMetricsFor(stream string) *xaddMetrics {
+	if m, found := xaddMetricsByStream.Load(stream); found {
+		return m
+	}
+	m := &xaddMetrics{
+		duration: metrics.GetOrRegisterTimer(xaddMetricPrefix+stream+"/duration", nil),
+		errors:   metrics.GetOrRegisterCounter(xaddMetricPrefix+stream+"/error", nil),
+		added:    metrics.GetOrRegisterCounter(xaddMetricPrefix+stream, nil),
+	}
+	xaddMetricsByStream.Store(stream, m)
+	return m
+}
+
+// recordXAdd updates the metrics of an XADD to the stream started at start.
+func recordXAdd(stream string, start time.Time, err error) {
+	m := xaddMetricsFor(stream)
+	m.duration.UpdateSince(start)
+	if err != nil {
+		m.errors.Inc(1)
+		return
+	}
+	xaddCounter.Inc(1)
+	m.added.Inc(1)
+}
+
+// waitRateLimit blocks until producing is allowed by the rate limit.
+func (p *Producer[Request, Response]) waitRateLimit(ctx context.Context) error {
+	if p.limiter == nil {
+		return nil
+	}
+	if err := p.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for produce rate limit: %w", err)
+	}
+	return nil
+}
+
+func (p *Producer[Request, Response]) produce(ctx context.Context, value Request, priority Priority) (promiseKey, *containers.Promise[Response], error) {
+	if err := p.waitRateLimit(ctx); err != nil {
+		return promiseKey{}, nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return promiseKey{}, nil, err
+	}
+	return p.produceValues(ctx, map[string]any{payloadField(p.config().PayloadField): val}, priority)
+}
+
+// produceValues adds an entry with given values to the stream and tracks the
+// promise of its response, configured by given functions before the lock is
+// released.
+func (p *Producer[Request, Response]) produceValues(ctx context.Context, values map[string]any, priority Priority, configure ...func(*trackedPromise[Response])) (promiseKey, *containers.Promise[Response], error) {
+	return p.produceValuesInto(ctx, values, priority, nil, configure...)
+}
+
+// produceValuesInto is like produceValues, but tracks given promise instead of
+// allocating one if it's not nil.
+func (p *Producer[Request, Response]) produceValuesInto(ctx context.Context, values map[string]any, priority Priority, into *containers.Promise[Response], configure ...func(*trackedPromise[Response])) (promiseKey, *containers.Promise[Response], error) {
+	if priority != PriorityNormal {
+		values[priorityKey] = int(priority)
+	}
+	// holding produceLock keeps the stream from being migrated while it's produced to,
+	// ids aren't tracked in order so checkResponses sorts them when it has to
+	p.produceLock.RLock()
+	defer p.produceLock.RUnlock()
+	if p.closed.Load() {
+		return promiseKey{}, nil, ErrProducerClosed
+	}
+	if p.paused.Load() {
+		return promiseKey{}, nil, ErrProducerPaused
+	}
+	stream := p.streamFor(ctx)
+	if id := explicitID(ctx); id != "" && p.isTracked(promiseKey{stream: stream, id: id}) {
+		return promiseKey{}, nil, fmt.Errorf("%w: %v", ErrDuplicateRequest, id)
+	}
+	msgId, err := p.addToStream(ctx, stream, values)
+	if err != nil {
+		return promiseKey{}, nil, err
+	}
+	key := promiseKey{stream: stream, id: msgId}
+	persisted := p.persistPromise(ctx, key)
+	shard := p.shardFor(key)
+	shard.lock.Lock()
+	defer p.unlockAndObserve(shard)
+	if p.closed.Load() {
+		if persisted {
+			shard.unpersisted = append(shard.unpersisted, persistedMember(key))
+		}
+		return promiseKey{}, nil, ErrProducerClosed
+	}
+	if _, found := shard.promises[key]; found {
+		// Tracking it again would leak the awaiter of the outstanding promise,
+		// which the persisted member stays for
+		return promiseKey{}, nil, fmt.Errorf("%w: %v", ErrDuplicateRequest, msgId)
+	}
+	promise := p.track(ctx, shard, key, priority, into)
+	for _, c := range configure {
+		c(shard.promises[key])
+	}
+	return key, promise, nil
+}
+
+// track starts tracking a promise for the response of given message, given
+// promise or a new one if it's nil, the lock of given shard must be held.
+func (p *Producer[Request, Response]) track(ctx context.Context, shard *promiseShard[Response], key promiseKey, priority Priority, promise *containers.Promise[Response]) *containers.Promise[Response] {
+	if promise == nil {
+		newPromise := containers.NewPromise[Response](nil)
+		promise = &newPromise
+	}
+	tracked := &trackedPromise[Response]{promise: promise, priority: priority, created: time.Now(), userData: userData(ctx)}
+	if deadline, ok := ctx.Deadline(); ok {
+		tracked.deadline = deadline
+	}
+	shard.promises[key] = tracked
+	p.recordTransition(shard, key.id, tracked, PromiseCreated)
+	promisesGauge.Inc(1)
+	return promise
+}
+
+func (p *Producer[Request, Response]) startIterativeChecks() {
+	cfg := p.config()
 	p.once.Do(func() {
-		p.StopWaiter.CallIteratively(p.checkResponses)
-		p.StopWaiter.CallIteratively(p.clearMessages)
+		p.checksStartedAt = time.Now()
+		p.StopWaiter.CallIteratively(func(ctx context.Context) time.Duration {
+			interval, err := p.runChecks(ctx)
+			if err != nil {
+				return 0
+			}
+			p.startedOnce.Do(func() { close(p.started) })
+			return interval
+		})
+		if !cfg.DisableTrim || !cfg.DisableReclaim {
+			p.StopWaiter.CallIteratively(p.clearMessages)
+		}
 	})
-	return p.produce(ctx, value)
+}
+
+// Started returns a channel closed once the first cycle of checking responses
+// completed, the checks start with the first produced request or WaitStarted.
+func (p *Producer[Request, Response]) Started() <-chan struct{} {
+	return p.started
+}
+
+// WaitStarted starts checking responses if it hasn't started yet and waits
+// until its first cycle completed. The producer must be started.
+func (p *Producer[Request, Response]) WaitStarted(ctx context.Context) error {
+	p.startIterativeChecks()
+	select {
+	case <-p.started:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Producer[Request, Response]) Produce(ctx context.Context, value Request) (*containers.Promise[Response], error) {
+	p.logger.Debug("Redis stream producing", "value", value)
+	p.startIterativeChecks()
+	_, promise, err := p.produce(ctx, value, PriorityNormal)
+	return promise, err
+}
+
+// ProduceInto is like Produce, but tracks the caller supplied promise instead
+// of allocating one, for callers recycling promises e.g. with a sync.Pool. The
+// promise must be created by containers.NewPromise and not been produced, and
+// must not be reused before it's ready, as the producer keeps resolving it
+// until then.
+func (p *Producer[Request, Response]) ProduceInto(ctx context.Context, value Request, promise *containers.Promise[Response]) error {
+	if promise == nil || promise.ReadyChan() == nil {
+		return errors.New("promise must be created by containers.NewPromise")
+	}
+	if promise.Ready() {
+		return errors.New("promise is already produced")
+	}
+	p.logger.Debug("Redis stream producing into promise", "value", value)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return err
+	}
+	_, _, err = p.produceValuesInto(ctx, map[string]any{payloadField(p.config().PayloadField): val}, PriorityNormal, promise)
+	return err
+}
+
+// ProduceWithPriority is like Produce, but the request's priority is stored in
+// its stream entry and determines its request timeout.
+func (p *Producer[Request, Response]) ProduceWithPriority(ctx context.Context, value Request, priority Priority) (*containers.Promise[Response], error) {
+	p.logger.Debug("Redis stream producing", "value", value, "priority", priority)
+	p.startIterativeChecks()
+	_, promise, err := p.produce(ctx, value, priority)
+	return promise, err
+}
+
+// ProduceNoWait adds the request to the stream without tracking a response for
+// it, intended for notification style messages. Consumers see such messages
+// with NoResponse set and complete them without writing a response.
+func (p *Producer[Request, Response]) ProduceNoWait(ctx context.Context, value Request) (string, error) {
+	p.logger.Debug("Redis stream producing without response", "value", value)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return "", err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	// holding produceLock keeps Pause from returning while it's produced
+	p.produceLock.RLock()
+	defer p.produceLock.RUnlock()
+	if p.closed.Load() {
+		return "", ErrProducerClosed
+	}
+	if p.paused.Load() {
+		return "", ErrProducerPaused
+	}
+	return p.addToStream(ctx, p.streamFor(ctx), map[string]any{payloadField(p.config().PayloadField): val, noResponseKey: true})
+}
+
+// ProduceStream is like Produce, but reads the already marshaled JSON request
+// from the reader in chunks, which are added as separate fields of the stream
+// entry, instead of marshaling a request value.
+func (p *Producer[Request, Response]) ProduceStream(ctx context.Context, r io.Reader) (*containers.Promise[Response], error) {
+	cfg := p.config()
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	var total uint64
+	count := 0
+	for {
+		chunk := make([]byte, streamChunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			total += uint64(n)
+			if cfg.MaxPayloadBytes != 0 && total > cfg.MaxPayloadBytes {
+				return nil, fmt.Errorf("%w: streamed request exceeds max allowed %d bytes", ErrPayloadTooLarge, cfg.MaxPayloadBytes)
+			}
+			// Chunks are encrypted separately, so that the request doesn't need to be buffered
+			encrypted, err := p.ciphers.encrypt(chunk[:n])
+			if err != nil {
+				return nil, err
+			}
+			values[messageChunkKeyFor(cfg.PayloadField, count)] = encrypted
+			count++
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading request: %w", err)
+		}
+	}
+	if count == 0 {
+		return nil, errors.New("streamed request is empty")
+	}
+	values[messageChunksKeyFor(cfg.PayloadField)] = count
+	p.logger.Debug("Redis stream producing from reader", "bytes", total, "chunks", count)
+	_, promise, err := p.produceValues(ctx, values, PriorityNormal)
+	return promise, err
+}
+
+// ProduceRaw is like Produce, but adds already marshaled request bytes to the
+// stream as is, skipping marshaling. It is intended for proxies relaying
+// requests from other systems. The caller is responsible for the bytes being
+// a JSON encoding of Request that consumers can unmarshal.
+func (p *Producer[Request, Response]) ProduceRaw(ctx context.Context, value []byte) (*containers.Promise[Response], error) {
+	cfg := p.config()
+	p.logger.Debug("Redis stream producing raw", "bytes", len(value))
+	p.startIterativeChecks()
+	if len(value) == 0 {
+		return nil, errors.New("raw request is empty")
+	}
+	if cfg.MaxPayloadBytes != 0 && uint64(len(value)) > cfg.MaxPayloadBytes {
+		return nil, fmt.Errorf("%w: raw request is %d bytes, max allowed is %d bytes", ErrPayloadTooLarge, len(value), cfg.MaxPayloadBytes)
+	}
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	value, err := p.ciphers.encrypt(value)
+	if err != nil {
+		return nil, err
+	}
+	_, promise, err := p.produceValues(ctx, map[string]any{payloadField(cfg.PayloadField): value}, PriorityNormal)
+	return promise, err
+}
+
+// ProduceIdempotent is like Produce, but requests produced with the same
+// idempotency key while the first one is outstanding, and the key hasn't
+// expired after ResponseEntryTimeout, all resolve with its response instead of
+// producing a new request. This keeps retries of callers from duplicating
+// work. Once the first one resolved the key is released, so that the next
+// request with it is produced again rather than awaiting a consumed response.
+func (p *Producer[Request, Response]) ProduceIdempotent(ctx context.Context, key string, value Request) (*containers.Promise[Response], error) {
+	p.logger.Debug("Redis stream producing idempotent", "key", key, "value", value)
+	p.startIterativeChecks()
+	stream := p.streamFor(ctx)
+	idempotencyKey := idempotencyKeyFor(stream, key)
+	for {
+		existing, err := p.client.Get(ctx, idempotencyKey).Result()
+		if err == nil {
+			promise, err := p.idempotentPromiseFor(ctx, idempotencyKey, promiseKey{stream: stream, id: existing})
+			if promise != nil || err != nil {
+				return promise, err
+			}
+			// The request of the key resolved already, nothing would resolve a promise for it
+			if err := p.releaseIdempotencyKey(ctx, idempotencyKey, existing); err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("reading idempotency key: %w", err)
+		}
+		produced, promise, err := p.produce(ctx, value, PriorityNormal)
+		if err != nil {
+			return nil, err
+		}
+		acquired, err := p.client.SetNX(ctx, idempotencyKey, produced.id, p.config().ResponseEntryTimeout).Result()
+		if err != nil {
+			// The request is produced anyway, so only idempotency of later retries is lost
+			p.logger.Warn("error setting idempotency key", "key", idempotencyKey, "msgId", produced.id, "err", err)
+			return promise, nil
+		}
+		if acquired {
+			p.holdIdempotencyKey(produced, idempotencyKey)
+			return promise, nil
+		}
+		// A concurrent request with the same key was produced first, drop ours in favor of it
+		shard := p.shardFor(produced)
+		shard.lock.Lock()
+		p.stopTracking(shard, produced, PromiseCanceled)
+		p.unlockAndObserve(shard)
+		p.removeFromRedis(ctx, produced.stream, produced.id)
+	}
+}
+
+// idempotencyRelease is an idempotency key to delete from redis, if it still
+// maps to the message id.
+type idempotencyRelease struct {
+	key   string
+	msgId string
+}
+
+// idempotentPromiseFor returns the promise for response of the message the
+// idempotency key maps to, or nil if it already resolved and the key is
+// released.
+func (p *Producer[Request, Response]) idempotentPromiseFor(ctx context.Context, idempotencyKey string, key promiseKey) (*containers.Promise[Response], error) {
+	_, shard, tracked := p.lockTracked(key)
+	if tracked != nil {
+		defer p.unlockAndObserve(shard)
+		if p.closed.Load() {
+			return nil, ErrProducerClosed
+		}
+		return tracked.promise, nil
+	}
+	released, found := p.releasedIdempotency.Load(idempotencyKey)
+	p.unlockAndObserve(shard)
+	if found && released == key.id {
+		return nil, nil
+	}
+	// Produced by another producer, or a previous run of this one
+	promise, err := p.persistedPromiseFor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// The key may have been released since it was read
+	current, err := p.client.Get(ctx, idempotencyKey).Result()
+	if (err != nil && !errors.Is(err, redis.Nil)) || current == key.id {
+		return promise, nil
+	}
+	key, shard, tracked = p.lockTracked(key)
+	if tracked != nil {
+		tracked.promise.ProduceError(ErrRequestCanceled)
+		p.stopTracking(shard, key, PromiseCanceled)
+	}
+	p.unlockAndObserve(shard)
+	if tracked == nil {
+		// Resolved meanwhile
+		return promise, nil
+	}
+	return nil, nil
+}
+
+// holdIdempotencyKey has the idempotency key released once the promise of the
+// message it maps to stops being tracked.
+func (p *Producer[Request, Response]) holdIdempotencyKey(key promiseKey, idempotencyKey string) {
+	key, shard, tracked := p.lockTracked(key)
+	if tracked != nil {
+		tracked.idempotencyKey = idempotencyKey
+	} else if !p.closed.Load() {
+		// Resolved before the key was set
+		p.releasedIdempotency.Store(idempotencyKey, key.id)
+		shard.releasedIdempotency = append(shard.releasedIdempotency, idempotencyRelease{key: idempotencyKey, msgId: key.id})
+	}
+	p.unlockAndObserve(shard)
+}
+
+// releaseIdempotencyKey deletes the idempotency key if it still maps to the
+// message id, so that a request with it is produced again.
+func (p *Producer[Request, Response]) releaseIdempotencyKey(ctx context.Context, idempotencyKey, msgId string) error {
+	err := p.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, idempotencyKey).Result()
+		if errors.Is(err, redis.Nil) || (err == nil && current != msgId) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, idempotencyKey)
+			return nil
+		})
+		return err
+	}, idempotencyKey)
+	if err != nil && !errors.Is(err, redis.TxFailedErr) {
+		// A failed transaction means the key changed, it's released either way
+		return fmt.Errorf("releasing idempotency key: %w", err)
+	}
+	return nil
+}
+
+// releaseIdempotencyKeys releases the idempotency keys of requests that
+// stopped being tracked. Like unpersistPromises, it's called once no shard
+// lock is held and isn't canceled along with the producer.
+func (p *Producer[Request, Response]) releaseIdempotencyKeys(released []idempotencyRelease) {
+	for _, r := range released {
+		if err := p.releaseIdempotencyKey(context.Background(), r.key, r.msgId); err != nil {
+			p.logger.Warn("redis producer: Error releasing idempotency key", "key", r.key, "msgId", r.msgId, "error", err)
+		}
+		p.releasedIdempotency.Delete(r.key)
+	}
+}
+
+// promiseFor returns the promise for response of an already produced message,
+// tracking a new one if this producer doesn't have it.
+func (p *Producer[Request, Response]) promiseFor(ctx context.Context, key promiseKey) (*containers.Promise[Response], error) {
+	shard := p.shardFor(key)
+	shard.lock.Lock()
+	defer p.unlockAndObserve(shard)
+	if p.closed.Load() {
+		return nil, ErrProducerClosed
+	}
+	if tracked, found := shard.promises[key]; found {
+		return tracked.promise, nil
+	}
+	return p.track(ctx, shard, key, PriorityNormal, nil), nil
+}
+
+// SetGroupPosition moves the last delivered id of the consumer group to given
+// id, consumers resume reading the stream after it. Use "$" to skip all
+// existing entries, or "0" to reprocess the stream from the start. This is an
+// incident recovery tool that makes consumers skip or repeat work, so it fails
+// with ErrGroupRepositionDisabled unless EnableGroupReposition is set.
+func (p *Producer[Request, Response]) SetGroupPosition(ctx context.Context, id string) error {
+	if !p.config().EnableGroupReposition {
+		return ErrGroupRepositionDisabled
+	}
+	p.logger.Warn("Moving consumer group position", "stream", p.stream(), "group", p.group(), "id", id)
+	if err := p.client.XGroupSetID(ctx, p.stream(), p.group(), id).Err(); err != nil {
+		if isNoGroupErr(err) {
+			return fmt.Errorf("%w: %w", ErrGroupNotFound, err)
+		}
+		return fmt.Errorf("setting group position: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// responseKeyMsgId returns the message id a key in the response key namespace
+// of the stream belongs to, covering response, chunk, receipt and cancel
+// keys. Other keys sharing the namespace, like idempotency keys, aren't
+// matched.
+func responseKeyMsgId(prefix, key string) (string, bool) {
+	rest, found := strings.CutPrefix(key, prefix)
+	if !found {
+		return "", false
+	}
+	rest = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(rest, ".received"), ".canceled"), ".heartbeat")
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	if _, err := getUintParts(rest); err != nil {
+		return "", false
+	}
+	return rest, true
+}
+
+// PruneOrphans deletes response keys of the stream, along with their chunk and
+// receipt keys, that aren't tracked by this producer and whose message is
+// neither in the PEL nor younger than the longest request timeout, so that
+// no live producer is still waiting for them. Returns the number of deleted
+// keys.
+func (p *Producer[Request, Response]) PruneOrphans(ctx context.Context) (int, error) {
+	cfg := p.config()
+	stream := p.stream()
+	keys := p.trackedKeys(func(key promiseKey) bool { return key.stream == stream })
+	tracked := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		tracked[key.id] = struct{}{}
+	}
+	oldest := allowedOldestID(p.redisNow(), cfg.maxRequestTimeout())
+	prefix := strings.TrimSuffix(resultKeyFor(stream, "*", cfg.UseHashTag), "*")
+	pending := make(map[string]bool)
+	deleted := 0
+	iter := p.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		msgId, ok := responseKeyMsgId(prefix, key)
+		if !ok {
+			continue
+		}
+		if _, found := tracked[msgId]; found || cmpMsgId(msgId, oldest) != -1 {
+			continue
+		}
+		isPending, checked := pending[msgId]
+		if !checked {
+			entries, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  p.group(),
+				Start:  msgId,
+				End:    msgId,
+				Count:  1,
+			}).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return deleted, fmt.Errorf("checking pending entry of %v: %w", msgId, err)
+			}
+			isPending = len(entries) > 0
+			pending[msgId] = isPending
+		}
+		if isPending {
+			continue
+		}
+		n, err := p.client.Del(ctx, key).Result()
+		if err != nil {
+			return deleted, fmt.Errorf("deleting orphaned key %v: %w", key, err)
+		}
+		deleted += int(n)
+	}
+	if err := iter.Err(); err != nil {
+		return deleted, fmt.Errorf("scanning response keys: %w", err)
+	}
+	responseDelCounter.Inc(int64(deleted))
+	return deleted, nil
+}
+
+func (p *Producer[Request, Response]) pruneOrphans(ctx context.Context) time.Duration {
+	deleted, err := p.PruneOrphans(ctx)
+	if err != nil {
+		p.logger.Error("Error pruning orphaned response keys", "stream", p.stream(), "deleted", deleted, "err", err)
+	} else {
+		p.logger.Debug("pruneOrphans", "deleted", deleted)
+	}
+	return p.config().PruneOrphansInterval
+}
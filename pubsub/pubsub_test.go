@@ -1,19 +1,27 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 
 	"github.com/offchainlabs/nitro/util/containers"
 	"github.com/offchainlabs/nitro/util/redisutil"
@@ -395,3 +403,4668 @@ func mergeValues(messages []map[string]string, withInvalidEntries bool) ([]strin
 	sort.Strings(ret)
 	return ret, nil
 }
+
+func TestSweepOrphanedResponses(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().ResponseEntryTimeout = time.Minute
+
+	orphanKey := ResultKeyFor(streamName, "1-0")
+	if err := redisClient.Set(ctx, orphanKey, "orphan", 0).Err(); err != nil {
+		t.Fatalf("Error setting orphan response: %v", err)
+	}
+	trackedPromiseKey := promiseKey{stream: streamName, id: "2-0"}
+	producer.shardFor(trackedPromiseKey).promises[trackedPromiseKey] = &trackedPromise[testResponse]{promise: &containers.Promise[testResponse]{}}
+	trackedKey := ResultKeyFor(streamName, "2-0")
+	if err := redisClient.Set(ctx, trackedKey, "tracked", 0).Err(); err != nil {
+		t.Fatalf("Error setting tracked response: %v", err)
+	}
+
+	producer.sweepOrphanedResponses(ctx)
+
+	if ttl, err := redisClient.TTL(ctx, orphanKey).Result(); err != nil || ttl <= 0 {
+		t.Errorf("Orphaned response key has ttl: %v, err: %v, want positive ttl", ttl, err)
+	}
+	if ttl, err := redisClient.TTL(ctx, trackedKey).Result(); err != nil || ttl != -1 {
+		t.Errorf("Tracked response key has ttl: %v, err: %v, want no expiry", ttl, err)
+	}
+}
+
+func TestPruneOrphans(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+
+	if err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, ID: "3-0", Values: map[string]any{messageKey: "pending"}}).Err(); err != nil {
+		t.Fatalf("Error adding pending message: %v", err)
+	}
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{Group: streamName, Consumer: "c", Streams: []string{streamName, ">"}, Count: 1}).Err(); err != nil {
+		t.Fatalf("Error reading pending message: %v", err)
+	}
+	trackedPromiseKey := promiseKey{stream: streamName, id: "2-0"}
+	producer.shardFor(trackedPromiseKey).promises[trackedPromiseKey] = &trackedPromise[testResponse]{promise: &containers.Promise[testResponse]{}}
+	recentId := fmt.Sprintf("%d-0", time.Now().UnixMilli())
+	orphaned := []string{
+		ResultKeyFor(streamName, "1-0"),
+		chunkKeyFor(ResultKeyFor(streamName, "1-0"), 0),
+		receiptKeyFor(ResultKeyFor(streamName, "1-0")),
+	}
+	kept := []string{
+		ResultKeyFor(streamName, "2-0"),
+		ResultKeyFor(streamName, "3-0"),
+		ResultKeyFor(streamName, recentId),
+		idempotencyKeyFor(streamName, "key"),
+	}
+	for _, key := range append(orphaned, kept...) {
+		if err := redisClient.Set(ctx, key, "value", 0).Err(); err != nil {
+			t.Fatalf("Error setting %v: %v", key, err)
+		}
+	}
+
+	deleted, err := producer.PruneOrphans(ctx)
+	if err != nil {
+		t.Fatalf("PruneOrphans() unexpected error: %v", err)
+	}
+	if deleted != len(orphaned) {
+		t.Errorf("PruneOrphans() = %d, want %d", deleted, len(orphaned))
+	}
+	for _, key := range orphaned {
+		if n, err := redisClient.Exists(ctx, key).Result(); err != nil || n != 0 {
+			t.Errorf("Orphaned key %v exists: %v, err: %v", key, n, err)
+		}
+	}
+	for _, key := range kept {
+		if n, err := redisClient.Exists(ctx, key).Result(); err != nil || n != 1 {
+			t.Errorf("Key %v exists: %v, err: %v, want kept", key, n, err)
+		}
+	}
+}
+
+func TestNewProducerRejectsPointerResponse(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	if _, err := NewProducer[testRequest, *testResponse](redisClient, "stream", producerCfg()); err == nil {
+		t.Error("NewProducer() with pointer response type succeeded, want error")
+	}
+	if _, err := NewProducer[*testRequest, testResponse](redisClient, "stream", producerCfg()); err != nil {
+		t.Errorf("NewProducer() with pointer request type unexpected error: %v", err)
+	}
+}
+
+func TestResponseTypeCheck(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	type unmarshalableResponse struct {
+		Done chan struct{}
+	}
+	if _, err := NewProducer[testRequest, unmarshalableResponse](redisClient, "stream", producerCfg(), WithResponseTypeCheck()); err == nil {
+		t.Error("NewProducer() with response type that can't round trip through JSON succeeded, want error")
+	}
+	if _, err := NewProducer[testRequest, unmarshalableResponse](redisClient, "stream", producerCfg()); err != nil {
+		t.Errorf("NewProducer() without WithResponseTypeCheck() unexpected error: %v", err)
+	}
+	if _, err := NewProducer[testRequest, testResponse](redisClient, "stream", producerCfg(), WithResponseTypeCheck()); err != nil {
+		t.Errorf("NewProducer() with valid response type unexpected error: %v", err)
+	}
+}
+
+func TestTrimStalled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	var observed []bool
+	cfg := producerCfg()
+	cfg.TrimStallThreshold = 2
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithTrimObserver(func(trimmed int64, stalled bool) {
+		observed = append(observed, stalled)
+	}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	readMessage := func() string {
+		t.Helper()
+		msgId, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: map[string]any{messageKey: "req"}}).Result()
+		if err != nil {
+			t.Fatalf("Error adding message: %v", err)
+		}
+		if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{Group: streamName, Consumer: "c", Streams: []string{streamName, ">"}, Count: 1}).Err(); err != nil {
+			t.Fatalf("Error reading message: %v", err)
+		}
+		return msgId
+	}
+
+	// The unacked message pins the PEL's lower entry
+	stuck := readMessage()
+	producer.clearMessages(ctx)
+	producer.clearMessages(ctx)
+	if !producer.TrimStalled() {
+		t.Error("TrimStalled() = false, want true")
+	}
+	readMessage()
+	if err := redisClient.XAck(ctx, streamName, streamName, stuck).Err(); err != nil {
+		t.Fatalf("Error acking message: %v", err)
+	}
+	producer.clearMessages(ctx)
+	if producer.TrimStalled() {
+		t.Error("TrimStalled() after trim freed entries = true, want false")
+	}
+	if diff := cmp.Diff([]bool{false, true, false}, observed); diff != "" {
+		t.Errorf("Observed stalled diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWaitStarted(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	select {
+	case <-producer.Started():
+		t.Fatal("Started() is closed before checking responses started")
+	default:
+	}
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := producer.WaitStarted(waitCtx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	select {
+	case <-producer.Started():
+	default:
+		t.Error("Started() isn't closed after WaitStarted returned")
+	}
+}
+
+func TestProducerWithID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	producer, err := NewProducer[testRequest, testResponse](redisClient, "stream", producerCfg(), WithID("stable-id"))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	if got := producer.Id(); got != "stable-id" {
+		t.Errorf("Producer.Id() = %q, want %q", got, "stable-id")
+	}
+	if _, err := NewProducer[testRequest, testResponse](redisClient, "stream", producerCfg(), WithID("")); err == nil {
+		t.Error("NewProducer() with empty id succeeded, want error")
+	}
+}
+
+func TestDefaultProducerID(t *testing.T) {
+	t.Parallel()
+	id := defaultProducerID()
+	if wantPid := fmt.Sprintf("-%d-", os.Getpid()); !strings.Contains(id, wantPid) {
+		t.Errorf("defaultProducerID() = %q, want it to contain pid %q", id, wantPid)
+	}
+	if id == defaultProducerID() {
+		t.Errorf("defaultProducerID() returned %q twice, want unique ids", id)
+	}
+}
+
+func TestProduceMaxPayloadBytes(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().MaxPayloadBytes = 64
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "small"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	_, err := producer.Produce(ctx, testRequest{Request: strings.Repeat("x", 100)})
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("Produce() error = %v, want %v", err, ErrPayloadTooLarge)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("Stream has %d entries, err: %v, want 1", n, err)
+	}
+}
+
+func TestProduceRateLimit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.MaxProducePerSecond = 10
+	cfg.ProduceBurst = 2
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	for i := 0; i < cfg.ProduceBurst; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: "burst"}); err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+	}
+	// The burst is used up, the next request is allowed in 100ms only
+	shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancel()
+	if _, err := producer.Produce(shortCtx, testRequest{Request: "throttled"}); err == nil {
+		t.Fatal("Produce() with a deadline before the rate limit allows it succeeded, want error")
+	}
+	start := time.Now()
+	if _, err := producer.Produce(ctx, testRequest{Request: "waited"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Produce() past the burst returned after %v, want it to wait for the rate limit", elapsed)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 3 {
+		t.Errorf("Stream has %d entries, err: %v, want 3", n, err)
+	}
+}
+
+func TestProduceNoWait(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	msgId, err := producer.ProduceNoWait(ctx, testRequest{Request: "notification"})
+	if err != nil {
+		t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer tracks %d promises, want 0", cnt)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil {
+		t.Fatalf("Consume() unexpected error: %v", err)
+	}
+	if msg == nil || msg.ID != msgId || !msg.NoResponse {
+		t.Fatalf("Consume() = %+v, want message %v with NoResponse set", msg, msgId)
+	}
+	if err := consumer.Complete(ctx, msg.ID); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Stream has %d entries, err: %v, want 0", n, err)
+	}
+	producer.StopAndWait()
+	if _, err := producer.ProduceNoWait(ctx, testRequest{Request: "closed"}); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("ProduceNoWait() after StopAndWait() error = %v, want %v", err, ErrProducerClosed)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Stream has %d entries after producing to a closed producer, err: %v, want 0", n, err)
+	}
+}
+
+func TestCreateGroup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	existing, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: map[string]any{"k": "v"}}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	cfg := producerCfg()
+	cfg.CreateGroup = true
+	cfg.CreateGroupStartID = "0"
+	for i := 0; i < 2; i++ {
+		// Creating another producer leaves the existing group as is
+		if _, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg); err != nil {
+			t.Fatalf("Error creating new producer: %v", err)
+		}
+	}
+	groups, err := redisClient.XInfoGroups(ctx, streamName).Result()
+	if err != nil {
+		t.Fatalf("XInfoGroups() unexpected error: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Name != streamName || groups[0].Lag != 1 {
+		t.Errorf("XInfoGroups() = %+v, want group %v with entry %v undelivered", groups, streamName, existing)
+	}
+}
+
+func TestRecreateGroup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	roundTrip := func(req string) {
+		t.Helper()
+		promise, err := producer.Produce(ctx, testRequest{Request: req})
+		if err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		msg.Ack()
+		if res, err := promise.Await(ctx); err != nil || res.Response != req {
+			t.Fatalf("Await() = %v, err: %v, want %q", res, err, req)
+		}
+	}
+
+	roundTrip("before")
+	if err := redisClient.XGroupDestroy(ctx, streamName, streamName).Err(); err != nil {
+		t.Fatalf("XGroupDestroy() unexpected error: %v", err)
+	}
+	producer.clearMessages(ctx)
+	exists, err := groupExists(ctx, redisClient, streamName, streamName)
+	if err != nil || !exists {
+		t.Fatalf("groupExists() after the group was destroyed = %v, err: %v, want it recreated", exists, err)
+	}
+	roundTrip("after")
+}
+
+func TestProduceRequireExistingGroup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	cfg := producerCfg()
+	cfg.RequireExistingGroup = true
+	streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("Produce() error = %v, want %v", err, ErrGroupNotFound)
+	}
+	if err := CreateStream(ctx, streamName, redisClient); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+}
+
+func TestProduceInto(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	var zero containers.Promise[testResponse]
+	if err := producer.ProduceInto(ctx, testRequest{Request: "req"}, &zero); err == nil {
+		t.Error("ProduceInto() with zero value promise succeeded, want error")
+	}
+	promise := containers.NewPromise[testResponse](nil)
+	if err := producer.ProduceInto(ctx, testRequest{Request: "req"}, &promise); err != nil {
+		t.Fatalf("ProduceInto() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	res, err := promise.Await(ctx)
+	if err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+	if err := producer.ProduceInto(ctx, testRequest{Request: "req"}, &promise); err == nil {
+		t.Error("ProduceInto() with produced promise succeeded, want error")
+	}
+}
+
+func TestProduceWithExplicitID(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	id := fmt.Sprintf("%d-5", time.Now().UnixMilli())
+	promise, err := producer.ProduceWithExplicitID(ctx, id, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceWithExplicitID() unexpected error: %v", err)
+	}
+	if _, err := producer.ProduceWithExplicitID(ctx, id, testRequest{Request: "req"}); !errors.Is(err, ErrDuplicateRequest) {
+		t.Errorf("ProduceWithExplicitID() of outstanding id error = %v, want %v", err, ErrDuplicateRequest)
+	}
+	if _, err := producer.ProduceWithExplicitID(ctx, "1-1", testRequest{Request: "req"}); !errors.Is(err, ErrIDNotMonotonic) {
+		t.Errorf("ProduceWithExplicitID() of smaller id error = %v, want %v", err, ErrIDNotMonotonic)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if msg.ID != id {
+		t.Errorf("Consumed message id = %v, want %v", msg.ID, id)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+
+	if _, err := producer.ProduceWithExplicitID(ctx, "invalid", testRequest{Request: "req"}); err == nil {
+		t.Error("ProduceWithExplicitID() of invalid id succeeded, want error")
+	}
+}
+
+func TestProduceWithDeadline(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	stale, err := producer.ProduceWithDeadline(ctx, testRequest{Request: "stale"}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("ProduceWithDeadline() unexpected error: %v", err)
+	}
+	fresh, err := producer.ProduceWithDeadline(ctx, testRequest{Request: "fresh"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("ProduceWithDeadline() unexpected error: %v", err)
+	}
+	if msg, err := consumer.Consume(ctx); err != nil || msg != nil {
+		t.Fatalf("Consume() of request past its deadline = %v, err: %v, want it skipped", msg, err)
+	}
+	if _, err := stale.Await(ctx); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Await() of request past its deadline error = %v, want %v", err, ErrDeadlineExceeded)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil || msg.Value.Request != "fresh" {
+		t.Fatalf("Consume() = %v, err: %v, want fresh request", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := fresh.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+}
+
+func TestCancelWhere(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promises, err := produceMessages(ctx, wantMessages(4, ""), producer, false)
+	if err != nil {
+		t.Fatalf("Error producing messages: %v", err)
+	}
+	msgs, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(msgs) != 4 {
+		t.Fatalf("XRange() = %d messages, err: %v, want 4", len(msgs), err)
+	}
+	keep := msgs[0].ID
+	if got := producer.CancelWhere(ctx, func(msgId string) bool { return msgId != keep }); got != 3 {
+		t.Errorf("CancelWhere() = %d, want 3", got)
+	}
+	for i, promise := range promises[1:] {
+		if _, err := promise.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+			t.Errorf("Promise %d error = %v, want %v", i+1, err, ErrRequestCanceled)
+		}
+	}
+	if cnt := producer.promisesLen(); cnt != 1 {
+		t.Errorf("Producer tracks %d promises, want 1", cnt)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("Stream has %d entries, err: %v, want 1", n, err)
+	}
+}
+
+func TestProduceCancelable(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	canceled, cancelRequest, err := producer.ProduceCancelable(ctx, testRequest{Request: "canceled"})
+	if err != nil {
+		t.Fatalf("ProduceCancelable() unexpected error: %v", err)
+	}
+	cancelRequest()
+	cancelRequest()
+	if _, err := canceled.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Await() error = %v, want %v", err, ErrRequestCanceled)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Stream has %d entries, err: %v, want 0", n, err)
+	}
+
+	resolved, cancelResolved, err := producer.ProduceCancelable(ctx, testRequest{Request: "resolved"})
+	if err != nil {
+		t.Fatalf("ProduceCancelable() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := resolved.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+	cancelResolved()
+	if res, err := resolved.Current(); err != nil || res.Response != "resp" {
+		t.Errorf("Current() after cancel = %v, err: %v, want %q", res, err, "resp")
+	}
+}
+
+func TestCancelSignalsConsumer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().CancelKeyTimeout = TestProducerConfig.CancelKeyTimeout
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.cfg.CancelPollInterval = TestConsumerConfig.CancelPollInterval
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	defer msg.Ack()
+	processCtx, done := consumer.WithCancellation(ctx, msg.ID)
+	defer done()
+	if canceled, err := consumer.Canceled(ctx, msg.ID); err != nil || canceled {
+		t.Errorf("Canceled() = %v, err: %v, want false", canceled, err)
+	}
+
+	if !producer.Cancel(ctx, msg.ID) {
+		t.Errorf("Cancel() = false, want true")
+	}
+	if producer.Cancel(ctx, msg.ID) {
+		t.Errorf("Cancel() of canceled request = true, want false")
+	}
+	if _, err := promise.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Promise error = %v, want %v", err, ErrRequestCanceled)
+	}
+	select {
+	case <-processCtx.Done():
+		if cause := context.Cause(processCtx); !errors.Is(cause, ErrRequestCanceled) {
+			t.Errorf("Processing context cause = %v, want %v", cause, ErrRequestCanceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Processing context wasn't canceled")
+	}
+}
+
+func TestAckResolved(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().AckResolved = true
+	// XACK is a round trip that must not hold up produces waiting for a shard lock
+	var ackedUnderLock atomic.Bool
+	redisClient.AddHook(commandHook{onCommand: func(name string) {
+		if name != "xack" {
+			return
+		}
+		for _, shard := range producer.shards {
+			if !shard.lock.TryLock() {
+				ackedUnderLock.Store(true)
+				continue
+			}
+			shard.lock.Unlock()
+		}
+	}})
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	// Write the response without acking, as if the consumer's ack failed
+	if err := redisClient.Set(ctx, ResultKeyFor(streamName, msg.ID), `{"Response":"resp"}`, time.Minute).Err(); err != nil {
+		t.Fatalf("Error setting response: %v", err)
+	}
+	if _, err := promise.Await(ctx); err != nil {
+		t.Fatalf("Await() unexpected error: %v", err)
+	}
+	// Messages are acked at the end of the cycle, after promises are resolved
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+		if err != nil {
+			t.Fatalf("XPending() unexpected error: %v", err)
+		}
+		if pending.Count == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Stream has %d pending messages, want 0", pending.Count)
+		}
+	}
+	if ackedUnderLock.Load() {
+		t.Error("Resolved messages were acked while holding a shard lock")
+	}
+}
+
+// commandHook calls onCommand with the name of every command the client
+// processes outside of pipelines.
+type commandHook struct {
+	onCommand func(name string)
+}
+
+func (h commandHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h commandHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.onCommand(cmd.Name())
+		return next(ctx, cmd)
+	}
+}
+
+func (h commandHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// failingHook fails the non-pipelined commands it returns an error for,
+// without sending them to redis.
+type failingHook struct {
+	fail func(name string) error
+}
+
+func (h failingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h failingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.fail(cmd.Name()); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h failingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisErrorBackoff(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.MaxConsecutiveRedisErrors = 2
+	cfg.RedisErrorBackoff = 7 * time.Second
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	var broken atomic.Bool
+	var reads atomic.Int32
+	redisClient.AddHook(failingHook{fail: func(name string) error {
+		if name != "get" {
+			return nil
+		}
+		reads.Add(1)
+		if broken.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}})
+	// Tracked without producing, so that no check cycle runs in the background
+	now := time.Now().UnixMilli()
+	for i := 0; i < 4; i++ {
+		key := promiseKey{stream: streamName, id: fmt.Sprintf("%d-%d", now, i)}
+		shard := producer.shardFor(key)
+		shard.lock.Lock()
+		producer.track(ctx, shard, key, PriorityNormal, nil)
+		producer.unlockAndObserve(shard)
+	}
+
+	broken.Store(true)
+	if interval := producer.checkResponses(ctx); interval != cfg.RedisErrorBackoff {
+		t.Errorf("checkResponses() with redis failing = %v, want backoff %v", interval, cfg.RedisErrorBackoff)
+	}
+	if got := reads.Load(); got != int32(cfg.MaxConsecutiveRedisErrors) {
+		t.Errorf("checkResponses() with redis failing read %d responses, want it to abort after %d", got, cfg.MaxConsecutiveRedisErrors)
+	}
+	broken.Store(false)
+	reads.Store(0)
+	if interval := producer.checkResponses(ctx); interval == cfg.RedisErrorBackoff {
+		t.Errorf("checkResponses() with redis recovered = %v, want no backoff", interval)
+	}
+	if got := reads.Load(); got != 4 {
+		t.Errorf("checkResponses() with redis recovered read %d responses, want 4", got)
+	}
+	if cnt := producer.promisesLen(); cnt != 4 {
+		t.Errorf("Producer tracks %d promises, want 4", cnt)
+	}
+}
+
+func TestOutstandingAgeWarning(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().OutstandingAgeWarning = 50 * time.Millisecond
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	ids := producer.OutstandingIDs()
+	if len(ids) != 1 {
+		t.Fatalf("OutstandingIDs() = %v, want one id", ids)
+	}
+	key := promiseKey{stream: streamName, id: ids[0]}
+	warned := func() (bool, bool) {
+		shard := producer.shardFor(key)
+		shard.lock.RLock()
+		defer shard.lock.RUnlock()
+		tracked, found := shard.promises[key]
+		return found && tracked.ageWarned, found
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		isWarned, found := warned()
+		if !found {
+			t.Fatal("Request stopped being tracked, want it outstanding")
+		}
+		if isWarned {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("Request wasn't reported as outstanding for long")
+		}
+	}
+	if promise.Ready() {
+		t.Error("Promise is ready, want it outstanding after the warning")
+	}
+}
+
+func TestUnmarshalRetries(t *testing.T) {
+	t.Parallel()
+	for _, useGetDel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("useGetDel=%v", useGetDel), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+			producer.config().UseGetDel = useGetDel
+			producer.config().UnmarshalRetries = 1000
+			producer.config().ResponseEntryTimeout = time.Minute
+			producer.Start(ctx)
+			defer producer.StopAndWait()
+
+			promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+			if err != nil {
+				t.Fatalf("Error producing message: %v", err)
+			}
+			ids := producer.OutstandingIDs()
+			if len(ids) != 1 {
+				t.Fatalf("OutstandingIDs() = %v, want one id", ids)
+			}
+			key := promiseKey{stream: streamName, id: ids[0]}
+			resultKey := ResultKeyFor(streamName, key.id)
+			if err := redisClient.Set(ctx, resultKey, `{"Response":1}`, time.Minute).Err(); err != nil {
+				t.Fatalf("Error setting response: %v", err)
+			}
+			failures := func() int {
+				shard := producer.shardFor(key)
+				shard.lock.RLock()
+				defer shard.lock.RUnlock()
+				if tracked, found := shard.promises[key]; found {
+					return tracked.unmarshalFailures
+				}
+				return -1
+			}
+			for start := time.Now(); failures() < 2; time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Response failed to unmarshal %d times, want retries", failures())
+				}
+			}
+			if promise.Ready() {
+				t.Fatal("Promise is ready, want it retried")
+			}
+			// A response in the expected format resolves the promise
+			if err := redisClient.Set(ctx, resultKey, `{"Response":"resp"}`, time.Minute).Err(); err != nil {
+				t.Fatalf("Error setting response: %v", err)
+			}
+			res, err := promise.Await(ctx)
+			if err != nil || res.Response != "resp" {
+				t.Errorf("Await() = %v, err: %v, want resp", res, err)
+			}
+		})
+	}
+}
+
+func TestResponseHMAC(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name        string
+		consumerKey string
+		chunked     bool
+		wantErr     error
+	}{
+		{name: "signed", consumerKey: "secret"},
+		{name: "signed chunked", consumerKey: "secret", chunked: true},
+		{name: "wrong key", consumerKey: "other", wantErr: ErrResponseUnverified},
+		{name: "unsigned", consumerKey: "", wantErr: ErrResponseUnverified},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, _, producer, consumers := newProducerConsumers(ctx, t)
+			producer.config().ResponseHMACKey = "secret"
+			producer.Start(ctx)
+			defer producer.StopAndWait()
+			consumer := consumers[0]
+			consumer.cfg = &ConsumerConfig{
+				ResponseEntryTimeout: TestConsumerConfig.ResponseEntryTimeout,
+				IdletimeToAutoclaim:  TestConsumerConfig.IdletimeToAutoclaim,
+				ResponseHMACKey:      tc.consumerKey,
+			}
+			consumer.Start(ctx)
+			defer consumer.StopAndWait()
+
+			promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+			if err != nil {
+				t.Fatalf("Error producing message: %v", err)
+			}
+			msg, err := consumer.Consume(ctx)
+			if err != nil || msg == nil {
+				t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+			}
+			msg.Ack()
+			if tc.chunked {
+				err = consumer.SetChunkedResult(ctx, msg.ID, testResponse{Response: "resp"}, 4)
+			} else {
+				err = consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"})
+			}
+			if err != nil {
+				t.Fatalf("Error setting result: %v", err)
+			}
+			res, err := promise.Await(ctx)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Await() error = %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || res.Response != "resp" {
+				t.Errorf("Await() = %v, err: %v, want resp", res, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	key1 := "k1:" + strings.Repeat("01", 32)
+	key2 := "k2:" + strings.Repeat("02", 32)
+	ciphers, err := newCipherSet([]string{key1, key2})
+	if err != nil {
+		t.Fatalf("newCipherSet() unexpected error: %v", err)
+	}
+	producer.ciphers = ciphers
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	// The consumer encrypts with the rotated key, which the producer still accepts
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, &ConsumerConfig{
+		ResponseEntryTimeout: TestConsumerConfig.ResponseEntryTimeout,
+		IdletimeToAutoclaim:  TestConsumerConfig.IdletimeToAutoclaim,
+		EncryptionKeys:       []string{key2, key1},
+	})
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumers[0] = consumer
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "sensitive"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	entries, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("XRange() = %v, err: %v, want one entry", entries, err)
+	}
+	if payload := fmt.Sprint(entries[0].Values[messageKey]); strings.Contains(payload, "sensitive") || !strings.HasPrefix(payload, encryptionMarkerPrefix+"k1:") {
+		t.Errorf("Stream entry payload = %q, want it encrypted with k1", payload)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if msg.Value.Request != "sensitive" {
+		t.Errorf("Consumed request = %v, want sensitive", msg.Value.Request)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+
+	if _, err := newCipherSet([]string{"k1:zz"}); err == nil {
+		t.Error("newCipherSet() with invalid key succeeded, want error")
+	}
+}
+
+func TestCompressionMinBytes(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().CompressionMinBytes = 100
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, &ConsumerConfig{
+		ResponseEntryTimeout: TestConsumerConfig.ResponseEntryTimeout,
+		IdletimeToAutoclaim:  TestConsumerConfig.IdletimeToAutoclaim,
+		CompressionMinBytes:  100,
+	})
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumers[0] = consumer
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	small := "small"
+	large := strings.Repeat("large", 100)
+	var promises []*containers.Promise[testResponse]
+	for _, req := range []string{small, large} {
+		promise, err := producer.Produce(ctx, testRequest{Request: req})
+		if err != nil {
+			t.Fatalf("Error producing message: %v", err)
+		}
+		promises = append(promises, promise)
+	}
+	entries, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("XRange() = %v, err: %v, want two entries", entries, err)
+	}
+	if payload := fmt.Sprint(entries[0].Values[messageKey]); strings.HasPrefix(payload, compressionMarkerPrefix) {
+		t.Errorf("Small stream entry payload = %q, want it uncompressed", payload)
+	}
+	if payload := fmt.Sprint(entries[1].Values[messageKey]); !strings.HasPrefix(payload, compressionMarkerPrefix) || len(payload) >= len(large) {
+		t.Errorf("Large stream entry payload is %d bytes, want it compressed", len(payload))
+	}
+	for i, want := range []string{small, large} {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if msg.Value.Request != want {
+			t.Errorf("Consumed request %d = %v, want %v", i, msg.Value.Request, want)
+		}
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	for i, want := range []string{small, large} {
+		if res, err := promises[i].Await(ctx); err != nil || res.Response != want {
+			t.Errorf("Await() %d = %v, err: %v, want %v", i, res, err, want)
+		}
+	}
+}
+
+func TestHighWaterObserver(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().HighWaterMark = 3
+	producer.config().LowWaterMark = 2
+	producer.config().CheckResultInterval = time.Hour
+	var lock sync.Mutex
+	var events []string
+	producer.highWaterObserver = HighWaterObserver{
+		OnHighWater: func(length int64) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, fmt.Sprintf("high:%d", length))
+		},
+		OnRecovered: func(length int64) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, fmt.Sprintf("recovered:%d", length))
+		},
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	checkEvents := func(want ...string) {
+		t.Helper()
+		if err := producer.Flush(ctx); err != nil {
+			t.Fatalf("Flush() unexpected error: %v", err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if !slices.Equal(events, want) {
+			t.Errorf("High-water events = %v, want %v", events, want)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Error producing message: %v", err)
+		}
+	}
+	checkEvents("high:4")
+	// Still above the low-water mark, so the stream hasn't recovered
+	entries, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("XRange() = %v, err: %v, want four entries", entries, err)
+	}
+	if err := redisClient.XDel(ctx, streamName, entries[0].ID, entries[1].ID).Err(); err != nil {
+		t.Fatalf("XDel() unexpected error: %v", err)
+	}
+	checkEvents("high:4")
+	if !producer.AboveHighWater() {
+		t.Error("AboveHighWater() = false, want true")
+	}
+	if err := redisClient.XDel(ctx, streamName, entries[2].ID).Err(); err != nil {
+		t.Fatalf("XDel() unexpected error: %v", err)
+	}
+	checkEvents("high:4", "recovered:1")
+	if producer.AboveHighWater() {
+		t.Error("AboveHighWater() = true, want false")
+	}
+}
+
+func TestProduceWithQoS(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	classes := []QoSClass{QoSLatencySensitive, QoSBatch, QoSDefault}
+	for _, qos := range classes {
+		if _, err := producer.ProduceWithQoS(ctx, testRequest{Request: qos.String()}, qos); err != nil {
+			t.Fatalf("ProduceWithQoS() unexpected error: %v", err)
+		}
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "plain"}); err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	for _, want := range append(classes, QoSDefault) {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if msg.QoS != want {
+			t.Errorf("Message %v QoS = %v, want %v", msg.Value.Request, msg.QoS, want)
+		}
+	}
+}
+
+func TestProduceFromChannel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().ChannelMaxOutstanding = 2
+	producer.config().CheckResultInterval = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	requests := make(chan testRequest, 4)
+	for i := 0; i < 4; i++ {
+		requests <- testRequest{Request: fmt.Sprint(i)}
+	}
+	close(requests)
+	results, err := producer.ProduceFromChannel(ctx, requests)
+	if err != nil {
+		t.Fatalf("ProduceFromChannel() unexpected error: %v", err)
+	}
+	var promises []*containers.Promise[testResponse]
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.Err != nil || res.Index != i {
+			t.Fatalf("ProduceFromChannel() result = %+v, want request %d produced", res, i)
+		}
+		promises = append(promises, res.Promise)
+	}
+	// Backpressure keeps the remaining requests in the channel
+	time.Sleep(50 * time.Millisecond)
+	if length, err := redisClient.XLen(ctx, streamName).Result(); err != nil || length != 2 {
+		t.Errorf("XLen() = %v, err: %v, want 2 while at max outstanding", length, err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	if res, err := promises[0].Await(ctx); err != nil || res.Response != "0" {
+		t.Errorf("Await() = %v, err: %v, want 0", res, err)
+	}
+	if res := <-results; res.Err != nil || res.Index != 2 {
+		t.Fatalf("ProduceFromChannel() result = %+v, want request 2 produced once one resolved", res)
+	}
+	select {
+	case res := <-results:
+		t.Fatalf("ProduceFromChannel() result = %+v, want none while at max outstanding", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Canceling ctx closes the results, even while waiting for requests
+	cancelCtx, cancelProduce := context.WithCancel(ctx)
+	more := make(chan testRequest)
+	results, err = producer.ProduceFromChannel(cancelCtx, more)
+	if err != nil {
+		t.Fatalf("ProduceFromChannel() unexpected error: %v", err)
+	}
+	cancelProduce()
+	if _, ok := <-results; ok {
+		t.Error("ProduceFromChannel() results not closed after ctx is done")
+	}
+}
+
+func TestProduceFromChannelStop(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	results, err := producer.ProduceFromChannel(ctx, make(chan testRequest))
+	if err != nil {
+		t.Fatalf("ProduceFromChannel() unexpected error: %v", err)
+	}
+	// Stopping the producer closes the results, even while waiting for requests
+	producer.StopAndWait()
+	if _, ok := <-results; ok {
+		t.Error("ProduceFromChannel() results not closed after the producer stopped")
+	}
+}
+
+// fakeProducer is a RequestProducer that responds with the request itself.
+type fakeProducer struct {
+	started  bool
+	produced []testRequest
+}
+
+func (f *fakeProducer) Start(context.Context) { f.started = true }
+
+func (f *fakeProducer) StopAndWait() { f.started = false }
+
+func (f *fakeProducer) Produce(ctx context.Context, value testRequest) (*containers.Promise[testResponse], error) {
+	if !f.started {
+		return nil, ErrProducerClosed
+	}
+	f.produced = append(f.produced, value)
+	promise := containers.NewPromise[testResponse](nil)
+	promise.Produce(testResponse{Response: value.Request})
+	return &promise, nil
+}
+
+func (f *fakeProducer) ProduceAndWait(ctx context.Context, value testRequest) (testResponse, error) {
+	promise, err := f.Produce(ctx, value)
+	if err != nil {
+		return testResponse{}, err
+	}
+	return promise.Await(ctx)
+}
+
+func TestRequestProducerFake(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	fake := &fakeProducer{}
+	// Code depending on the interface runs against the fake without redis
+	run := func(producer RequestProducer[testRequest, testResponse]) (string, error) {
+		producer.Start(ctx)
+		defer producer.StopAndWait()
+		res, err := producer.ProduceAndWait(ctx, testRequest{Request: "req"})
+		return res.Response, err
+	}
+	if res, err := run(fake); err != nil || res != "req" {
+		t.Errorf("run() = %q, err: %v, want req", res, err)
+	}
+	if len(fake.produced) != 1 || fake.produced[0].Request != "req" {
+		t.Errorf("Fake produced %v, want the request", fake.produced)
+	}
+	if _, err := fake.Produce(ctx, testRequest{}); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("Produce() after StopAndWait() error = %v, want %v", err, ErrProducerClosed)
+	}
+}
+
+func TestProduceC(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	results, err := producer.ProduceC(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceC() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res := <-results; res.Err != nil || res.Response.Response != "resp" {
+		t.Errorf("ProduceC() result = %+v, want resp", res)
+	}
+	if _, ok := <-results; ok {
+		t.Error("ProduceC() channel not closed after delivering the result")
+	}
+
+	cancelCtx, cancelProduce := context.WithCancel(ctx)
+	results, err = producer.ProduceC(cancelCtx, testRequest{Request: "canceled"})
+	if err != nil {
+		t.Fatalf("ProduceC() unexpected error: %v", err)
+	}
+	cancelProduce()
+	if res := <-results; !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("ProduceC() result error = %v, want %v", res.Err, context.Canceled)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "before"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	producer.Pause()
+	if !producer.Paused() {
+		t.Error("Paused() = false after Pause(), want true")
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "paused"}); !errors.Is(err, ErrProducerPaused) {
+		t.Errorf("Produce() error = %v, want %v", err, ErrProducerPaused)
+	}
+	if _, err := producer.ProduceNoWait(ctx, testRequest{Request: "paused"}); !errors.Is(err, ErrProducerPaused) {
+		t.Errorf("ProduceNoWait() error = %v, want %v", err, ErrProducerPaused)
+	}
+	// Outstanding promises drain while paused
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+	producer.Resume()
+	if producer.Paused() {
+		t.Error("Paused() = true after Resume(), want false")
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "after"}); err != nil {
+		t.Errorf("Produce() after Resume() unexpected error: %v", err)
+	}
+}
+
+func TestPauseProduceNoWait(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := producer.ProduceNoWait(ctx, testRequest{Request: "notification"}); err != nil {
+					if !errors.Is(err, ErrProducerPaused) {
+						t.Errorf("ProduceNoWait() error = %v, want %v", err, ErrProducerPaused)
+					}
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	producer.Pause()
+	// No produce started before Pause adds its request after it returned
+	atPause, err := redisClient.XLen(ctx, streamName).Result()
+	if err != nil {
+		t.Fatalf("XLen() unexpected error: %v", err)
+	}
+	wg.Wait()
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != atPause {
+		t.Errorf("Stream has %d entries, err: %v, want %d as when paused", n, err, atPause)
+	}
+}
+
+func TestPersistPromises(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	newPersistingProducer := func() *Producer[testRequest, testResponse] {
+		t.Helper()
+		cfg := producerCfg()
+		cfg.PersistPromises = true
+		cfg.CheckResultInterval = time.Hour
+		cfg.RequestTimeout = 2 * time.Hour
+		producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithID("persisting"))
+		if err != nil {
+			t.Fatalf("Error creating new producer: %v", err)
+		}
+		producer.Start(ctx)
+		return producer
+	}
+	persisted := func() []string {
+		t.Helper()
+		members, err := redisClient.SMembers(ctx, persistedPromisesKeyFor("persisting")).Result()
+		if err != nil {
+			t.Fatalf("SMembers() unexpected error: %v", err)
+		}
+		return members
+	}
+	respond := func(producer *Producer[testRequest, testResponse]) string {
+		t.Helper()
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		if err := producer.Flush(ctx); err != nil {
+			t.Fatalf("Flush() unexpected error: %v", err)
+		}
+		return msg.ID
+	}
+
+	producer := newPersistingProducer()
+	for _, req := range []string{"first", "second"} {
+		if _, err := producer.Produce(ctx, testRequest{Request: req}); err != nil {
+			t.Fatalf("Error producing message: %v", err)
+		}
+	}
+	if members := persisted(); len(members) != 2 {
+		t.Fatalf("Persisted promises = %v, want two", members)
+	}
+	resolvedID := respond(producer)
+	members := persisted()
+	if len(members) != 1 || strings.HasPrefix(members[0], resolvedID) {
+		t.Fatalf("Persisted promises = %v, want the one of the outstanding request only", members)
+	}
+	// Stopping, like crashing, leaves the outstanding request persisted
+	producer.StopAndWait()
+	if after := persisted(); !slices.Equal(after, members) {
+		t.Fatalf("Persisted promises after stopping = %v, want %v", after, members)
+	}
+
+	restarted := newPersistingProducer()
+	defer restarted.StopAndWait()
+	ids := restarted.OutstandingIDs()
+	if len(ids) != 1 {
+		t.Fatalf("OutstandingIDs() after restart = %v, want the persisted request", ids)
+	}
+	subscriber := restarted.Subscribe(ids[0])
+	if subscriber == nil {
+		t.Fatalf("Subscribe(%v) = nil, want promise of the restored request", ids[0])
+	}
+	if respondedID := respond(restarted); respondedID != ids[0] {
+		t.Fatalf("Consumed message %v, want %v", respondedID, ids[0])
+	}
+	if res, err := subscriber.Await(ctx); err != nil || res.Response != "second" {
+		t.Errorf("Await() = %v, err: %v, want second", res, err)
+	}
+	if members := persisted(); len(members) != 0 {
+		t.Errorf("Persisted promises = %v, want none once all resolved", members)
+	}
+}
+
+func TestPersistPromisesOfOtherStreams(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	tenantStream := streamName + ":tenant"
+	createRedisGroup(ctx, t, tenantStream, redisClient)
+	newPersistingProducer := func() *Producer[testRequest, testResponse] {
+		t.Helper()
+		cfg := producerCfg()
+		cfg.PersistPromises = true
+		cfg.CheckResultInterval = time.Hour
+		cfg.RequestTimeout = 2 * time.Hour
+		producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithID("persisting"))
+		if err != nil {
+			t.Fatalf("Error creating new producer: %v", err)
+		}
+		producer.Start(ctx)
+		return producer
+	}
+
+	producer := newPersistingProducer()
+	if _, err := producer.Produce(WithStreamOverride(ctx, tenantStream), testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msgs, err := redisClient.XRange(ctx, tenantStream, "-", "+").Result()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("XRange() = %d messages, err: %v, want 1", len(msgs), err)
+	}
+	producer.StopAndWait()
+
+	restarted := newPersistingProducer()
+	defer restarted.StopAndWait()
+	if subscriber := restarted.Subscribe(msgs[0].ID); subscriber != nil {
+		t.Errorf("Subscribe(%v) = %v, want nil for a request of another stream", msgs[0].ID, subscriber)
+	}
+	subscriber := restarted.SubscribeStream(tenantStream, msgs[0].ID)
+	if subscriber == nil {
+		t.Fatalf("SubscribeStream(%v, %v) = nil, want promise of the restored request", tenantStream, msgs[0].ID)
+	}
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, tenantStream, consumerCfg())
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if err := restarted.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	if res, err := subscriber.Await(ctx); err != nil || res.Response != "req" {
+		t.Errorf("Await() = %v, err: %v, want req", res, err)
+	}
+}
+
+func TestPersistPromisesUntracked(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if _, err := producer.ProduceIdempotent(ctx, "key", testRequest{Request: "req"}); err != nil {
+		t.Fatalf("ProduceIdempotent() unexpected error: %v", err)
+	}
+
+	cfg := producerCfg()
+	cfg.PersistPromises = true
+	closed, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithID("closed"))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	closed.Start(ctx)
+	closed.StopAndWait()
+	if _, err := closed.ProduceIdempotent(ctx, "key", testRequest{Request: "req"}); !errors.Is(err, ErrProducerClosed) {
+		t.Fatalf("ProduceIdempotent() error = %v, want %v", err, ErrProducerClosed)
+	}
+	members, err := redisClient.SMembers(ctx, persistedPromisesKeyFor("closed")).Result()
+	if err != nil {
+		t.Fatalf("SMembers() unexpected error: %v", err)
+	}
+	if len(members) != 0 {
+		t.Errorf("Persisted promises = %v, want none for a request that isn't tracked", members)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().EnableKeyspaceNotifications = true
+	// Polling alone wouldn't resolve the promise within the test
+	producer.config().CheckResultInterval = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Error producing message: %v", err)
+	}
+	ids := producer.OutstandingIDs()
+	if len(ids) != 1 {
+		t.Fatalf("OutstandingIDs() = %v, want one id", ids)
+	}
+	resultKey := ResultKeyFor(streamName, ids[0])
+	if err := redisClient.Set(ctx, resultKey, `{"Response":"resp"}`, time.Minute).Err(); err != nil {
+		t.Fatalf("Error setting response: %v", err)
+	}
+	// The test redis doesn't emit keyspace notifications, so publish them as
+	// the server would, until the subscription is established
+	for start := time.Now(); !promise.Ready(); time.Sleep(10 * time.Millisecond) {
+		if err := redisClient.Publish(ctx, "__keyspace@0__:"+resultKey, "set").Err(); err != nil {
+			t.Fatalf("Error publishing notification: %v", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Promise wasn't resolved on keyspace notification")
+		}
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+}
+
+func TestKeyspaceNotificationsMigrate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().EnableKeyspaceNotifications = true
+	// Polling alone wouldn't resolve the promises within the test
+	producer.config().CheckResultInterval = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	newStream := streamName + ":new"
+	createRedisGroup(ctx, t, newStream, redisClient)
+
+	respond := func(stream string) {
+		t.Helper()
+		promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+		if err != nil {
+			t.Fatalf("Error producing message: %v", err)
+		}
+		ids := producer.OutstandingIDs()
+		if len(ids) != 1 {
+			t.Fatalf("OutstandingIDs() = %v, want one id", ids)
+		}
+		resultKey := ResultKeyFor(stream, ids[0])
+		if err := redisClient.Set(ctx, resultKey, `{"Response":"resp"}`, time.Minute).Err(); err != nil {
+			t.Fatalf("Error setting response: %v", err)
+		}
+		// The test redis doesn't emit keyspace notifications, so publish them
+		// as the server would, until the subscription is established
+		for start := time.Now(); !promise.Ready(); time.Sleep(10 * time.Millisecond) {
+			if err := redisClient.Publish(ctx, "__keyspace@0__:"+resultKey, "set").Err(); err != nil {
+				t.Fatalf("Error publishing notification: %v", err)
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Promise of request to %v wasn't resolved on keyspace notification", stream)
+			}
+		}
+	}
+	// Subscribed to the stream's notifications before migrating, then to the new one's
+	respond(streamName)
+	if err := producer.MigrateTo(ctx, newStream); err != nil {
+		t.Fatalf("MigrateTo() unexpected error: %v", err)
+	}
+	respond(newStream)
+}
+
+func TestChunkedResult(t *testing.T) {
+	t.Parallel()
+	for _, useGetDel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("useGetDel=%v", useGetDel), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+			producer.config().UseGetDel = useGetDel
+			producer.Start(ctx)
+			defer producer.StopAndWait()
+
+			promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+			if err != nil {
+				t.Fatalf("Produce() unexpected error: %v", err)
+			}
+			consumer := consumers[0]
+			consumer.Start(ctx)
+			defer consumer.StopAndWait()
+			msg, err := consumer.Consume(ctx)
+			if err != nil || msg == nil {
+				t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+			}
+			want := testResponse{Response: strings.Repeat("chunk", 20)}
+			if err := consumer.SetChunkedResult(ctx, msg.ID, want, 7); err != nil {
+				t.Fatalf("SetChunkedResult() unexpected error: %v", err)
+			}
+			msg.Ack()
+			got, err := promise.Await(ctx)
+			if err != nil {
+				t.Fatalf("Await() unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Unexpected diff in response (-want +got):\n%s\n", diff)
+			}
+			// Response keys are deleted in the same check cycle, while holding the promises lock
+			if cnt := producer.promisesLen(); cnt != 0 {
+				t.Errorf("Producer tracks %d promises, want 0", cnt)
+			}
+			keys, err := redisClient.Keys(ctx, ResultKeyFor(streamName, "*")).Result()
+			if err != nil || len(keys) != 0 {
+				t.Errorf("Response keys left in redis: %v, err: %v", keys, err)
+			}
+		})
+	}
+}
+
+func TestProduceStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	want := testRequest{Request: strings.Repeat("x", 3*streamChunkSize)}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Error marshaling request: %v", err)
+	}
+	if _, err := producer.ProduceStream(ctx, bytes.NewReader(data)); err != nil {
+		t.Fatalf("ProduceStream() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if diff := cmp.Diff(want, msg.Value); diff != "" {
+		t.Errorf("Unexpected diff in request (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestStopAndWaitErrorsOutstandingPromises(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	producer.StopAndWait()
+	if _, err := promise.Await(ctx); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("Await() error = %v, want %v", err, ErrProducerClosed)
+	}
+	if _, _, err := producer.produce(ctx, testRequest{Request: "req"}, PriorityNormal); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("produce() after stop error = %v, want %v", err, ErrProducerClosed)
+	}
+	// Stopping again is a no-op.
+	producer.StopAndWait()
+}
+
+func TestConsumerSetError(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if err := consumer.SetError(ctx, msg.ID, errors.New("invalid input")); err != nil {
+		t.Fatalf("SetError() unexpected error: %v", err)
+	}
+	msg.Ack()
+	_, err = promise.Await(ctx)
+	if !errors.Is(err, ErrConsumerError) || !strings.Contains(err.Error(), "invalid input") {
+		t.Errorf("Await() error = %v, want %v with consumer's message", err, ErrConsumerError)
+	}
+}
+
+func TestProduceIdempotent(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().ResponseEntryTimeout = time.Minute
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	first, err := producer.ProduceIdempotent(ctx, "key", testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceIdempotent() unexpected error: %v", err)
+	}
+	retry, err := producer.ProduceIdempotent(ctx, "key", testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceIdempotent() unexpected error: %v", err)
+	}
+	if first != retry {
+		t.Error("ProduceIdempotent() with the same key returned a different promise")
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 1 {
+		t.Errorf("Stream has %d entries, err: %v, want 1", n, err)
+	}
+}
+
+func TestProduceIdempotentResolved(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().ResponseEntryTimeout = time.Minute
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	var ids []string
+	for _, want := range []string{"first", "second"} {
+		promise, err := producer.ProduceIdempotent(ctx, "key", testRequest{Request: want})
+		if err != nil {
+			t.Fatalf("ProduceIdempotent() unexpected error: %v", err)
+		}
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		ids = append(ids, msg.ID)
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		// Reusing the key right after the first one resolved produces it again
+		awaitCtx, awaitCancel := context.WithTimeout(ctx, 5*time.Second)
+		res, err := promise.Await(awaitCtx)
+		awaitCancel()
+		if err != nil || res.Response != want {
+			t.Fatalf("Await() = %v, err: %v, want %v", res, err, want)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("Request with released key consumed as %v again, want produced again", ids[1])
+	}
+	// Released once the second one resolved too
+	for i := 0; ; i++ {
+		n, err := redisClient.Exists(ctx, idempotencyKeyFor(streamName, "key")).Result()
+		if err != nil {
+			t.Fatalf("Exists() unexpected error: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Idempotency key not released after its request resolved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetGroupPositionDisabled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	if err := producer.SetGroupPosition(ctx, "$"); !errors.Is(err, ErrGroupRepositionDisabled) {
+		t.Errorf("SetGroupPosition() error = %v, want %v", err, ErrGroupRepositionDisabled)
+	}
+}
+
+func TestStreamPatternDiscovery(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().StreamPattern = streamName + ":tenant:*"
+	tenants := []string{streamName + ":tenant:a", streamName + ":tenant:b"}
+	for _, tenant := range tenants {
+		createRedisGroup(ctx, t, tenant, redisClient)
+	}
+	// Not a stream, so it's not discovered even though it matches
+	if err := redisClient.Set(ctx, streamName+":tenant:key", "v", 0).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	tenant := tenants[0]
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: tenant, Values: map[string]any{"k": i}}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    tenant,
+		Consumer: "consumer",
+		Streams:  []string{tenant, ">"},
+		Count:    3,
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	// The last entry is still pending, so it's the one trimming stops at
+	if err := redisClient.XAck(ctx, tenant, tenant, ids[:2]...).Err(); err != nil {
+		t.Fatalf("XAck() unexpected error: %v", err)
+	}
+
+	producer.discoverStreams(ctx)
+	got := append([]string{}, producer.discoveredStreams()...)
+	sort.Strings(got)
+	if diff := cmp.Diff(tenants, got); diff != "" {
+		t.Errorf("Unexpected diff in discovered streams (-want +got):\n%s\n", diff)
+	}
+	producer.clearMessages(ctx)
+	if n, err := redisClient.XLen(ctx, tenant).Result(); err != nil || n != 1 {
+		t.Errorf("Discovered stream has %d entries after trimming, err: %v, want 1", n, err)
+	}
+}
+
+func TestProduceWithStreamOverride(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	tenantStream := streamName + ":tenant"
+	createRedisGroup(ctx, t, tenantStream, redisClient)
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, tenantStream, consumerCfg())
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(WithStreamOverride(ctx, tenantStream), testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Default stream has %d entries, err: %v, want 0", n, err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	res, err := promise.Await(ctx)
+	if err != nil {
+		t.Fatalf("Await() unexpected error: %v", err)
+	}
+	if res.Response != "req" {
+		t.Errorf("Await() = %q, want %q", res.Response, "req")
+	}
+}
+
+func TestXAddMetrics(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	tenantStream := streamName + ":tenant"
+	createRedisGroup(ctx, t, tenantStream, redisClient)
+
+	for _, stream := range []string{streamName, tenantStream} {
+		for i := 0; i < 2; i++ {
+			if _, err := producer.Produce(WithStreamOverride(ctx, stream), testRequest{Request: "req"}); err != nil {
+				t.Fatalf("Produce() unexpected error: %v", err)
+			}
+		}
+		cached, found := xaddMetricsByStream.Load(stream)
+		if !found {
+			t.Fatalf("No XADD metrics of stream %v after producing to it", stream)
+		}
+		if m := xaddMetricsFor(stream); m != cached {
+			t.Errorf("xaddMetricsFor(%v) = %p, want the cached metrics %p", stream, m, cached)
+		}
+		for _, name := range []string{xaddMetricPrefix + stream, xaddMetricPrefix + stream + "/duration", xaddMetricPrefix + stream + "/error"} {
+			if metrics.DefaultRegistry.Get(name) == nil {
+				t.Errorf("Metric %v isn't registered", name)
+			}
+		}
+	}
+}
+
+func TestProduceWithAffinity(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if _, err := producer.ProduceWithAffinity(ctx, "a", testRequest{Request: "a"}); !errors.Is(err, ErrAffinityDisabled) {
+		t.Fatalf("ProduceWithAffinity() error = %v, want %v", err, ErrAffinityDisabled)
+	}
+	partitions := 4
+	producer.config().AffinityPartitions = partitions
+	for i := 0; i < partitions; i++ {
+		createRedisGroup(ctx, t, AffinityStreamFor(streamName, i), redisClient)
+	}
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 3; i++ {
+		for _, key := range keys {
+			if _, err := producer.ProduceWithAffinity(ctx, key, testRequest{Request: key}); err != nil {
+				t.Fatalf("ProduceWithAffinity() unexpected error: %v", err)
+			}
+		}
+	}
+	// Partition each key's requests were added to
+	partitionOf := make(map[string]int)
+	total := 0
+	for i := 0; i < partitions; i++ {
+		msgs, err := redisClient.XRange(ctx, AffinityStreamFor(streamName, i), "-", "+").Result()
+		if err != nil {
+			t.Fatalf("XRange() unexpected error: %v", err)
+		}
+		for _, msg := range msgs {
+			data, err := messageData(msg.Values, payloadField(""), nil)
+			if err != nil {
+				t.Fatalf("messageData() unexpected error: %v", err)
+			}
+			var req testRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				t.Fatalf("Unmarshal() unexpected error: %v", err)
+			}
+			if partition, found := partitionOf[req.Request]; found && partition != i {
+				t.Errorf("Requests of key %q added to partitions %d and %d, want one", req.Request, partition, i)
+			}
+			partitionOf[req.Request] = i
+			total++
+		}
+	}
+	if want := 3 * len(keys); total != want {
+		t.Errorf("Partition streams have %d entries, want %d", total, want)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Default stream has %d entries, err: %v, want 0", n, err)
+	}
+}
+
+func TestAffinityOrdered(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().AffinityPartitions = 1
+	producer.config().AffinityOrdered = true
+	producer.config().AffinityOrderedMaxOutstanding = 2
+	producer.config().CheckResultInterval = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	partitionStream := AffinityStreamFor(streamName, 0)
+	createRedisGroup(ctx, t, partitionStream, redisClient)
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, partitionStream, consumerCfg())
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promises := make(map[string]*containers.Promise[testResponse])
+	for _, req := range []struct{ key, name string }{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}} {
+		promise, err := producer.ProduceWithAffinity(ctx, req.key, testRequest{Request: req.name})
+		if err != nil {
+			t.Fatalf("ProduceWithAffinity() unexpected error: %v", err)
+		}
+		promises[req.name] = promise
+	}
+	if _, err := producer.ProduceWithAffinity(ctx, "a", testRequest{Request: "a3"}); !errors.Is(err, ErrAffinityOrderFull) {
+		t.Errorf("ProduceWithAffinity() error = %v, want %v", err, ErrAffinityOrderFull)
+	}
+	msgs := make(map[string]*Message[testRequest])
+	for i := 0; i < 3; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		msgs[msg.Value.Request] = msg
+	}
+	respond := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if err := consumer.SetResult(ctx, msgs[name].ID, testResponse{Response: name}); err != nil {
+				t.Fatalf("SetResult() unexpected error: %v", err)
+			}
+		}
+		if err := producer.Flush(ctx); err != nil {
+			t.Fatalf("Flush() unexpected error: %v", err)
+		}
+	}
+	// a2 completes first but is held back by a1, b1 is independent
+	respond("a2", "b1")
+	if res, err := promises["b1"].Await(ctx); err != nil || res.Response != "b1" {
+		t.Errorf("Await() = %v, err: %v, want b1", res, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if promises["a2"].Ready() {
+		t.Error("Promise of a2 resolved before the one of a1 produced before it")
+	}
+	respond("a1")
+	for _, name := range []string{"a1", "a2"} {
+		if res, err := promises[name].Await(ctx); err != nil || res.Response != name {
+			t.Errorf("Await() = %v, err: %v, want %v", res, err, name)
+		}
+	}
+	// Resolved requests no longer count towards the bound
+	if _, err := producer.ProduceWithAffinity(ctx, "a", testRequest{Request: "a3"}); err != nil {
+		t.Errorf("ProduceWithAffinity() unexpected error: %v", err)
+	}
+}
+
+func TestProduceRaw(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.ProduceRaw(ctx, nil); err == nil {
+		t.Error("ProduceRaw() with empty bytes succeeded, want error")
+	}
+	promise, err := producer.ProduceRaw(ctx, []byte(`{"Request":"raw"}`))
+	if err != nil {
+		t.Fatalf("ProduceRaw() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if msg.Value.Request != "raw" {
+		t.Errorf("Consume() request = %q, want %q", msg.Value.Request, "raw")
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if res, err := promise.Await(ctx); err != nil || res.Response != "raw" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "raw")
+	}
+}
+
+func TestCheckResponsesInChunks(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().CheckChunkSize = 2
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	var promises []*containers.Promise[testResponse]
+	for i := 0; i < 5; i++ {
+		promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)})
+		if err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+		promises = append(promises, promise)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	for range promises {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		msg.Ack()
+	}
+	for i, promise := range promises {
+		res, err := promise.Await(ctx)
+		if err != nil {
+			t.Fatalf("Await() unexpected error: %v", err)
+		}
+		if want := msgForIndex(i); res.Response != want {
+			t.Errorf("Await() = %q, want %q", res.Response, want)
+		}
+	}
+}
+
+func TestPromiseObserver(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	var mu sync.Mutex
+	transitions := make(map[string][]PromiseTransition)
+	observed := 0
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, producerCfg(), WithPromiseObserver(func(msgId string, transition PromiseTransition, elapsed time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions[msgId] = append(transitions[msgId], transition)
+		observed++
+	}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if _, err := promise.Await(ctx); err != nil {
+		t.Fatalf("Await() unexpected error: %v", err)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "canceled"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	var canceledID string
+	producer.CancelWhere(ctx, func(msgId string) bool {
+		canceledID = msgId
+		return true
+	})
+
+	// Transitions are observed after the promises lock is released, which may
+	// be after Await returned.
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := observed == 4
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string][]PromiseTransition{
+		msg.ID:     {PromiseCreated, PromiseResolved},
+		canceledID: {PromiseCreated, PromiseCanceled},
+	}
+	if diff := cmp.Diff(want, transitions); diff != "" {
+		t.Errorf("Unexpected diff in transitions (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestOrderedResolution(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	var mu sync.Mutex
+	var resolved []string
+	cfg := producerCfg()
+	cfg.OrderedResolution = true
+	cfg.PromiseShards = 4
+	// Only flushes resolve promises after the first cycle
+	cfg.CheckResultInterval = time.Hour
+	cfg.RequestTimeout = 2 * time.Hour
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithPromiseObserver(func(msgId string, transition PromiseTransition, elapsed time.Duration) {
+		if transition == PromiseResolved {
+			mu.Lock()
+			defer mu.Unlock()
+			resolved = append(resolved, msgId)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	const count = 8
+	if _, err := produceMessages(ctx, wantMessages(count, ""), producer, false); err != nil {
+		t.Fatalf("Error producing messages: %v", err)
+	}
+	var msgs []*Message[testRequest]
+	for i := 0; i < count; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		msgs = append(msgs, msg)
+	}
+	// Responses arrive in the reverse order of producing
+	var want []string
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if err := consumer.SetResult(ctx, msgs[i].ID, testResponse{Response: msgs[i].Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		want = append([]string{msgs[i].ID}, want...)
+	}
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, resolved); diff != "" {
+		t.Errorf("Unexpected diff in resolution order (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestPriorityRequestTimeouts(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	cfg := producer.config()
+	cfg.RequestTimeout = time.Hour
+	cfg.HighPriorityRequestTimeout = time.Minute
+	cfg.LowPriorityRequestTimeout = 2 * time.Hour
+
+	// Tracked without producing, so that no check cycle runs in the background
+	past := time.Now().Add(-30 * time.Minute).UnixMilli()
+	promises := make(map[Priority]*containers.Promise[testResponse])
+	for i, priority := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		key := promiseKey{stream: streamName, id: fmt.Sprintf("%d-%d", past, i)}
+		shard := producer.shardFor(key)
+		shard.lock.Lock()
+		promises[priority] = producer.track(ctx, shard, key, priority, nil)
+		producer.unlockAndObserve(shard)
+	}
+	producer.checkResponses(ctx)
+	if _, err := promises[PriorityHigh].Current(); !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("High priority promise past its timeout error = %v, want %v", err, ErrRequestTimeout)
+	}
+	for _, priority := range []Priority{PriorityNormal, PriorityLow} {
+		if _, err := promises[priority].Current(); !errors.Is(err, containers.ErrNotReady) {
+			t.Errorf("Promise of priority %v within its timeout error = %v, want %v", priority, err, containers.ErrNotReady)
+		}
+	}
+	if cnt := producer.promisesLen(); cnt != 2 {
+		t.Errorf("Producer tracks %d promises, want 2", cnt)
+	}
+
+	// Reclaiming reads the priority of pending messages from the stream
+	for _, priority := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: map[string]any{messageKey: "{}", priorityKey: int(priority)}}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		if got, want := producer.messageRequestTimeout(ctx, streamName, id), cfg.requestTimeout(priority); got != want {
+			t.Errorf("messageRequestTimeout() of priority %v = %v, want %v", priority, got, want)
+		}
+	}
+	if got := cfg.minRequestTimeout(); got != cfg.HighPriorityRequestTimeout {
+		t.Errorf("minRequestTimeout() = %v, want %v", got, cfg.HighPriorityRequestTimeout)
+	}
+	if got := cfg.maxRequestTimeout(); got != cfg.LowPriorityRequestTimeout {
+		t.Errorf("maxRequestTimeout() = %v, want %v", got, cfg.LowPriorityRequestTimeout)
+	}
+}
+
+func TestPriorityResolution(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	var mu sync.Mutex
+	var resolved []string
+	cfg := producerCfg()
+	cfg.PriorityResolution = true
+	// Only flushes resolve promises after the first cycle
+	cfg.CheckResultInterval = time.Hour
+	cfg.RequestTimeout = 2 * time.Hour
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithPromiseObserver(func(msgId string, transition PromiseTransition, elapsed time.Duration) {
+		if transition == PromiseResolved {
+			mu.Lock()
+			defer mu.Unlock()
+			resolved = append(resolved, msgId)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	priorities := []Priority{PriorityLow, PriorityNormal, PriorityHigh}
+	for _, priority := range priorities {
+		if _, err := producer.ProduceWithPriority(ctx, testRequest{Request: fmt.Sprint(priority)}, priority); err != nil {
+			t.Fatalf("ProduceWithPriority() unexpected error: %v", err)
+		}
+	}
+	idOf := make(map[string]string)
+	for range priorities {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		idOf[msg.Value.Request] = msg.ID
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{idOf[fmt.Sprint(PriorityHigh)], idOf[fmt.Sprint(PriorityNormal)], idOf[fmt.Sprint(PriorityLow)]}
+	if diff := cmp.Diff(want, resolved); diff != "" {
+		t.Errorf("Unexpected diff in resolution order (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestMaxPromiseLifetime(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().RequestTimeout = time.Hour
+	producer.config().MaxPromiseLifetime = 50 * time.Millisecond
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if _, err := promise.Await(ctx); !errors.Is(err, ErrForceEvicted) {
+		t.Errorf("Await() error = %v, want %v", err, ErrForceEvicted)
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer tracks %d promises after eviction, want 0", cnt)
+	}
+}
+
+// pipelineCounter is a redis hook counting the pipelines sent.
+type pipelineCounter struct {
+	count *atomic.Int64
+}
+
+func (h pipelineCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h pipelineCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h pipelineCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.count.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.CoalesceWindow = 50 * time.Millisecond
+	cfg.CoalesceMaxBatch = 4
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	var pipelines atomic.Int64
+	redisClient.AddHook(pipelineCounter{count: &pipelines})
+	count := 10
+	ids := make([]string, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := producer.ProduceNoWait(ctx, testRequest{Request: msgForIndex(i)})
+			if err != nil {
+				t.Errorf("ProduceNoWait() unexpected error: %v", err)
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+	if flushed := pipelines.Load(); flushed < 3 || flushed >= int64(count) {
+		t.Errorf("Requests were added in %d batches, want between 3 and %d", flushed, count-1)
+	}
+	msgs, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil {
+		t.Fatalf("XRange() unexpected error: %v", err)
+	}
+	if len(msgs) != count {
+		t.Fatalf("Stream has %d entries, want %d", len(msgs), count)
+	}
+	for _, msg := range msgs {
+		if !slices.Contains(ids, msg.ID) {
+			t.Errorf("Stream entry %v wasn't returned to any producer", msg.ID)
+		}
+	}
+	// Entries of requests produced one after the other ascend
+	var last string
+	for i := 0; i < 3; i++ {
+		id, err := producer.ProduceNoWait(ctx, testRequest{Request: msgForIndex(i)})
+		if err != nil {
+			t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+		}
+		if last != "" && cmpMsgId(last, id) != -1 {
+			t.Errorf("Entry %v added after entry %v, want ascending ids", id, last)
+		}
+		last = id
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	// Only flushes resolve promises after the first cycle
+	producer.config().CheckResultInterval = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := producer.Flush(ctx); err != nil {
+				t.Errorf("Flush() unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if !promise.Ready() {
+		t.Fatal("Promise isn't ready after Flush returned")
+	}
+	if res, err := promise.Current(); err != nil || res.Response != "resp" {
+		t.Errorf("Current() = %v, err: %v, want %q", res, err, "resp")
+	}
+}
+
+func TestPromiseEventObserverUserData(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	var mu sync.Mutex
+	var events []PromiseEvent
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, producerCfg(), WithPromiseEventObserver(func(event PromiseEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(WithUserData(ctx, "order-42"), testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if _, err := promise.Await(ctx); err != nil {
+		t.Fatalf("Await() unexpected error: %v", err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := len(events) == 2
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("Observed %d events, want 2", len(events))
+	}
+	for i, transition := range []PromiseTransition{PromiseCreated, PromiseResolved} {
+		if e := events[i]; e.MsgID != msg.ID || e.Transition != transition || e.UserData != "order-42" {
+			t.Errorf("Event %d = %+v, want %v of %v with user data %q", i, e, transition, msg.ID, "order-42")
+		}
+	}
+}
+
+func TestUseMiddleware(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	errBad := errors.New("bad request")
+	for _, suffix := range []string{"+a", "+b"} {
+		producer.Use(func(_ context.Context, req testRequest) (testRequest, error) {
+			if req.Request == "bad" {
+				return req, errBad
+			}
+			req.Request += suffix
+			return req, nil
+		})
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "bad"}); !errors.Is(err, errBad) {
+		t.Fatalf("Produce() error = %v, want %v", err, errBad)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if _, err := producer.ProduceNoWait(ctx, testRequest{Request: "notification"}); err != nil {
+		t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+	}
+	for _, want := range []string{"req+a+b", "notification+a+b"} {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if msg.Value.Request != want {
+			t.Errorf("Consume() request = %q, want %q", msg.Value.Request, want)
+		}
+	}
+}
+
+func TestMarshalRequestDisableHTMLEscape(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	req := testRequest{Request: "https://example.com/?a=<b>&c"}
+	for _, tc := range []struct {
+		disable bool
+		want    string
+	}{
+		{disable: false, want: `{"Request":"https://example.com/?a=\u003cb\u003e\u0026c","IsInvalid":false}`},
+		{disable: true, want: `{"Request":"https://example.com/?a=<b>&c","IsInvalid":false}`},
+	} {
+		producer.config().DisableHTMLEscape = tc.disable
+		got, err := producer.marshalRequest(ctx, req)
+		if err != nil {
+			t.Fatalf("marshalRequest() unexpected error: %v", err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("marshalRequest() with DisableHTMLEscape=%v = %s, want %s", tc.disable, got, tc.want)
+		}
+	}
+}
+
+func TestOutstandingIDs(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if ids := producer.OutstandingIDs(); len(ids) != 0 {
+		t.Errorf("OutstandingIDs() = %v, want none", ids)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)}); err != nil {
+			t.Fatalf("Produce() unexpected error: %v", err)
+		}
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	var want []string
+	for i := 0; i < 3; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		want = append(want, msg.ID)
+	}
+	if diff := cmp.Diff(want, producer.OutstandingIDs()); diff != "" {
+		t.Errorf("Unexpected diff in outstanding ids (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestFailOnStreamGone(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().FailOnStreamGone = true
+	producer.config().RequestTimeout = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if err := redisClient.Del(ctx, streamName).Err(); err != nil {
+		t.Fatalf("Error deleting stream: %v", err)
+	}
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer awaitCancel()
+	if _, err := promise.Await(awaitCtx); !errors.Is(err, ErrStreamGone) {
+		t.Errorf("Await() error = %v, want %v", err, ErrStreamGone)
+	}
+}
+
+func TestBatchProduceChan(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	requests := []testRequest{{Request: msgForIndex(0)}, {Request: msgForIndex(1)}, {Request: msgForIndex(2)}}
+	results, err := producer.BatchProduceChan(ctx, requests)
+	if err != nil {
+		t.Fatalf("BatchProduceChan() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	for range requests {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		msg.Ack()
+	}
+	got := make(map[int]string)
+	for res := range results {
+		if res.Err != nil {
+			t.Errorf("Result %d unexpected error: %v", res.Index, res.Err)
+		}
+		got[res.Index] = res.Response.Response
+	}
+	want := map[int]string{0: msgForIndex(0), 1: msgForIndex(1), 2: msgForIndex(2)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected diff in results (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestProduceCanceledContext(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	canceledCtx, cancelProduce := context.WithCancel(ctx)
+	cancelProduce()
+	if _, err := producer.Produce(canceledCtx, testRequest{Request: "req"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Produce() error = %v, want %v", err, context.Canceled)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Stream has %d entries, err: %v, want 0", n, err)
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer tracks %d promises, want 0", cnt)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	encryptionKey := strings.Repeat("ab", 32)
+	producer.config().EncryptionKeys = []string{"k1:" + encryptionKey}
+	hmacKey := "hmac-secret"
+	producer.config().ResponseHMACKey = hmacKey
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	d, err := producer.Diagnostics(ctx)
+	if err != nil {
+		t.Fatalf("Diagnostics() unexpected error: %v", err)
+	}
+	if d.ProducerID != producer.Id() {
+		t.Errorf("Diagnostics() producer id = %q, want %q", d.ProducerID, producer.Id())
+	}
+	if d.Outstanding != 1 {
+		t.Errorf("Diagnostics() outstanding = %d, want 1", d.Outstanding)
+	}
+	if d.Stream.Length != 1 {
+		t.Errorf("Diagnostics() stream length = %d, want 1", d.Stream.Length)
+	}
+	if len(d.Groups) != 1 {
+		t.Errorf("Diagnostics() groups = %v, want 1 group", d.Groups)
+	}
+	out, err := json.Marshal(d)
+	if err != nil {
+		t.Errorf("Error marshaling diagnostics: %v", err)
+	}
+	if strings.Contains(string(out), encryptionKey) {
+		t.Errorf("Diagnostics JSON contains the encryption key: %s", out)
+	}
+	if strings.Contains(string(out), hmacKey) {
+		t.Errorf("Diagnostics JSON contains the response HMAC key: %s", out)
+	}
+	if want := []string{"k1:" + redactedSecret}; !slices.Equal(d.Config.EncryptionKeys, want) {
+		t.Errorf("Diagnostics() encryption keys = %v, want %v", d.Config.EncryptionKeys, want)
+	}
+	if producer.config().EncryptionKeys[0] != "k1:"+encryptionKey {
+		t.Errorf("Diagnostics() modified the encryption keys of the producer's config")
+	}
+}
+
+func TestVisitPending(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	var want []string
+	for i := 0; i < 3; i++ {
+		id, err := producer.ProduceNoWait(ctx, testRequest{Request: fmt.Sprintf("req-%d", i)})
+		if err != nil {
+			t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+		}
+		want = append(want, id)
+	}
+	for range want {
+		if msg, err := consumer.Consume(ctx); err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, %v, want message", msg, err)
+		}
+	}
+	var got []PendingEntry
+	if err := producer.VisitPending(ctx, func(e PendingEntry) bool {
+		got = append(got, e)
+		return true
+	}); err != nil {
+		t.Fatalf("VisitPending() unexpected error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("VisitPending() visited %d entries, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if e.ID != want[i] || e.Consumer != consumer.Id() || e.RetryCount < 1 {
+			t.Errorf("VisitPending() entry %d = %+v, want id %v consumer %v delivered at least once", i, e, want[i], consumer.Id())
+		}
+	}
+	visited := 0
+	if err := producer.VisitPending(ctx, func(PendingEntry) bool {
+		visited++
+		return false
+	}); err != nil {
+		t.Fatalf("VisitPending() unexpected error: %v", err)
+	}
+	if visited != 1 {
+		t.Errorf("VisitPending() visited %d entries after returning false, want 1", visited)
+	}
+}
+
+func TestProduceAt(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	if _, err := producer.ProduceAt(ctx, testRequest{Request: "req"}, time.Now()); !errors.Is(err, ErrSchedulingDisabled) {
+		t.Fatalf("ProduceAt() error = %v, want %v", err, ErrSchedulingDisabled)
+	}
+	producer.config().EnableScheduling = true
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	notBefore := time.Now().Add(300 * time.Millisecond)
+	promise, err := producer.ProduceAt(ctx, testRequest{Request: "req"}, notBefore)
+	if err != nil {
+		t.Fatalf("ProduceAt() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	var msg *Message[testRequest]
+	for msg == nil {
+		if msg, err = consumer.Consume(ctx); err != nil {
+			t.Fatalf("Consume() unexpected error: %v", err)
+		}
+		if msg == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if now := time.Now(); now.Before(notBefore.Truncate(time.Millisecond)) {
+		t.Errorf("Consumed scheduled message at %v, before %v", now, notBefore)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if res, err := promise.Await(ctx); err != nil || res.Response != "req" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "req")
+	}
+}
+
+func TestSyncRedisTime(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.redisClockOffset.Store(int64(time.Hour))
+	producer.syncRedisTime(ctx)
+	// miniredis shares the local clock
+	if offset := time.Until(producer.redisNow()); offset > time.Second || offset < -time.Second {
+		t.Errorf("Offset from redis clock = %v, want about 0", offset)
+	}
+}
+
+func TestProduceAndWaitRetryPolicy(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.RequestTimeout = 200 * time.Millisecond
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg, WithRetryPolicy(RetryPolicy{MaxAttempts: 10, Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	// Respond only once the first attempt timed out
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	defer func() {
+		stopConsuming()
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		time.Sleep(2 * cfg.RequestTimeout)
+		for consumeCtx.Err() == nil {
+			msg, err := consumer.Consume(consumeCtx)
+			if err != nil || msg == nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if err := consumer.SetResult(consumeCtx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+				log.Error("Error setting result", "error", err)
+			}
+			msg.Ack()
+		}
+	}()
+	res, err := producer.ProduceAndWait(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceAndWait() unexpected error: %v", err)
+	}
+	if res.Response != "req" {
+		t.Errorf("ProduceAndWait() = %q, want %q", res.Response, "req")
+	}
+}
+
+func TestProducerWithReadClient(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	readClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, producerCfg(), WithReadClient(readClient))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	// The response only shows up once it's replicated to the read client
+	time.Sleep(10 * TestProducerConfig.CheckResultInterval)
+	if promise.Ready() {
+		t.Fatal("Promise resolved before the response was on the read client")
+	}
+	resultKey := ResultKeyFor(streamName, msg.ID)
+	if err := readClient.Set(ctx, resultKey, `{"Response":"resp"}`, 0).Err(); err != nil {
+		t.Fatalf("Error replicating response: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+}
+
+func TestProduceWithMeta(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.ProduceWithMeta(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceWithMeta() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	wantMeta := ResponseMeta{Worker: consumer.Id(), Duration: time.Second, Version: "v1"}
+	if err := consumer.SetResultWithMeta(ctx, msg.ID, testResponse{Response: "resp"}, wantMeta); err != nil {
+		t.Fatalf("SetResultWithMeta() unexpected error: %v", err)
+	}
+	msg.Ack()
+	res, meta, err := promise.AwaitWithMeta(ctx)
+	if err != nil {
+		t.Fatalf("AwaitWithMeta() unexpected error: %v", err)
+	}
+	if res.Response != "resp" {
+		t.Errorf("AwaitWithMeta() response = %q, want %q", res.Response, "resp")
+	}
+	if diff := cmp.Diff(wantMeta, meta); diff != "" {
+		t.Errorf("Unexpected diff in metadata (-want +got):\n%s\n", diff)
+	}
+}
+
+func TestPayloadField(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().PayloadField = "payload"
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consCfg := consumerCfg()
+	consCfg.PayloadField = "payload"
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consCfg)
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	entries, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("XRange() = %v, err: %v, want 1 entry", entries, err)
+	}
+	if _, found := entries[0].Values["payload"]; !found {
+		t.Errorf("Stream entry fields = %v, want payload field", entries[0].Values)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if msg.Value.Request != "req" {
+		t.Errorf("Consume() request = %q, want %q", msg.Value.Request, "req")
+	}
+	msg.Ack()
+}
+
+func TestMigrateTo(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	newStream := streamName + ":new"
+	createRedisGroup(ctx, t, newStream, redisClient)
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "stranded"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	migrateCtx, migrateCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer migrateCancel()
+	if err := producer.MigrateTo(migrateCtx, newStream); err != nil {
+		t.Fatalf("MigrateTo() unexpected error: %v", err)
+	}
+	if n, err := redisClient.XLen(ctx, streamName).Result(); err != nil || n != 0 {
+		t.Errorf("Old stream has %d entries, err: %v, want 0", n, err)
+	}
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, newStream, consumerCfg())
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want migrated message", msg, err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if res, err := promise.Await(ctx); err != nil || res.Response != "stranded" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "stranded")
+	}
+}
+
+// xaddHook calls onXAdd with the stream of every non-pipelined XADD, before
+// it's sent.
+type xaddHook struct {
+	onXAdd func(stream string)
+}
+
+func (h xaddHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h xaddHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "xadd" {
+			if stream, ok := cmd.Args()[1].(string); ok {
+				h.onXAdd(stream)
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h xaddHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestCancelMigrated(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	newStream := streamName + ":new"
+	createRedisGroup(ctx, t, newStream, redisClient)
+
+	during, cancelDuring, err := producer.ProduceCancelable(ctx, testRequest{Request: "during"})
+	if err != nil {
+		t.Fatalf("ProduceCancelable() unexpected error: %v", err)
+	}
+	after, cancelAfter, err := producer.ProduceCancelable(ctx, testRequest{Request: "after"})
+	if err != nil {
+		t.Fatalf("ProduceCancelable() unexpected error: %v", err)
+	}
+	byID, err := producer.Produce(ctx, testRequest{Request: "by id"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msgs, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("XRange() = %d messages, err: %v, want 3", len(msgs), err)
+	}
+	// The first request is canceled while it's produced again to the new stream
+	var once sync.Once
+	redisClient.AddHook(xaddHook{onXAdd: func(stream string) {
+		if stream == newStream {
+			once.Do(cancelDuring)
+		}
+	}})
+	migrateCtx, migrateCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer migrateCancel()
+	if err := producer.MigrateTo(migrateCtx, newStream); err != nil {
+		t.Fatalf("MigrateTo() unexpected error: %v", err)
+	}
+	if _, err := during.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Await() of request canceled during migration error = %v, want %v", err, ErrRequestCanceled)
+	}
+	if cnt := producer.promisesLen(); cnt != 2 {
+		t.Errorf("Producer tracks %d promises after migration, want 2", cnt)
+	}
+
+	cancelAfter()
+	if _, err := after.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Await() of request canceled after migration error = %v, want %v", err, ErrRequestCanceled)
+	}
+	if !producer.CancelStream(ctx, streamName, msgs[2].ID) {
+		t.Errorf("CancelStream(%v, %v) = false, want the migrated request canceled", streamName, msgs[2].ID)
+	}
+	if _, err := byID.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Await() of request canceled by id after migration error = %v, want %v", err, ErrRequestCanceled)
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer tracks %d promises, want 0", cnt)
+	}
+	for _, stream := range []string{streamName, newStream} {
+		if n, err := redisClient.XLen(ctx, stream).Result(); err != nil || n != 0 {
+			t.Errorf("Stream %v has %d entries, err: %v, want 0", stream, n, err)
+		}
+	}
+	if keys := producer.migrated.Keys(); len(keys) != 0 {
+		t.Errorf("Migrated keys = %v, want none once canceled", keys)
+	}
+}
+
+// TestResolutionAge enables metrics and swaps the package-level timers, so it
+// doesn't run in parallel with the other tests.
+func TestResolutionAge(t *testing.T) {
+	metrics.Enabled = true
+	timers := []*metrics.Timer{&successAgeTimer, &unmarshalErrorAgeTimer, &timeoutAgeTimer}
+	for _, timer := range timers {
+		defer func(timer *metrics.Timer, old metrics.Timer) {
+			(*timer).Stop()
+			*timer = old
+		}(timer, *timer)
+		*timer = metrics.NewTimer()
+	}
+	metrics.Enabled = false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().RequestTimeout = time.Hour
+
+	// Tracked without producing, so that no check cycle runs in the background
+	ages := []time.Duration{10 * time.Minute, 20 * time.Minute, 2 * time.Hour}
+	var ids []string
+	for i, age := range ages {
+		key := promiseKey{stream: streamName, id: fmt.Sprintf("%d-%d", time.Now().Add(-age).UnixMilli(), i)}
+		shard := producer.shardFor(key)
+		shard.lock.Lock()
+		producer.track(ctx, shard, key, PriorityNormal, nil)
+		producer.unlockAndObserve(shard)
+		ids = append(ids, key.id)
+	}
+	if err := consumers[0].SetResult(ctx, ids[0], testResponse{Response: "ok"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	if err := redisClient.Set(ctx, ResultKeyFor(streamName, ids[1]), "not json", 0).Err(); err != nil {
+		t.Fatalf("Set() unexpected error: %v", err)
+	}
+	producer.checkResponses(ctx)
+	for i, timer := range timers {
+		snapshot := (*timer).Snapshot()
+		if snapshot.Count() != 1 {
+			t.Errorf("Resolution age timer %d count = %d, want 1", i, snapshot.Count())
+			continue
+		}
+		if age := time.Duration(snapshot.Max()); age < ages[i] || age > ages[i]+time.Minute {
+			t.Errorf("Resolution age timer %d recorded %v, want about %v", i, age, ages[i])
+		}
+	}
+}
+
+// TestPromisesGauge swaps the package-level gauge, so it doesn't run in
+// parallel with the other tests.
+func TestPromisesGauge(t *testing.T) {
+	gauge := &metrics.StandardGauge{}
+	defer func(old metrics.Gauge) { promisesGauge = old }(promisesGauge)
+	promisesGauge = gauge
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+
+	promises, err := produceMessages(ctx, wantMessages(2, ""), producer, false)
+	if err != nil {
+		t.Fatalf("Error producing messages: %v", err)
+	}
+	if got := gauge.Snapshot().Value(); got != 2 {
+		t.Errorf("Promises gauge = %d, want 2", got)
+	}
+	// Stopping to track an unknown promise leaves it alone
+	unknown := promiseKey{stream: streamName, id: "0-1"}
+	shard := producer.shardFor(unknown)
+	shard.lock.Lock()
+	producer.stopTracking(shard, unknown, PromiseCanceled)
+	producer.unlockAndObserve(shard)
+	if got := gauge.Snapshot().Value(); got != 2 {
+		t.Errorf("Promises gauge after stopping an unknown promise = %d, want 2", got)
+	}
+	// A request produced again after the producer closed stops being tracked
+	msgs, err := redisClient.XRange(ctx, streamName, "-", "+").Result()
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("XRange() = %d messages, err: %v, want 2", len(msgs), err)
+	}
+	producer.closed.Store(true)
+	if err := producer.reproduceAfter(ctx, promiseKey{stream: streamName, id: msgs[0].ID}, time.Second); err != nil {
+		t.Fatalf("reproduceAfter() unexpected error: %v", err)
+	}
+	if _, err := promises[0].Await(ctx); !errors.Is(err, ErrProducerClosed) {
+		t.Errorf("Promise error = %v, want %v", err, ErrProducerClosed)
+	}
+	if got := gauge.Snapshot().Value(); got != 1 {
+		t.Errorf("Promises gauge after closed retry = %d, want 1", got)
+	}
+	producer.StopAndWait()
+	if got := gauge.Snapshot().Value(); got != 0 {
+		t.Errorf("Promises gauge after StopAndWait() = %d, want 0", got)
+	}
+}
+
+// TestTrimmedCounter swaps the package-level counter, so it doesn't run in
+// parallel with the other tests.
+func TestTrimmedCounter(t *testing.T) {
+	counter := new(metrics.StandardCounter)
+	defer func(old metrics.Counter) { trimmedCounter = old }(trimmedCounter)
+	trimmedCounter = counter
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		msgId, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: map[string]any{messageKey: "req"}}).Result()
+		if err != nil {
+			t.Fatalf("Error adding message: %v", err)
+		}
+		ids = append(ids, msgId)
+	}
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{Group: streamName, Consumer: "c", Streams: []string{streamName, ">"}, Count: 4}).Err(); err != nil {
+		t.Fatalf("Error reading messages: %v", err)
+	}
+	// The last unacked message is the PEL's lower entry trimming stops at
+	if err := redisClient.XAck(ctx, streamName, streamName, ids[:3]...).Err(); err != nil {
+		t.Fatalf("Error acking messages: %v", err)
+	}
+	producer.clearMessages(ctx)
+	if got := counter.Snapshot().Count(); got != 3 {
+		t.Errorf("Trimmed counter = %d, want 3", got)
+	}
+	// Nothing more is trimmed while the lower entry is pending
+	producer.clearMessages(ctx)
+	if got := counter.Snapshot().Count(); got != 3 {
+		t.Errorf("Trimmed counter after trim freeing nothing = %d, want 3", got)
+	}
+}
+
+func TestProduceEnqueued(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	before := time.Now().Truncate(time.Millisecond)
+	promise, err := producer.ProduceEnqueued(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceEnqueued() unexpected error: %v", err)
+	}
+	after := time.Now()
+	if got := promise.EnqueuedAt(); got.Before(before) || got.After(after) {
+		t.Errorf("EnqueuedAt() = %v, want between %v and %v", got, before, after)
+	}
+}
+
+func TestMaxResolvePerCycle(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().MaxResolvePerCycle = 1
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	var promises []*containers.Promise[testResponse]
+	for i := 0; i < 3; i++ {
+		_, promise, err := producer.produce(ctx, testRequest{Request: msgForIndex(i)}, PriorityNormal)
+		if err != nil {
+			t.Fatalf("produce() unexpected error: %v", err)
+		}
+		promises = append(promises, promise)
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+		msg.Ack()
+	}
+	for want := 2; want >= 0; want-- {
+		producer.checkResponses(ctx)
+		if cnt := producer.promisesLen(); cnt != want {
+			t.Errorf("Producer tracks %d promises after check cycle, want %d", cnt, want)
+		}
+	}
+}
+
+func TestProduceWithReceipt(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	promise, err := producer.ProduceWithReceipt(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceWithReceipt() unexpected error: %v", err)
+	}
+	if promise.Produced().Ready() {
+		t.Fatal("Produced() is ready before a consumer received the request")
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	if _, err := promise.Produced().Await(ctx); err != nil {
+		t.Fatalf("Produced().Await() unexpected error: %v", err)
+	}
+	if promise.Ready() {
+		t.Error("Promise is ready before the consumer set the result")
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+	producer.promisesLen()
+	if keys, err := redisClient.Keys(ctx, ResultKeyFor(streamName, "*")).Result(); err != nil || len(keys) != 0 {
+		t.Errorf("Response keys left in redis: %v, err: %v", keys, err)
+	}
+}
+
+func TestShardedPromises(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.PromiseShards = 4
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	var wg sync.WaitGroup
+	promises := make([]*containers.Promise[testResponse], messagesCount)
+	for i := range promises {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			promise, err := producer.Produce(ctx, testRequest{Request: msgForIndex(i)})
+			if err != nil {
+				t.Errorf("Produce() unexpected error: %v", err)
+				return
+			}
+			promises[i] = promise
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	used := 0
+	for _, shard := range producer.shards {
+		shard.lock.RLock()
+		if len(shard.promises) > 0 {
+			used++
+		}
+		shard.lock.RUnlock()
+	}
+	if used < 2 {
+		t.Errorf("Promises tracked in %d shards, want them spread over several", used)
+	}
+	for range promises {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+			t.Fatalf("SetResult() unexpected error: %v", err)
+		}
+	}
+	for i, promise := range promises {
+		res, err := promise.Await(ctx)
+		if err != nil {
+			t.Fatalf("Await() unexpected error: %v", err)
+		}
+		if want := msgForIndex(i); res.Response != want {
+			t.Errorf("Await() = %q, want %q", res.Response, want)
+		}
+	}
+	if n := producer.promisesLen(); n != 0 {
+		t.Errorf("promisesLen() = %d, want 0", n)
+	}
+}
+
+func BenchmarkProduceConcurrent(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisServer, err := miniredis.Run()
+			if err != nil {
+				b.Fatalf("Error starting redis: %v", err)
+			}
+			defer redisServer.Close()
+			redisClient, err := redisutil.RedisClientFromURL(fmt.Sprintf("redis://%s/0", redisServer.Addr()))
+			if err != nil {
+				b.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+			}
+			streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+			if err := redisClient.XGroupCreateMkStream(ctx, streamName, streamName, "$").Err(); err != nil {
+				b.Fatalf("Error creating stream group: %v", err)
+			}
+			cfg := producerCfg()
+			cfg.RequestTimeout = time.Hour
+			cfg.PromiseShards = shards
+			producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+			if err != nil {
+				b.Fatalf("Error creating new producer: %v", err)
+			}
+			producer.Start(ctx)
+			defer producer.StopAndWait()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+						b.Errorf("Produce() unexpected error: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCheckResponses(b *testing.B) {
+	for _, checkExists := range []bool{false, true} {
+		b.Run(fmt.Sprintf("check-exists=%v", checkExists), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			redisServer, err := miniredis.Run()
+			if err != nil {
+				b.Fatalf("Error starting redis: %v", err)
+			}
+			defer redisServer.Close()
+			redisClient, err := redisutil.RedisClientFromURL(fmt.Sprintf("redis://%s/0", redisServer.Addr()))
+			if err != nil {
+				b.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+			}
+			streamName := fmt.Sprintf("stream:%s", uuid.NewString())
+			if err := redisClient.XGroupCreateMkStream(ctx, streamName, streamName, "$").Err(); err != nil {
+				b.Fatalf("Error creating stream group: %v", err)
+			}
+			cfg := producerCfg()
+			cfg.RequestTimeout = time.Hour
+			cfg.CheckResultInterval = time.Hour
+			cfg.CheckExists = checkExists
+			producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+			if err != nil {
+				b.Fatalf("Error creating new producer: %v", err)
+			}
+			producer.Start(ctx)
+			defer producer.StopAndWait()
+			// Outstanding requests none of which has a response yet
+			for i := 0; i < 1000; i++ {
+				if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+					b.Fatalf("Produce() unexpected error: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				producer.checkResponses(ctx)
+			}
+		})
+	}
+}
+
+func TestCmpMsgId(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "1-0", b: "1-0", want: 0},
+		{a: "1-0", b: "1-1", want: -1},
+		{a: "2-0", b: "1-9", want: 1},
+		{a: "10-0", b: "9-0", want: 1},
+		{a: "1", b: "1-0", want: -2},
+		{a: "1-0-0", b: "1-0", want: -2},
+		{a: "-1", b: "1-0", want: -2},
+		{a: "1-", b: "1-0", want: -2},
+		{a: "a-0", b: "1-0", want: -2},
+	} {
+		if got := cmpMsgId(tc.a, tc.b); got != tc.want {
+			t.Errorf("cmpMsgId(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkCmpMsgId(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cmpMsgId("1718000000000-12", "1718000000000-13")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	if subscriber := producer.Subscribe("1-0"); subscriber != nil {
+		t.Error("Subscribe() of request that isn't outstanding returned a promise, want nil")
+	}
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	promises := []*containers.Promise[testResponse]{promise, producer.Subscribe(msg.ID), producer.Subscribe(msg.ID)}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	for i, promise := range promises {
+		if promise == nil {
+			t.Fatalf("promises[%d] is nil, want subscriber", i)
+		}
+		if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+			t.Errorf("promises[%d].Await() = %v, err: %v, want %q", i, res, err, "resp")
+		}
+	}
+}
+
+func TestResponseStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().ResponseStream = true
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.cfg.ResponseStream = true
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	resolved, err := producer.Produce(ctx, testRequest{Request: "resolved"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	errored, err := producer.Produce(ctx, testRequest{Request: "errored"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if msg.Value.Request == "errored" {
+			err = consumer.SetError(ctx, msg.ID, errors.New("failed"))
+		} else {
+			err = consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"})
+		}
+		if err != nil {
+			t.Fatalf("Setting response unexpected error: %v", err)
+		}
+	}
+	if res, err := resolved.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+	if _, err := errored.Await(ctx); !errors.Is(err, ErrConsumerError) {
+		t.Errorf("Await() error = %v, want %v", err, ErrConsumerError)
+	}
+	if keys, err := redisClient.Keys(ctx, ResultKeyFor(streamName, "*-*")).Result(); err != nil || len(keys) != 0 {
+		t.Errorf("Response keys in redis: %v, err: %v, want none", keys, err)
+	}
+	if n, err := redisClient.XLen(ctx, ResponseStreamFor(streamName)).Result(); err != nil || n != 0 {
+		t.Errorf("XLen() of response stream = %d, err: %v, want 0", n, err)
+	}
+	if ttl, err := redisClient.TTL(ctx, ResponseStreamFor(streamName)).Result(); err != nil || ttl <= 0 {
+		t.Errorf("TTL() of response stream = %v, err: %v, want it to expire", ttl, err)
+	}
+}
+
+func TestResponseStreamReads(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, consumers := newProducerConsumers(ctx, t)
+	cfg := producerCfg()
+	cfg.ResponseStream = true
+	// Only flushes read responses after the first cycle
+	cfg.CheckResultInterval = time.Hour
+	cfg.RequestTimeout = 2 * time.Hour
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.cfg.ResponseStream = true
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	responseStream := ResponseStreamFor(streamName)
+	addResponses := func(idOf func(i int) string) {
+		t.Helper()
+		for i := 0; i < responseStreamReadCount+1; i++ {
+			if err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: responseStream, ID: idOf(i), Values: map[string]any{responseIDField: "0-1", responseValueField: "{}"}}).Err(); err != nil {
+				t.Fatalf("XAdd() unexpected error: %v", err)
+			}
+		}
+	}
+	// Responses of other producers from before the timeout, and after the request
+	stale := time.Now().Add(-3 * time.Hour).UnixMilli()
+	addResponses(func(i int) string { return fmt.Sprintf("%d-%d", stale, i) })
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	addResponses(func(int) string { return "*" })
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	var reads atomic.Int32
+	redisClient.AddHook(commandHook{onCommand: func(name string) {
+		if name == "xread" {
+			reads.Add(1)
+		}
+	}})
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want resp", res, err)
+	}
+	// The stale responses aren't read, the ones after the request take two pages
+	if got := reads.Load(); got != 2 {
+		t.Errorf("Response stream read %d times, want 2", got)
+	}
+	if n, err := redisClient.XLen(ctx, responseStream).Result(); err != nil || n != responseStreamReadCount+1 {
+		t.Errorf("XLen() of response stream = %d, err: %v, want %d with stale responses trimmed", n, err, responseStreamReadCount+1)
+	}
+}
+
+func TestBinaryPayloadRoundTrip(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	payload := make([]byte, 0, 512)
+	for i := 0; i < 512; i++ {
+		payload = append(payload, byte(i*7))
+	}
+	ciphers, err := newCipherSet([]string{"k1:" + strings.Repeat("01", 32)})
+	if err != nil {
+		t.Fatalf("newCipherSet() unexpected error: %v", err)
+	}
+	encrypted, err := ciphers.encrypt(payload)
+	if err != nil {
+		t.Fatalf("encrypt() unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		name    string
+		stored  []byte
+		ciphers *cipherSet
+	}{
+		{name: "plain", stored: payload},
+		{name: "encrypted", stored: encrypted, ciphers: ciphers},
+	} {
+		values := map[string]any{payloadField(""): tc.stored}
+		if got, err := messageData(values, "", tc.ciphers); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: messageData() of added values = %x, err: %v, want %x", tc.name, got, err, payload)
+		}
+		msgId, err := producer.addToStream(ctx, streamName, values)
+		if err != nil {
+			t.Fatalf("%s: addToStream() unexpected error: %v", tc.name, err)
+		}
+		msgs, err := redisClient.XRangeN(ctx, streamName, msgId, msgId, 1).Result()
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("%s: XRangeN() = %v, err: %v, want one entry", tc.name, msgs, err)
+		}
+		if got, err := messageData(msgs[0].Values, "", tc.ciphers); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: messageData() of read values = %x, err: %v, want %x", tc.name, got, err, payload)
+		}
+	}
+}
+
+// keepAliveHook records the min idle time of XCLAIMs and, while alive is set,
+// answers them as redis does for messages idle for less than it, since the
+// test redis ignores MIN-IDLE.
+type keepAliveHook struct {
+	alive   *atomic.Bool
+	minIdle *atomic.Int64
+}
+
+func (h keepAliveHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h keepAliveHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() != "xclaim" {
+			return next(ctx, cmd)
+		}
+		if minIdle, ok := cmd.Args()[4].(int64); ok {
+			h.minIdle.Store(minIdle)
+		}
+		if claim, ok := cmd.(*redis.StringSliceCmd); ok && h.alive.Load() {
+			claim.SetVal(nil)
+			return nil
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h keepAliveHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().KeepAliveTimeout = time.Minute
+	var alive atomic.Bool
+	var minIdle atomic.Int64
+	redisClient.AddHook(keepAliveHook{alive: &alive, minIdle: &minIdle})
+
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, ID: fmt.Sprintf("%d-0", past), Values: map[string]any{messageKey: "{}"}}).Result()
+	if err != nil {
+		t.Fatalf("XAdd() unexpected error: %v", err)
+	}
+	if _, err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{Group: streamName, Consumer: "slow", Streams: []string{streamName, ">"}}).Result(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	pendingCount := func() int64 {
+		t.Helper()
+		pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+		if err != nil {
+			t.Fatalf("XPending() unexpected error: %v", err)
+		}
+		return pending.Count
+	}
+
+	// The slow consumer keeps the message from being idle for KeepAliveTimeout
+	alive.Store(true)
+	if ok, err := producer.reclaimExpired(ctx, streamName, id); err != nil || ok {
+		t.Errorf("reclaimExpired() of message of alive consumer = %v, err: %v, want false", ok, err)
+	}
+	if got, want := minIdle.Load(), time.Minute.Milliseconds(); got != want {
+		t.Errorf("XCLAIM min idle = %dms, want KeepAliveTimeout %dms", got, want)
+	}
+	if got := pendingCount(); got != 1 {
+		t.Errorf("Pending after reclaimExpired() of message of alive consumer = %d, want 1", got)
+	}
+	alive.Store(false)
+	if ok, err := producer.reclaimExpired(ctx, streamName, id); err != nil || !ok {
+		t.Errorf("reclaimExpired() of idle message = %v, err: %v, want true", ok, err)
+	}
+	if got := pendingCount(); got != 0 {
+		t.Errorf("Pending after reclaimExpired() of idle message = %d, want 0", got)
+	}
+}
+
+func TestConsumerKeepAlive(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	if DefaultProducerConfig.KeepAliveTimeout != DefaultConsumerConfig.IdletimeToAutoclaim {
+		t.Errorf("Default KeepAliveTimeout = %v, want consumers' IdletimeToAutoclaim %v", DefaultProducerConfig.KeepAliveTimeout, DefaultConsumerConfig.IdletimeToAutoclaim)
+	}
+	cfg := consumerCfg()
+	cfg.IdletimeToAutoclaim = 200 * time.Millisecond
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, cfg)
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "slow"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	defer msg.Ack()
+	// Processing for longer than IdletimeToAutoclaim, the consumer keeps
+	// resetting the idle time of its message
+	time.Sleep(3 * cfg.IdletimeToAutoclaim)
+	idle, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: streamName, Group: streamName, Start: "-", End: "+", Count: 10, Idle: cfg.IdletimeToAutoclaim}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		t.Fatalf("XPendingExt() unexpected error: %v", err)
+	}
+	if len(idle) != 0 {
+		t.Errorf("Pending entries idle for %v = %v, want none while the consumer is alive", cfg.IdletimeToAutoclaim, idle)
+	}
+}
+
+func TestReclaimPending(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().PendingScanCount = 2
+	producer.config().PendingMinIdle = 200 * time.Millisecond
+
+	// Entries past their request timeout, all but the last one idle long enough
+	const idle = 5
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	var ids []string
+	for i := 0; i <= idle; i++ {
+		id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, ID: fmt.Sprintf("%d-%d", past, i), Values: map[string]any{messageKey: "{}"}}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	readPending := func(count int64) {
+		t.Helper()
+		if _, err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{Group: streamName, Consumer: "consumer", Streams: []string{streamName, ">"}, Count: count}).Result(); err != nil {
+			t.Fatalf("XReadGroup() unexpected error: %v", err)
+		}
+	}
+	readPending(idle)
+	time.Sleep(300 * time.Millisecond)
+	readPending(1)
+	pendingCount := func() int64 {
+		t.Helper()
+		pending, err := redisClient.XPending(ctx, streamName, streamName).Result()
+		if err != nil {
+			t.Fatalf("XPending() unexpected error: %v", err)
+		}
+		return pending.Count
+	}
+
+	// Each cycle reclaims a page, and is rerun right away while pages are full
+	for i, want := range []struct {
+		interval time.Duration
+		pending  int64
+	}{
+		{0, 4},
+		{0, 2},
+		{5 * producer.config().CheckResultInterval, 1},
+	} {
+		if interval := producer.reclaimPending(ctx); interval != want.interval {
+			t.Errorf("reclaimPending() cycle %d = %v, want %v", i, interval, want.interval)
+		}
+		if got := pendingCount(); got != want.pending {
+			t.Errorf("Pending after reclaimPending() cycle %d = %d, want %d", i, got, want.pending)
+		}
+	}
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: streamName, Group: streamName, Start: "-", End: "+", Count: 10}).Result()
+	if err != nil || len(pending) != 1 || pending[0].ID != ids[idle] {
+		t.Errorf("XPendingExt() = %v, err: %v, want the entry idle for less than PendingMinIdle only", pending, err)
+	}
+}
+
+func TestReclaimDeadConsumers(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().DeadConsumerIdle = 100 * time.Millisecond
+	producer.config().DeadConsumerReclaimBatch = 2
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	var want []string
+	for i := 0; i < 3; i++ {
+		id, err := producer.ProduceNoWait(ctx, testRequest{Request: msgForIndex(i)})
+		if err != nil {
+			t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+		}
+		want = append(want, id)
+	}
+	// A consumer that reads the requests, heartbeats them once and dies
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamName,
+		Consumer: "dead",
+		Streams:  []string{streamName, ">"},
+		Count:    3,
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	if err := redisClient.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   streamName,
+		Group:    streamName,
+		Consumer: "dead",
+		Messages: want,
+	}).Err(); err != nil {
+		t.Fatalf("XClaimJustID() unexpected error: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	producer.reclaimDeadConsumers(ctx)
+	var moved []string
+	if err := producer.VisitPending(ctx, func(e PendingEntry) bool {
+		if e.Consumer != producer.Id() || e.Idle < 100*time.Millisecond {
+			t.Errorf("Pending entry %+v, want it moved to %v keeping its idle time", e, producer.Id())
+		}
+		moved = append(moved, e.ID)
+		return true
+	}); err != nil {
+		t.Fatalf("VisitPending() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, moved); diff != "" {
+		t.Errorf("Unexpected diff in moved requests (-want +got):\n%s\n", diff)
+	}
+	groupConsumers, err := redisClient.XInfoConsumers(ctx, streamName, streamName).Result()
+	if err != nil {
+		t.Fatalf("XInfoConsumers() unexpected error: %v", err)
+	}
+	for _, c := range groupConsumers {
+		if c.Name == "dead" {
+			t.Errorf("Dead consumer is still in the group: %+v", c)
+		}
+	}
+	// Live consumers claim them right away
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want reclaimed message", msg, err)
+	}
+	msg.Ack()
+}
+
+func TestTimeoutCause(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, producer, _ := newProducerConsumers(ctx, t)
+	producer.config().ClassifyTimeouts = true
+	var ids []string
+	for i := 0; i < 4; i++ {
+		id, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: streamName, Values: map[string]any{"k": i}}).Result()
+		if err != nil {
+			t.Fatalf("XAdd() unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	// The first request is acked without a response, the second is pending,
+	// the third was reclaimed by the producer during a consumer outage, and
+	// the last was never delivered
+	if err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamName,
+		Consumer: "consumer",
+		Streams:  []string{streamName, ">"},
+		Count:    3,
+	}).Err(); err != nil {
+		t.Fatalf("XReadGroup() unexpected error: %v", err)
+	}
+	if err := redisClient.XAck(ctx, streamName, streamName, ids[0]).Err(); err != nil {
+		t.Fatalf("XAck() unexpected error: %v", err)
+	}
+	if ok, err := producer.reclaimExpired(ctx, streamName, ids[2]); err != nil || !ok {
+		t.Fatalf("reclaimExpired() = %v, %v, want true", ok, err)
+	}
+	for i, want := range []timeoutCause{timeoutProcessedWithoutResponse, timeoutNeverProcessed, timeoutNeverProcessed, timeoutNeverProcessed} {
+		got, err := producer.timeoutCause(ctx, promiseKey{stream: streamName, id: ids[i]})
+		if err != nil {
+			t.Fatalf("timeoutCause() unexpected error: %v", err)
+		}
+		if got != want {
+			t.Errorf("timeoutCause(%v) = %v, want %v", ids[i], got, want)
+		}
+	}
+}
+
+func TestProducerConfigValidate(t *testing.T) {
+	t.Parallel()
+	if err := DefaultProducerConfig.Validate(); err != nil {
+		t.Errorf("DefaultProducerConfig.Validate() unexpected error: %v", err)
+	}
+	if err := TestProducerConfig.Validate(); err != nil {
+		t.Errorf("TestProducerConfig.Validate() unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		desc   string
+		modify func(*ProducerConfig)
+		want   string
+	}{
+		{"zero check interval", func(c *ProducerConfig) { c.CheckResultInterval = 0 }, "check-result-interval must be positive"},
+		{"zero request timeout", func(c *ProducerConfig) { c.RequestTimeout = 0 }, "request-timeout must be positive"},
+		{"check interval past timeout", func(c *ProducerConfig) { c.CheckResultInterval = 2 * c.RequestTimeout }, "must be less than the request timeout"},
+		{"check interval past priority timeout", func(c *ProducerConfig) { c.HighPriorityRequestTimeout = c.CheckResultInterval }, "must be less than the request timeout"},
+		{"negative interval", func(c *ProducerConfig) { c.PruneOrphansInterval = -time.Second }, "prune-orphans-interval can't be negative"},
+		{"pattern without interval", func(c *ProducerConfig) { c.StreamPattern, c.StreamDiscoveryInterval = "s:*", 0 }, "stream-discovery-interval must be positive"},
+		{"low above high water mark", func(c *ProducerConfig) { c.HighWaterMark, c.LowWaterMark = 10, 20 }, "can't be greater than high-water-mark"},
+	} {
+		cfg := TestProducerConfig
+		tc.modify(&cfg)
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: Validate() = %v, want error containing %q", tc.desc, err, tc.want)
+		}
+	}
+	ctx := context.Background()
+	redisClient, err := redisutil.RedisClientFromURL(redisutil.CreateTestRedis(ctx, t))
+	if err != nil {
+		t.Fatalf("RedisClientFromURL() unexpected error: %v", err)
+	}
+	cfg := producerCfg()
+	cfg.CheckResultInterval = 0
+	if _, err := NewProducer[testRequest, testResponse](redisClient, "stream", cfg); err == nil {
+		t.Error("NewProducer() with zero check-result-interval succeeded, want error")
+	}
+}
+
+func TestStartupGracePeriod(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().StartupGracePeriod = time.Hour
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+	msgId, err := producer.ProduceNoWait(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceNoWait() unexpected error: %v", err)
+	}
+	if msg, err := consumer.Consume(ctx); err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, %v, want message", msg, err)
+	}
+	if ok, err := producer.reclaimExpired(ctx, producer.stream(), msgId); err != nil || ok {
+		t.Fatalf("reclaimExpired() = %v, %v during grace period, want false", ok, err)
+	}
+	cfg := *producer.config()
+	cfg.StartupGracePeriod = time.Nanosecond
+	if err := producer.UpdateConfig(cfg); err != nil {
+		t.Fatalf("UpdateConfig() unexpected error: %v", err)
+	}
+	if ok, err := producer.reclaimExpired(ctx, producer.stream(), msgId); err != nil || !ok {
+		t.Fatalf("reclaimExpired() = %v, %v after grace period, want true", ok, err)
+	}
+}
+
+func TestHeartbeatExtendsTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().RequestTimeout = 100 * time.Millisecond
+	producer.config().HeartbeatStaleness = 100 * time.Millisecond
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.cfg.HeartbeatInterval = 10 * time.Millisecond
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	// Work past the request timeout while heartbeating
+	time.Sleep(4 * producer.config().RequestTimeout)
+	if promise.Ready() {
+		_, err := promise.Current()
+		t.Fatalf("Promise resolved while consumer heartbeats, err: %v", err)
+	}
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	msg.Ack()
+	if res, err := promise.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes of loggers.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	var logs lockedBuffer
+	logger := log.NewLogger(log.NewTerminalHandlerWithLevel(&logs, log.LevelDebug, false))
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, producerCfg(), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	if got := logs.String(); !strings.Contains(got, "Redis stream producing") {
+		t.Errorf("Injected logger got %q, want it to log producing", got)
+	}
+}
+
+func TestProduceWithDecoder(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	decode := func(data []byte) (testResponse, error) {
+		return testResponse{Response: "decoded " + string(data)}, nil
+	}
+	if _, err := producer.ProduceWithDecoder(ctx, testRequest{Request: "req"}, nil); err == nil {
+		t.Error("ProduceWithDecoder() with nil decoder succeeded, want error")
+	}
+	promise, err := producer.ProduceWithDecoder(ctx, testRequest{Request: "req"}, decode)
+	if err != nil {
+		t.Fatalf("ProduceWithDecoder() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	want := `decoded {"Response":"resp"}`
+	if res, err := promise.Await(ctx); err != nil || res.Response != want {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, want)
+	}
+}
+
+func TestCheckExists(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().CheckExists = true
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	pending, err := producer.Produce(ctx, testRequest{Request: "pending"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	answered, err := producer.Produce(ctx, testRequest{Request: "answered"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := consumer.Consume(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+		}
+		msg.Ack()
+		if msg.Value.Request == "answered" {
+			if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: "resp"}); err != nil {
+				t.Fatalf("SetResult() unexpected error: %v", err)
+			}
+		}
+	}
+	if res, err := answered.Await(ctx); err != nil || res.Response != "resp" {
+		t.Errorf("Await() = %v, err: %v, want %q", res, err, "resp")
+	}
+	if pending.Ready() {
+		t.Error("Promise without response is ready, want pending")
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, _ := newProducerConsumers(ctx, t)
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	cfg := *producer.config()
+	cfg.MaxPayloadBytes = 1
+	if err := producer.UpdateConfig(cfg); err != nil {
+		t.Fatalf("UpdateConfig() unexpected error: %v", err)
+	}
+	if _, err := producer.Produce(ctx, testRequest{Request: "req"}); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Produce() after UpdateConfig() error = %v, want %v", err, ErrPayloadTooLarge)
+	}
+
+	for _, modify := range []func(*ProducerConfig){
+		func(c *ProducerConfig) { c.CheckResultInterval = 0 },
+		func(c *ProducerConfig) { c.CheckResultInterval = c.RequestTimeout },
+	} {
+		invalid := *producer.config()
+		modify(&invalid)
+		if err := producer.UpdateConfig(invalid); err == nil {
+			t.Errorf("UpdateConfig() with check-result-interval %v and request-timeout %v succeeded, want error", invalid.CheckResultInterval, invalid.RequestTimeout)
+		}
+		if got := producer.config().CheckResultInterval; got != cfg.CheckResultInterval {
+			t.Errorf("CheckResultInterval after rejected UpdateConfig() = %v, want %v", got, cfg.CheckResultInterval)
+		}
+	}
+
+	// Settings that must match the consumers keep their initial values
+	compat := *producer.config()
+	compat.UseHashTag = !cfg.UseHashTag
+	compat.PayloadField = "other"
+	if err := producer.UpdateConfig(compat); err != nil {
+		t.Fatalf("UpdateConfig() unexpected error: %v", err)
+	}
+	if got := producer.config(); got.UseHashTag != cfg.UseHashTag || got.PayloadField != cfg.PayloadField {
+		t.Errorf("UpdateConfig() changed UseHashTag to %v and PayloadField to %q, want %v and %q kept", got.UseHashTag, got.PayloadField, cfg.UseHashTag, cfg.PayloadField)
+	}
+}
+
+func TestUseHashTag(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	redisClient, streamName, _, _ := newProducerConsumers(ctx, t)
+	if got, want := HashTaggedResultKeyFor(streamName, "1-0"), "{"+streamName+"}.1-0"; got != want {
+		t.Errorf("HashTaggedResultKeyFor() = %q, want %q", got, want)
+	}
+	prodCfg := producerCfg()
+	prodCfg.UseHashTag = true
+	// Only flushes read responses after the first cycle
+	prodCfg.CheckResultInterval = time.Hour
+	prodCfg.RequestTimeout = 2 * time.Hour
+	producer, err := NewProducer[testRequest, testResponse](redisClient, streamName, prodCfg)
+	if err != nil {
+		t.Fatalf("Error creating new producer: %v", err)
+	}
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	if err := producer.WaitStarted(ctx); err != nil {
+		t.Fatalf("WaitStarted() unexpected error: %v", err)
+	}
+	consCfg := consumerCfg()
+	consCfg.UseHashTag = true
+	consumer, err := NewConsumer[testRequest, testResponse](redisClient, streamName, consCfg)
+	if err != nil {
+		t.Fatalf("Error creating new consumer: %v", err)
+	}
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	msg, err := consumer.Consume(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Consume() = %v, err: %v, want message", msg, err)
+	}
+	msg.Ack()
+	if err := consumer.SetResult(ctx, msg.ID, testResponse{Response: msg.Value.Request}); err != nil {
+		t.Fatalf("SetResult() unexpected error: %v", err)
+	}
+	hashTagged := "{" + streamName + "}." + msg.ID
+	if n, err := redisClient.Exists(ctx, hashTagged, ResultKeyFor(streamName, msg.ID)).Result(); err != nil || n != 1 {
+		t.Fatalf("Exists() = %d, err: %v, want the response under %q only", n, err, hashTagged)
+	}
+	if n, err := redisClient.Exists(ctx, hashTagged).Result(); err != nil || n != 1 {
+		t.Fatalf("Response key %q exists = %d, err: %v, want 1", hashTagged, n, err)
+	}
+	if err := producer.Flush(ctx); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+	if res, err := promise.Await(ctx); err != nil || res.Response != "req" {
+		t.Errorf("Await() = %v, err: %v, want req", res, err)
+	}
+}
+
+func TestRetryAfterCancel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().EnableScheduling = true
+	producer.config().MaxRetryAfter = 1
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	consumeNext := func() *Message[testRequest] {
+		t.Helper()
+		for {
+			msg, err := consumer.Consume(ctx)
+			if err != nil {
+				t.Fatalf("Consume() unexpected error: %v", err)
+			}
+			if msg != nil {
+				msg.Ack()
+				return msg
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	promise, cancelRequest, err := producer.ProduceCancelable(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("ProduceCancelable() unexpected error: %v", err)
+	}
+	first := consumeNext()
+	if err := consumer.SetRetryAfter(ctx, first.ID, 10*time.Millisecond); err != nil {
+		t.Fatalf("SetRetryAfter() unexpected error: %v", err)
+	}
+	second := consumeNext()
+	if second.ID == first.ID {
+		t.Fatalf("Consumed %v again after retry, want request produced again", second.ID)
+	}
+	// The request produced again is found by its original id
+	subscriber := producer.Subscribe(first.ID)
+	if subscriber == nil {
+		t.Fatalf("Subscribe(%v) = nil after retry, want promise of the request produced again", first.ID)
+	}
+	cancelRequest()
+	for i, promise := range []*containers.Promise[testResponse]{promise, subscriber} {
+		if _, err := promise.Await(ctx); !errors.Is(err, ErrRequestCanceled) {
+			t.Errorf("promises[%d].Await() error = %v, want %v", i, err, ErrRequestCanceled)
+		}
+	}
+	if cnt := producer.promisesLen(); cnt != 0 {
+		t.Errorf("Producer tracks %d promises after cancel, want 0", cnt)
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, producer, consumers := newProducerConsumers(ctx, t)
+	producer.config().EnableScheduling = true
+	producer.config().MaxRetryAfter = 1
+	producer.Start(ctx)
+	defer producer.StopAndWait()
+	consumer := consumers[0]
+	consumer.Start(ctx)
+	defer consumer.StopAndWait()
+
+	consumeNext := func() *Message[testRequest] {
+		t.Helper()
+		for {
+			msg, err := consumer.Consume(ctx)
+			if err != nil {
+				t.Fatalf("Consume() unexpected error: %v", err)
+			}
+			if msg != nil {
+				msg.Ack()
+				return msg
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	promise, err := producer.Produce(ctx, testRequest{Request: "req"})
+	if err != nil {
+		t.Fatalf("Produce() unexpected error: %v", err)
+	}
+	first := consumeNext()
+	delay := 100 * time.Millisecond
+	retried := time.Now()
+	if err := consumer.SetRetryAfter(ctx, first.ID, delay); err != nil {
+		t.Fatalf("SetRetryAfter() unexpected error: %v", err)
+	}
+	second := consumeNext()
+	if second.ID == first.ID || second.Value.Request != "req" {
+		t.Errorf("Consumed %v %v after retry, want request produced again", second.ID, second.Value)
+	}
+	if elapsed := time.Since(retried); elapsed < delay {
+		t.Errorf("Request produced again after %v, want at least %v", elapsed, delay)
+	}
+	if promise.Ready() {
+		t.Fatal("Promise resolved after retry, want it waiting for the produced again request")
+	}
+	if err := consumer.SetRetryAfter(ctx, second.ID, delay); err != nil {
+		t.Fatalf("SetRetryAfter() unexpected error: %v", err)
+	}
+	if _, err := promise.Await(ctx); !errors.Is(err, ErrRetryAfter) {
+		t.Errorf("Await() error = %v, want %v", err, ErrRetryAfter)
+	}
+}
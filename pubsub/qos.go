@@ -0,0 +1,72 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// qosKey is the field of the stream entry holding the request's QoS class.
+const qosKey = "qos"
+
+// QoSClass is a soft hint of how a request should be scheduled by consumers,
+// unlike deadlines it isn't enforced, it's up to consumers to honor it.
+type QoSClass uint8
+
+const (
+	// QoSDefault is the class of requests produced without a QoS class.
+	QoSDefault QoSClass = iota
+	// QoSLatencySensitive requests have someone waiting on them, consumers
+	// should prefer them, e.g. preempting batch work.
+	QoSLatencySensitive
+	// QoSBatch requests tolerate delays, consumers can defer them.
+	QoSBatch
+)
+
+func (q QoSClass) String() string {
+	switch q {
+	case QoSDefault:
+		return "default"
+	case QoSLatencySensitive:
+		return "latency-sensitive"
+	case QoSBatch:
+		return "batch"
+	default:
+		return "unknown"
+	}
+}
+
+// ProduceWithQoS is like Produce, but writes given QoS class to the message,
+// which consumers read from Message.QoS to schedule their work.
+func (p *Producer[Request, Response]) ProduceWithQoS(ctx context.Context, value Request, qos QoSClass) (*containers.Promise[Response], error) {
+	p.logger.Debug("Redis stream producing with QoS class", "value", value, "qos", qos)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{payloadField(p.config().PayloadField): val}
+	if qos != QoSDefault {
+		values[qosKey] = int(qos)
+	}
+	_, promise, err := p.produceValues(ctx, values, PriorityNormal)
+	return promise, err
+}
+
+// parseQoS returns the QoS class stored in the stream entry values,
+// defaulting to QoSDefault when it's missing or invalid.
+func parseQoS(values map[string]any) QoSClass {
+	str, ok := values[qosKey].(string)
+	if !ok {
+		return QoSDefault
+	}
+	qos, err := strconv.ParseUint(str, 10, 8)
+	if err != nil {
+		return QoSDefault
+	}
+	return QoSClass(qos)
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// receiptKey is the field of the stream entry set when the producer wants to
+// know once a consumer received the request.
+const receiptKey = "receipt"
+
+var errNoReceipt = errors.New("request finished without receipt")
+
+// receiptKeyFor returns the key a consumer sets once it received the request
+// of given response key.
+func receiptKeyFor(resultKey string) string { return resultKey + ".received" }
+
+// ReceiptPromise is a promise of a response that also signals when a consumer
+// received the request, before the response is ready.
+type ReceiptPromise[Response any] struct {
+	*containers.Promise[Response]
+	produced *containers.Promise[struct{}]
+}
+
+// Produced returns a promise resolved once a consumer received the request,
+// meaning it's committed for processing. It errors if the request finishes
+// without a consumer receiving it, e.g. when it times out or is canceled.
+func (r *ReceiptPromise[Response]) Produced() *containers.Promise[struct{}] {
+	return r.produced
+}
+
+// ProduceWithReceipt is like Produce, but consumers report when they received
+// the request, which is signaled by the returned promise's Produced. The
+// receipt costs a redis round trip per check cycle until it arrives.
+func (p *Producer[Request, Response]) ProduceWithReceipt(ctx context.Context, value Request) (*ReceiptPromise[Response], error) {
+	p.logger.Debug("Redis stream producing with receipt", "value", value)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	produced := containers.NewPromise[struct{}](nil)
+	values := map[string]any{payloadField(p.config().PayloadField): val, receiptKey: true}
+	_, promise, err := p.produceValues(ctx, values, PriorityNormal, func(tracked *trackedPromise[Response]) {
+		tracked.produced = &produced
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ReceiptPromise[Response]{Promise: promise, produced: &produced}, nil
+}
+
+// checkReceipt resolves the produced promise if a consumer has received the
+// request, the lock of its shard must be held.
+func (p *Producer[Request, Response]) checkReceipt(ctx context.Context, resultKey string, tracked *trackedPromise[Response]) {
+	key := receiptKeyFor(resultKey)
+	err := p.readClient.Get(ctx, key).Err()
+	if errors.Is(err, redis.Nil) {
+		return
+	}
+	if err != nil {
+		p.logger.Warn("error reading receipt", "key", key, "err", err)
+		return
+	}
+	tracked.produced.Produce(struct{}{})
+}
+
+// sendReceipt reports to the producer that the message was received, it's best
+// effort as the producer still gets the response without it.
+func (c *Consumer[Request, Response]) sendReceipt(ctx context.Context, messageID string) {
+	key := receiptKeyFor(resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag))
+	if err := c.client.Set(ctx, key, 1, c.cfg.ResponseEntryTimeout).Err(); err != nil {
+		log.Warn("error sending receipt", "messageID", messageID, "err", err)
+	}
+}
@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// Age of requests when their promise is resolved, by outcome, to tell slow
+// but working consumers, whose successes skew old, from failing ones.
+var (
+	successAgeTimer        = metrics.NewRegisteredTimer("arb/pubsub/producer/resolution/age/success", nil)
+	unmarshalErrorAgeTimer = metrics.NewRegisteredTimer("arb/pubsub/producer/resolution/age/unmarshal_error", nil)
+	timeoutAgeTimer        = metrics.NewRegisteredTimer("arb/pubsub/producer/resolution/age/timeout", nil)
+)
+
+type resolutionOutcome int
+
+const (
+	resolvedSuccess resolutionOutcome = iota
+	resolvedUnmarshalError
+	resolvedTimeout
+)
+
+// recordResolutionAge records the age of the request at the time of
+// resolution, from its message id's timestamp, as of the redis server's clock.
+func recordResolutionAge(outcome resolutionOutcome, msgId string, redisNow time.Time) {
+	enqueuedAt, err := msgIdTime(msgId)
+	if err != nil {
+		return
+	}
+	age := redisNow.Sub(enqueuedAt)
+	switch outcome {
+	case resolvedSuccess:
+		successAgeTimer.Update(age)
+	case resolvedUnmarshalError:
+		unmarshalErrorAgeTimer.Update(age)
+	case resolvedTimeout:
+		timeoutAgeTimer.Update(age)
+	}
+}
@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// responseIDField is the field of response stream entries holding the
+	// message id of the request they respond to.
+	responseIDField = "id"
+	// responseValueField is the field of response stream entries holding the
+	// response, formatted as the value of a response key.
+	responseValueField = "value"
+	// responseStreamReadCount is the max number of entries read from a
+	// response stream per XREAD.
+	responseStreamReadCount = 1000
+	// responseStreamClockMargin is how long before its oldest tracked request
+	// a response stream is first read from, as it may be on another redis
+	// cluster node than the request stream, whose clock is off.
+	responseStreamClockMargin = time.Minute
+)
+
+// ResponseStreamFor returns the stream that responses to requests of given
+// stream are added to when ResponseStream is set.
+func ResponseStreamFor(streamName string) string { return ResultKeyFor(streamName, "responses") }
+
+func responseStreamFor(streamName string, useHashTag bool) string {
+	return resultKeyFor(streamName, "responses", useHashTag)
+}
+
+// streamResponse is a response read from a response stream that wasn't taken
+// by a check of its promise yet.
+type streamResponse struct {
+	value   string
+	entryID string
+	// unclaimed is set once a check cycle started without its promise being
+	// tracked, it's dropped if that happens again.
+	unclaimed bool
+}
+
+// readResponseStreams reads the responses added to the response streams of
+// given promises since the last read, to be taken by takeStreamResponse.
+// Responses that no tracked promise takes are dropped after a cycle, which
+// leaves time for promises produced concurrently to be tracked. Response
+// streams are first read from just before their oldest tracked request, and
+// entries older than the longest request timeout are trimmed, as the requests
+// they respond to have timed out.
+func (p *Producer[Request, Response]) readResponseStreams(ctx context.Context, keys []promiseKey) {
+	p.responsesLock.Lock()
+	defer p.responsesLock.Unlock()
+	tracked := make(map[promiseKey]struct{}, len(keys))
+	// oldest tracked message id by stream
+	streams := make(map[string]string)
+	for _, key := range keys {
+		tracked[key] = struct{}{}
+		if oldest, found := streams[key.stream]; !found || cmpMsgId(key.id, oldest) == -1 {
+			streams[key.stream] = key.id
+		}
+	}
+	for key, response := range p.streamResponses {
+		if _, found := tracked[key]; found {
+			continue
+		}
+		if response.unclaimed {
+			delete(p.streamResponses, key)
+		} else {
+			response.unclaimed = true
+		}
+	}
+	for stream, oldest := range streams {
+		responseStream := responseStreamFor(stream, p.config().UseHashTag)
+		cursor, found := p.responseCursors[stream]
+		if !found {
+			cursor = firstResponseCursor(oldest)
+		}
+		read := 0
+		for {
+			res, err := p.readClient.XRead(ctx, &redis.XReadArgs{
+				Streams: []string{responseStream, cursor},
+				Count:   responseStreamReadCount,
+				Block:   -1,
+			}).Result()
+			if err != nil {
+				if !errors.Is(err, redis.Nil) {
+					p.logger.Error("Error reading response stream", "stream", responseStream, "error", err)
+				}
+				break
+			}
+			page := 0
+			for _, s := range res {
+				for _, msg := range s.Messages {
+					page++
+					cursor = msg.ID
+					msgId, _ := msg.Values[responseIDField].(string)
+					value, _ := msg.Values[responseValueField].(string)
+					key := promiseKey{stream: stream, id: msgId}
+					if _, found := p.streamResponses[key]; found {
+						// Only the first response counts, as with response keys
+						continue
+					}
+					p.streamResponses[key] = &streamResponse{value: value, entryID: msg.ID}
+				}
+			}
+			read += page
+			if page < responseStreamReadCount {
+				break
+			}
+		}
+		p.responseCursors[stream] = cursor
+		if read > 0 {
+			p.trimResponseStream(ctx, responseStream)
+		}
+	}
+}
+
+// firstResponseCursor returns the id to first read the response stream from,
+// given the oldest tracked request, as responses are added after requests.
+func firstResponseCursor(oldest string) string {
+	producedAt, err := msgIdTime(oldest)
+	if err != nil {
+		return "0"
+	}
+	return allowedOldestID(producedAt, responseStreamClockMargin)
+}
+
+// trimResponseStream trims the entries of the response stream older than the
+// longest request timeout, which other producers sharing it have read too.
+func (p *Producer[Request, Response]) trimResponseStream(ctx context.Context, responseStream string) {
+	minID := allowedOldestID(p.redisNow(), p.config().maxRequestTimeout())
+	if err := p.client.XTrimMinID(ctx, responseStream, minID).Err(); err != nil {
+		p.logger.Warn("error trimming response stream", "stream", responseStream, "err", err)
+	}
+}
+
+// takeStreamResponse returns the response of the promise read from its
+// response stream and its entry id, or redis.Nil if there isn't one yet.
+func (p *Producer[Request, Response]) takeStreamResponse(key promiseKey) (string, string, error) {
+	p.responsesLock.Lock()
+	defer p.responsesLock.Unlock()
+	response, found := p.streamResponses[key]
+	if !found {
+		return "", "", redis.Nil
+	}
+	delete(p.streamResponses, key)
+	return response.value, response.entryID, nil
+}
+
+// keepStreamResponse makes a taken response available to be taken again.
+func (p *Producer[Request, Response]) keepStreamResponse(key promiseKey, value, entryID string) {
+	p.responsesLock.Lock()
+	defer p.responsesLock.Unlock()
+	p.streamResponses[key] = &streamResponse{value: value, entryID: entryID}
+}
+
+// deleteStreamResponse deletes the entry of a handled response from the
+// response stream, it's best effort as entries expire with the stream.
+func (p *Producer[Request, Response]) deleteStreamResponse(ctx context.Context, stream, entryID string) {
+	responseStream := responseStreamFor(stream, p.config().UseHashTag)
+	if err := p.client.XDel(ctx, responseStream, entryID).Err(); err != nil {
+		p.logger.Warn("error deleting response stream entry", "stream", responseStream, "entryID", entryID, "err", err)
+	}
+}
+
+// writeResponse writes the response value of the message, to the response
+// key or the response stream when ResponseStream is set. Returns whether it
+// was written, a response key isn't overwritten.
+func (c *Consumer[Request, Response]) writeResponse(ctx context.Context, messageID, resultKey, value string) (bool, error) {
+	if !c.cfg.ResponseStream {
+		return c.client.SetNX(ctx, resultKey, value, c.cfg.ResponseEntryTimeout).Result()
+	}
+	responseStream := responseStreamFor(c.StreamName(), c.cfg.UseHashTag)
+	pipe := c.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: responseStream,
+		Values: map[string]any{responseIDField: messageID, responseValueField: value},
+	})
+	if c.cfg.ResponseEntryTimeout > 0 {
+		// Refreshed with every response, so that the stream expires once it's unused
+		pipe.Expire(ctx, responseStream, c.cfg.ResponseEntryTimeout)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy configures how ProduceAndWait retries requests that timed out,
+// e.g. because no consumer picked them up.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a request is produced.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for every next one.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries, zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// WithRetryPolicy makes ProduceAndWait re-produce requests that fail with
+// ErrRequestTimeout according to the policy.
+func WithRetryPolicy(policy RetryPolicy) ProducerOption {
+	return func(o *producerOptions) {
+		o.retryPolicy = &policy
+	}
+}
+
+// ProduceAndWait produces the request and waits for its response. If a retry
+// policy is set, requests that time out are removed from the stream and
+// produced again, so that stale attempts don't pile up.
+func (p *Producer[Request, Response]) ProduceAndWait(ctx context.Context, value Request) (Response, error) {
+	p.startIterativeChecks()
+	attempts := 1
+	var backoff time.Duration
+	if p.retryPolicy != nil {
+		attempts = max(p.retryPolicy.MaxAttempts, 1)
+		backoff = p.retryPolicy.Backoff
+	}
+	var zero Response
+	for attempt := 1; ; attempt++ {
+		key, promise, err := p.produce(ctx, value, PriorityNormal)
+		if err != nil {
+			return zero, err
+		}
+		res, err := promise.Await(ctx)
+		if err == nil || !errors.Is(err, ErrRequestTimeout) || attempt >= attempts {
+			return res, err
+		}
+		p.logger.Warn("Request timed out, retrying", "msgId", key.id, "attempt", attempt, "maxAttempts", attempts)
+		p.removeFromRedis(ctx, key.stream, key.id)
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if p.retryPolicy.MaxBackoff != 0 && backoff > p.retryPolicy.MaxBackoff {
+			backoff = p.retryPolicy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// retryAfterMarkerPrefix prefixes the value of a response key when the
+// consumer asks the producer to retry the request later, followed by the
+// delay in milliseconds.
+const retryAfterMarkerPrefix = "#retry-after:"
+
+func retryAfterMarker(delay time.Duration) string {
+	return retryAfterMarkerPrefix + strconv.FormatInt(delay.Milliseconds(), 10)
+}
+
+// parseRetryAfterMarker returns the delay if value of the response key is a
+// retry after marker.
+func parseRetryAfterMarker(value string) (time.Duration, bool) {
+	ms, found := strings.CutPrefix(value, retryAfterMarkerPrefix)
+	if !found {
+		return 0, false
+	}
+	delay, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(delay) * time.Millisecond, true
+}
+
+// SetRetryAfter asks the producer to produce the message again after given
+// delay instead of failing it, e.g. when a downstream is rate limited. The
+// message is acked but left in the stream for the producer to read it from,
+// which errors the promise with ErrRetryAfter once MaxRetryAfter is reached.
+func (c *Consumer[Request, Response]) SetRetryAfter(ctx context.Context, messageID string, delay time.Duration) error {
+	if delay < time.Millisecond {
+		return fmt.Errorf("invalid retry delay: %v", delay)
+	}
+	resultKey := resultKeyFor(c.StreamName(), messageID, c.cfg.UseHashTag)
+	log.Debug("consumer: setting retry after", "cid", c.id, "msgIdInStream", messageID, "resultKeyInRedis", resultKey, "delay", delay)
+	marker := retryAfterMarker(delay)
+	acquired, err := c.writeResponse(ctx, messageID, resultKey, c.sign(messageID, marker, []byte(marker)))
+	if err != nil || !acquired {
+		return fmt.Errorf("setting retry after for message with message-id in stream: %v, error: %w", messageID, err)
+	}
+	if _, err := c.client.XAck(ctx, c.redisStream, c.redisGroup, messageID).Result(); err != nil {
+		return fmt.Errorf("acking message: %v, error: %w", messageID, err)
+	}
+	return nil
+}
+
+// retryAfter is a request its consumer asked to retry after the delay.
+type retryAfter struct {
+	key   promiseKey
+	delay time.Duration
+}
+
+// retryLater produces the requests again, scheduled after their delay, and
+// tracks their promises under the new messages. No shard lock may be held.
+func (p *Producer[Request, Response]) retryLater(ctx context.Context, retries []retryAfter) {
+	for _, retry := range retries {
+		if err := p.reproduceAfter(ctx, retry.key, retry.delay); err != nil {
+			p.logger.Error("Error producing request again after retry delay", "msgId", retry.key.id, "delay", retry.delay, "err", err)
+			shard := p.shardFor(retry.key)
+			shard.lock.Lock()
+			if tracked, found := shard.promises[retry.key]; found {
+				tracked.promise.ProduceError(fmt.Errorf("%w: producing again after %v: %w", ErrRetryAfter, retry.delay, err))
+				p.stopTracking(shard, retry.key, PromiseErrored)
+			}
+			p.unlockAndObserve(shard)
+		}
+	}
+}
+
+func (p *Producer[Request, Response]) reproduceAfter(ctx context.Context, key promiseKey, delay time.Duration) error {
+	msgs, err := p.client.XRangeN(ctx, key.stream, key.id, key.id, 1).Result()
+	if err != nil {
+		return fmt.Errorf("reading request: %w", err)
+	}
+	if len(msgs) == 0 {
+		return errors.New("request is gone from the stream")
+	}
+	values := msgs[0].Values
+	notBefore := time.Now().Add(delay)
+	values[notBeforeKey] = notBefore.UnixMilli()
+	msgId, err := p.addToStream(ctx, key.stream, values)
+	if err != nil {
+		return err
+	}
+	newKey := promiseKey{stream: key.stream, id: msgId}
+	rekeyed := p.rekey(key, newKey, func(tracked *trackedPromise[Response]) {
+		tracked.retryAfters++
+		tracked.notBefore = notBefore
+	})
+	if !rekeyed {
+		// Canceled meanwhile, nobody waits for the new request
+		p.removeFromRedis(ctx, newKey.stream, newKey.id)
+		return nil
+	}
+	p.movePersistedPromise(ctx, key, newKey)
+	if err := p.client.XDel(ctx, key.stream, key.id).Err(); err != nil {
+		p.logger.Warn("error deleting retried message", "msgId", key.id, "err", err)
+	}
+	return nil
+}
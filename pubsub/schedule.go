@@ -0,0 +1,76 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// notBeforeKey is the field of the stream entry holding the unix time in
+// milliseconds before which the request shouldn't be processed.
+const notBeforeKey = "not-before"
+
+// parseNotBefore returns the time stored in the stream entry values before
+// which the request shouldn't be processed, if there is one.
+func parseNotBefore(values map[string]any) (time.Time, bool) {
+	return parseUnixMilli(values, notBeforeKey)
+}
+
+// parseUnixMilli returns the time stored in unix milliseconds in given field
+// of the stream entry values, if there is one.
+func parseUnixMilli(values map[string]any, field string) (time.Time, bool) {
+	str, ok := values[field].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// scheduledTimeout extends the request timeout of a message by the delay until
+// its not before time, so that scheduled requests don't expire while waiting.
+func scheduledTimeout(msgId string, notBefore time.Time, timeout time.Duration) time.Duration {
+	if notBefore.IsZero() {
+		return timeout
+	}
+	enqueuedAt, err := msgIdTime(msgId)
+	if err != nil {
+		return timeout
+	}
+	if delay := notBefore.Sub(enqueuedAt); delay > 0 {
+		return timeout + delay
+	}
+	return timeout
+}
+
+// ProduceAt is like Produce, but the request is not processed before given
+// time. Consumers skip requests that aren't due yet without heartbeating
+// them, so they're claimed again once idle for IdletimeToAutoclaim. Requests
+// are thus processed up to IdletimeToAutoclaim (plus the consumers' polling
+// interval) after notBefore, shorter autoclaim idle times give better
+// precision at the cost of more redis round trips. Requires EnableScheduling.
+func (p *Producer[Request, Response]) ProduceAt(ctx context.Context, value Request, notBefore time.Time) (*containers.Promise[Response], error) {
+	cfg := p.config()
+	if !cfg.EnableScheduling {
+		return nil, ErrSchedulingDisabled
+	}
+	p.logger.Debug("Redis stream producing scheduled", "value", value, "notBefore", notBefore)
+	p.startIterativeChecks()
+	if err := p.waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	val, err := p.marshalRequest(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{payloadField(cfg.PayloadField): val, notBeforeKey: notBefore.UnixMilli()}
+	_, promise, err := p.produceValues(ctx, values, PriorityNormal, func(tracked *trackedPromise[Response]) {
+		tracked.notBefore = notBefore
+	})
+	return promise, err
+}
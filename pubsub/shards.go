@@ -0,0 +1,76 @@
+package pubsub
+
+import (
+	"sync"
+)
+
+// promiseShard is a stripe of the producer's tracked promises, guarded by its
+// own lock so that produces and resolutions of different shards don't contend.
+type promiseShard[Response any] struct {
+	lock     sync.RWMutex
+	promises map[promiseKey]*trackedPromise[Response]
+	// transitions recorded while holding lock, guarded by it.
+	transitions []promiseTransition
+	// unpersisted are the persisted set members of promises that stopped
+	// being tracked while holding lock, guarded by it.
+	unpersisted []string
+	// releasedIdempotency are the idempotency keys of promises that stopped
+	// being tracked while holding lock, guarded by it.
+	releasedIdempotency []idempotencyRelease
+}
+
+func newPromiseShards[Response any](count int) []*promiseShard[Response] {
+	shards := make([]*promiseShard[Response], max(count, 1))
+	for i := range shards {
+		shards[i] = &promiseShard[Response]{promises: make(map[promiseKey]*trackedPromise[Response])}
+	}
+	return shards
+}
+
+// fnv1a hashes the string with FNV-1a, inline so that it doesn't allocate.
+func fnv1a(s string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// shardIndex hashes the message id to the index of its shard.
+func (p *Producer[Request, Response]) shardIndex(key promiseKey) int {
+	if len(p.shards) == 1 {
+		return 0
+	}
+	return int(fnv1a(key.id) % uint32(len(p.shards)))
+}
+
+// shardFor returns the shard tracking the promise of given message.
+func (p *Producer[Request, Response]) shardFor(key promiseKey) *promiseShard[Response] {
+	return p.shards[p.shardIndex(key)]
+}
+
+// isTracked returns whether the promise of given message is tracked.
+func (p *Producer[Request, Response]) isTracked(key promiseKey) bool {
+	shard := p.shardFor(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	_, found := shard.promises[key]
+	return found
+}
+
+// trackedKeys returns the keys of all the tracked promises matching the
+// predicate, or all of them if it's nil.
+func (p *Producer[Request, Response]) trackedKeys(match func(promiseKey) bool) []promiseKey {
+	var keys []promiseKey
+	for _, shard := range p.shards {
+		shard.lock.RLock()
+		for key := range shard.promises {
+			if match == nil || match(key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	return keys
+}
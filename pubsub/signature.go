@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// signatureMarkerPrefix prefixes the value of a response key when the consumer
+// signed the response, followed by the hex encoded HMAC and ':'.
+const signatureMarkerPrefix = "#sig:"
+
+// responseMAC returns the HMAC of the response data of given message, the id
+// is covered so that a signed response can't be replayed for another message.
+func responseMAC(key, messageID string, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(messageID))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// splitSignature returns the value of a response key without its signature
+// marker and the signature, which is empty if the value isn't signed.
+func splitSignature(value string) (string, string) {
+	rest, found := strings.CutPrefix(value, signatureMarkerPrefix)
+	if !found {
+		return value, ""
+	}
+	signature, rest, found := strings.Cut(rest, ":")
+	if !found {
+		return value, ""
+	}
+	return rest, signature
+}
+
+// verifyResponse checks the signature of the assembled response data of given
+// message when ResponseHMACKey is set.
+func (p *Producer[Request, Response]) verifyResponse(messageID string, data []byte, signature string) error {
+	cfg := p.config()
+	if cfg.ResponseHMACKey == "" {
+		return nil
+	}
+	if signature == "" {
+		return fmt.Errorf("%w: response of %v isn't signed", ErrResponseUnverified, messageID)
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, responseMAC(cfg.ResponseHMACKey, messageID, data)) {
+		return fmt.Errorf("%w: signature of %v doesn't match", ErrResponseUnverified, messageID)
+	}
+	return nil
+}
+
+// sign prefixes the value of a response key with the signature of the response
+// data of given message, which for chunked responses is the data of all the
+// chunks, when ResponseHMACKey is set.
+func (c *Consumer[Request, Response]) sign(messageID, value string, data []byte) string {
+	if c.cfg.ResponseHMACKey == "" {
+		return value
+	}
+	return signatureMarkerPrefix + hex.EncodeToString(responseMAC(c.cfg.ResponseHMACKey, messageID, data)) + ":" + value
+}
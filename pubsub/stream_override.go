@@ -0,0 +1,31 @@
+package pubsub
+
+import "context"
+
+type streamOverrideKey struct{}
+
+// WithStreamOverride returns a context that makes producers add requests
+// produced with it to given stream instead of their configured one. This lets
+// one producer serve many tenants that each have their own stream. Responses
+// of all the streams are polled by the producer, while trimming and reclaiming
+// are only done on the configured stream and the ones matching StreamPattern.
+func WithStreamOverride(ctx context.Context, stream string) context.Context {
+	return context.WithValue(ctx, streamOverrideKey{}, stream)
+}
+
+// streamFor returns the stream requests produced with the context are added to.
+func (p *Producer[Request, Response]) streamFor(ctx context.Context) string {
+	if stream, ok := ctx.Value(streamOverrideKey{}).(string); ok && stream != "" {
+		return stream
+	}
+	return p.stream()
+}
+
+// groupFor returns the consumer group of the stream, which like for the
+// configured stream is named the same as the stream.
+func (p *Producer[Request, Response]) groupFor(stream string) string {
+	if stream == p.stream() {
+		return p.group()
+	}
+	return stream
+}
@@ -0,0 +1,47 @@
+package pubsub
+
+import (
+	"errors"
+
+	"github.com/offchainlabs/nitro/util/containers"
+)
+
+// Subscribe returns an additional promise for the response of an outstanding
+// request with given message id, resolved with the same response or error as
+// the promise returned when it was produced. Returns nil if the request isn't
+// outstanding.
+func (p *Producer[Request, Response]) Subscribe(msgId string) *containers.Promise[Response] {
+	return p.SubscribeStream(p.stream(), msgId)
+}
+
+// SubscribeStream is like Subscribe, for a request produced to given stream
+// rather than the producer's, e.g. with WithStreamOverride or by affinity.
+// Requests moved to another stream by MigrateTo, or produced again after a
+// retry after, are found by the stream and message id they had before too.
+func (p *Producer[Request, Response]) SubscribeStream(stream, msgId string) *containers.Promise[Response] {
+	_, shard, tracked := p.lockTracked(promiseKey{stream: stream, id: msgId})
+	defer shard.lock.Unlock()
+	if tracked == nil {
+		return nil
+	}
+	subscriber := containers.NewPromise[Response](nil)
+	tracked.subscribers = append(tracked.subscribers, &subscriber)
+	return &subscriber
+}
+
+// notifySubscribers resolves the subscribers with the result of the promise,
+// or ErrRequestCanceled if it stopped being tracked unresolved.
+func (t *trackedPromise[Response]) notifySubscribers() {
+	result, err := t.promise.Current()
+	if errors.Is(err, containers.ErrNotReady) {
+		err = ErrRequestCanceled
+	}
+	for _, subscriber := range t.subscribers {
+		if err != nil {
+			subscriber.ProduceError(err)
+		} else {
+			subscriber.Produce(result)
+		}
+	}
+	t.subscribers = nil
+}
@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	processedWithoutResponseCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/timeout/processed_without_response", nil)
+	neverProcessedCounter           = metrics.NewRegisteredCounter("arb/pubsub/producer/timeout/never_processed", nil)
+)
+
+// timeoutCause tells why a request timed out.
+type timeoutCause int
+
+const (
+	// timeoutNeverProcessed is when no consumer finished the request, it's
+	// either waiting to be delivered or pending with a consumer.
+	timeoutNeverProcessed timeoutCause = iota
+	// timeoutProcessedWithoutResponse is when a consumer acked the request
+	// without writing its response.
+	timeoutProcessedWithoutResponse
+)
+
+// classifyTimeouts logs and meters why each of the requests timed out.
+func (p *Producer[Request, Response]) classifyTimeouts(ctx context.Context, keys []promiseKey) {
+	for _, key := range keys {
+		cause, err := p.timeoutCause(ctx, key)
+		if err != nil {
+			p.logger.Warn("error classifying timed out request", "stream", key.stream, "msgId", key.id, "err", err)
+			continue
+		}
+		switch cause {
+		case timeoutProcessedWithoutResponse:
+			processedWithoutResponseCounter.Inc(1)
+			p.logger.Error("Request timed out after a consumer acked it without a response", "stream", key.stream, "msgId", key.id)
+		case timeoutNeverProcessed:
+			neverProcessedCounter.Inc(1)
+			p.logger.Warn("Request timed out without a consumer finishing it", "stream", key.stream, "msgId", key.id)
+		}
+	}
+}
+
+// reclaimedSet holds the messages the producer reclaimed itself, which are
+// acked without a response although no consumer finished them.
+type reclaimedSet struct {
+	lock sync.Mutex
+	// ids maps reclaimed messages to when they were reclaimed.
+	ids map[promiseKey]time.Time
+}
+
+// recordReclaimed records that the producer acked the message when
+// reclaiming it, so that its timeout isn't classified as processed. Records
+// older than the longest request timeout are dropped, their promises have
+// timed out by then.
+func (p *Producer[Request, Response]) recordReclaimed(key promiseKey) {
+	cfg := p.config()
+	if !cfg.ClassifyTimeouts {
+		return
+	}
+	now := time.Now()
+	p.reclaimed.lock.Lock()
+	defer p.reclaimed.lock.Unlock()
+	if p.reclaimed.ids == nil {
+		p.reclaimed.ids = make(map[promiseKey]time.Time)
+	}
+	for k, at := range p.reclaimed.ids {
+		if now.Sub(at) > cfg.maxRequestTimeout() {
+			delete(p.reclaimed.ids, k)
+		}
+	}
+	p.reclaimed.ids[key] = now
+}
+
+// takeReclaimed returns whether the producer reclaimed the message, and
+// forgets it.
+func (p *Producer[Request, Response]) takeReclaimed(key promiseKey) bool {
+	p.reclaimed.lock.Lock()
+	defer p.reclaimed.lock.Unlock()
+	_, found := p.reclaimed.ids[key]
+	delete(p.reclaimed.ids, key)
+	return found
+}
+
+// timeoutCause returns whether the request was acked, by it having been
+// delivered to the group while not being pending anymore. Requests this
+// producer reclaimed itself were acked by it and not by a consumer, so they
+// weren't processed.
+func (p *Producer[Request, Response]) timeoutCause(ctx context.Context, key promiseKey) (timeoutCause, error) {
+	if p.takeReclaimed(key) {
+		return timeoutNeverProcessed, nil
+	}
+	group := p.groupFor(key.stream)
+	pending, err := p.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: key.stream,
+		Group:  group,
+		Start:  key.id,
+		End:    key.id,
+		Count:  1,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("checking pending entry: %w", err)
+	}
+	if len(pending) > 0 {
+		return timeoutNeverProcessed, nil
+	}
+	groups, err := p.client.XInfoGroups(ctx, key.stream).Result()
+	if err != nil {
+		return 0, fmt.Errorf("getting groups info: %w", err)
+	}
+	for _, g := range groups {
+		if g.Name == group && cmpMsgId(key.id, g.LastDeliveredID) <= 0 {
+			return timeoutProcessedWithoutResponse, nil
+		}
+	}
+	return timeoutNeverProcessed, nil
+}
@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var trimStalledCounter = metrics.NewRegisteredCounter("arb/pubsub/producer/trim/stalled", nil)
+
+// TrimObserver is called after every trim of the stream with the number of
+// entries it freed and whether trimming is stalled. It's called synchronously
+// from the producer's clearing loop, so it must not block.
+type TrimObserver func(trimmed int64, stalled bool)
+
+// WithTrimObserver registers an observer of trims of the stream.
+func WithTrimObserver(observer TrimObserver) ProducerOption {
+	return func(o *producerOptions) {
+		o.trimObserver = observer
+	}
+}
+
+// TrimStalled returns whether the last TrimStallThreshold trims of the stream
+// freed no entries.
+func (p *Producer[Request, Response]) TrimStalled() bool {
+	cfg := p.config()
+	return cfg.TrimStallThreshold != 0 && p.noopTrims.Load() >= int64(cfg.TrimStallThreshold)
+}
+
+// recordTrim tracks the consecutive trims that freed no entries.
+func (p *Producer[Request, Response]) recordTrim(minId string, trimmed int64) {
+	cfg := p.config()
+	if trimmed > 0 {
+		p.noopTrims.Store(0)
+	} else if noops := p.noopTrims.Add(1); cfg.TrimStallThreshold != 0 && noops == int64(cfg.TrimStallThreshold) {
+		p.logger.Warn("Trimming the stream stalled, the lower pending entry might be stuck", "stream", p.stream(), "lower", minId, "trims", noops)
+		trimStalledCounter.Inc(1)
+	}
+	if p.trimObserver != nil {
+		p.trimObserver(trimmed, p.TrimStalled())
+	}
+}
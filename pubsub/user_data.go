@@ -0,0 +1,18 @@
+package pubsub
+
+import "context"
+
+type userDataKey struct{}
+
+// WithUserData returns a context that makes producers store given opaque data
+// with the promises of requests produced with it. The data is passed along
+// with the promise's transitions to the PromiseEventObserver, so callers can
+// tell which operation a response belongs to without mapping message ids.
+func WithUserData(ctx context.Context, data any) context.Context {
+	return context.WithValue(ctx, userDataKey{}, data)
+}
+
+// userData returns the data set on the context with WithUserData, nil if none.
+func userData(ctx context.Context) any {
+	return ctx.Value(userDataKey{})
+}